@@ -3,6 +3,16 @@
 package_name="roulette"
 mkdir -p builds
 
+# embed ruffle assets for flash support
+if [ ! -f types/flash/ruffle/ruffle.js ]; then
+  ./update-ruffle.sh || exit 1
+fi
+
+if [ ! -f types/flash/ruffle/ruffle.js ]; then
+  echo "ruffle assets are missing from types/flash/ruffle" >&2
+  exit 1
+fi
+
 platforms=(
   "aix/ppc64"
   "darwin/amd64"
@@ -0,0 +1,113 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// Sort order which navigates through every file in the index in turn,
+// ordered by directory and then by filename.
+const archiveOrder = "archive"
+
+// Returns the file offset places from the specified one in index order,
+// continuing into neighbouring directories as needed. If within is
+// non-empty, only directories inside that path are considered.
+func (index *fileIndex) adjacent(file, within string, offset int) string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	low, high := index.directoryRange(within)
+
+	dir, _ := path.Split(file)
+
+	d, found := slices.BinarySearch(index.pathIndex[low:high], dir)
+	if !found {
+		return ""
+	}
+
+	d += low
+
+	files := index.pathMap[dir].snapshot()
+
+	i, found := slices.BinarySearch(files, file)
+	if !found {
+		return ""
+	}
+
+	i += offset
+
+	for i < 0 || i >= len(files) {
+		if i < 0 {
+			d--
+
+			if d < low {
+				return ""
+			}
+
+			i += index.pathMap[index.pathIndex[d]].length()
+		} else {
+			i -= len(files)
+
+			d++
+
+			if d >= high {
+				return ""
+			}
+		}
+
+		files = index.pathMap[index.pathIndex[d]].snapshot()
+	}
+
+	return files[i]
+}
+
+// Returns the first and last files in the same directory as the specified
+// one or, if --archive-global is set, in the entire index.
+func (index *fileIndex) archiveBounds(file, within string) (string, string) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	var first, last []string
+
+	if index.app.ArchiveGlobal {
+		low, high := index.directoryRange(within)
+		if low == high {
+			return "", ""
+		}
+
+		first = index.pathMap[index.pathIndex[low]].snapshot()
+		last = index.pathMap[index.pathIndex[high-1]].snapshot()
+	} else {
+		dir, _ := path.Split(file)
+
+		first = index.pathMap[dir].snapshot()
+		last = first
+	}
+
+	if len(first) == 0 || len(last) == 0 {
+		return "", ""
+	}
+
+	return first[0], last[len(last)-1]
+}
+
+func (app *application) archivePaginate(file, within, queryParams string, index *fileIndex) string {
+	first, last := index.archiveBounds(file, within)
+
+	prev := index.adjacent(file, within, -1)
+	next := index.adjacent(file, within, 1)
+
+	var html strings.Builder
+
+	html.WriteString(app.pageButton("First", first, queryParams, first == "" || file == first))
+	html.WriteString(app.pageButton("Prev", prev, queryParams, prev == ""))
+	html.WriteString(app.pageButton("Next", next, queryParams, next == ""))
+	html.WriteString(app.pageButton("Last", last, queryParams, last == "" || file == last))
+
+	return html.String()
+}
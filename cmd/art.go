@@ -0,0 +1,457 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	artPrefix string = `/art`
+
+	// Maximum size of embedded metadata read when looking for album art
+	artMaxSize int64 = 16 << 20
+)
+
+// Images used as album art for audio files without any embedded, in order of preference.
+var artFiles = []string{"cover.jpg", "Cover.jpg", "folder.jpg", "Folder.jpg", "cover.png", "folder.png"}
+
+type albumArt struct {
+	mediaType string
+	data      []byte
+}
+
+// Returns the path component used to request the album art of the specified file.
+func (app *application) artUri(path string) string {
+	return artPrefix + app.pagePath(path)
+}
+
+// Returns the image data, if it is a supported image. The declared media
+// type is only trusted if it agrees with the data itself.
+func newAlbumArt(data []byte) *albumArt {
+	mediaType := http.DetectContentType(data)
+	if !strings.HasPrefix(mediaType, "image/") {
+		return nil
+	}
+
+	return &albumArt{mediaType: mediaType, data: data}
+}
+
+// Returns the size stored in four bytes of seven bits each, as used by ID3v2.
+func syncsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+// Returns the picture in an ID3v2 APIC (or, in version 2.2, PIC) frame.
+func parseApic(frame []byte, version byte) *albumArt {
+	if len(frame) < 1 {
+		return nil
+	}
+
+	encoding, rest := frame[0], frame[1:]
+
+	// Skips the image format (or MIME type) and the picture type
+	if version == 2 {
+		if len(rest) < 4 {
+			return nil
+		}
+
+		rest = rest[4:]
+	} else {
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 || i+2 > len(rest) {
+			return nil
+		}
+
+		rest = rest[i+2:]
+	}
+
+	// Skips the description, terminated by one null byte, or two if UTF-16
+	switch encoding {
+	case 1, 2:
+		for i := 0; ; i += 2 {
+			if i+1 >= len(rest) {
+				return nil
+			}
+
+			if rest[i] == 0 && rest[i+1] == 0 {
+				rest = rest[i+2:]
+
+				break
+			}
+		}
+	default:
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 {
+			return nil
+		}
+
+		rest = rest[i+1:]
+	}
+
+	return newAlbumArt(rest)
+}
+
+// Returns the first picture in the file's ID3v2 tag, if it has one.
+func id3Art(r io.ReaderAt) *albumArt {
+	header := make([]byte, 10)
+
+	_, err := r.ReadAt(header, 0)
+	if err != nil || string(header[:3]) != "ID3" {
+		return nil
+	}
+
+	version, flags := header[3], header[5]
+
+	// Unsynchronised tags are rare, and not supported
+	if flags&0x80 != 0 || version < 2 || version > 4 {
+		return nil
+	}
+
+	size := syncsafe(header[6:10])
+	if int64(size) > artMaxSize {
+		return nil
+	}
+
+	tag := make([]byte, size)
+
+	_, err = r.ReadAt(tag, 10)
+	if err != nil {
+		return nil
+	}
+
+	var offset int
+
+	if flags&0x40 != 0 && len(tag) >= 4 {
+		switch version {
+		case 3:
+			offset = 4 + int(binary.BigEndian.Uint32(tag))
+		case 4:
+			offset = syncsafe(tag)
+		}
+	}
+
+	idLength, headerLength := 4, 10
+	if version == 2 {
+		idLength, headerLength = 3, 6
+	}
+
+	for offset >= 0 && offset+headerLength <= len(tag) {
+		id := string(tag[offset : offset+idLength])
+		if id[0] == 0 {
+			break
+		}
+
+		var frameSize int
+
+		switch version {
+		case 2:
+			frameSize = int(tag[offset+3])<<16 | int(tag[offset+4])<<8 | int(tag[offset+5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(tag[offset+4:]))
+		case 4:
+			frameSize = syncsafe(tag[offset+4:])
+		}
+
+		start := offset + headerLength
+		end := start + frameSize
+
+		if frameSize < 0 || end > len(tag) {
+			break
+		}
+
+		if id == "APIC" || id == "PIC" {
+			return parseApic(tag[start:end], version)
+		}
+
+		offset = end
+	}
+
+	return nil
+}
+
+// Returns the picture in a FLAC file's PICTURE metadata block, if it has one.
+func flacArt(r io.ReaderAt) *albumArt {
+	header := make([]byte, 4)
+
+	_, err := r.ReadAt(header, 0)
+	if err != nil || string(header) != "fLaC" {
+		return nil
+	}
+
+	offset := int64(4)
+
+	for {
+		_, err := r.ReadAt(header, offset)
+		if err != nil {
+			return nil
+		}
+
+		last, kind := header[0]&0x80 != 0, header[0]&0x7f
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+
+		offset += 4
+
+		if kind == 6 {
+			if length > artMaxSize {
+				return nil
+			}
+
+			block := make([]byte, length)
+
+			_, err = r.ReadAt(block, offset)
+			if err != nil {
+				return nil
+			}
+
+			return parseFlacPicture(block)
+		}
+
+		if last {
+			return nil
+		}
+
+		offset += length
+	}
+}
+
+func parseFlacPicture(block []byte) *albumArt {
+	var position int
+
+	next := func(n int) []byte {
+		if n < 0 || position+n > len(block) {
+			return nil
+		}
+
+		field := block[position : position+n]
+
+		position += n
+
+		return field
+	}
+
+	length := func() int {
+		field := next(4)
+		if field == nil {
+			return -1
+		}
+
+		return int(binary.BigEndian.Uint32(field))
+	}
+
+	// Picture type, MIME type, description, then dimensions and color depth
+	if next(4) == nil || next(length()) == nil || next(length()) == nil || next(16) == nil {
+		return nil
+	}
+
+	data := next(length())
+	if data == nil {
+		return nil
+	}
+
+	return newAlbumArt(data)
+}
+
+// Returns the cover in an MP4 file's iTunes metadata, if it has one.
+func mp4Art(r io.ReaderAt, size int64) *albumArt {
+	header := make([]byte, 16)
+
+	_, err := r.ReadAt(header[:8], 0)
+	if err != nil || string(header[4:8]) != "ftyp" {
+		return nil
+	}
+
+	start, end := int64(0), size
+
+	for _, name := range []string{"moov", "udta", "meta", "ilst", "covr", "data"} {
+		found := false
+
+		for offset := start; offset+8 <= end; {
+			_, err := r.ReadAt(header[:8], offset)
+			if err != nil {
+				return nil
+			}
+
+			atomSize, headerSize := int64(binary.BigEndian.Uint32(header)), int64(8)
+			kind := string(header[4:8])
+
+			switch atomSize {
+			case 0:
+				atomSize = end - offset
+			case 1:
+				_, err := r.ReadAt(header[8:16], offset+8)
+				if err != nil {
+					return nil
+				}
+
+				atomSize, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+			}
+
+			if atomSize < headerSize || offset+atomSize > end {
+				return nil
+			}
+
+			if kind == name {
+				start, end = offset+headerSize, offset+atomSize
+				found = true
+
+				break
+			}
+
+			offset += atomSize
+		}
+
+		if !found {
+			return nil
+		}
+
+		// The meta atom usually carries a version and flags before its
+		// children, except in files written by some QuickTime encoders
+		if name == "meta" && end-start >= 8 {
+			_, err := r.ReadAt(header[:8], start)
+			if err != nil {
+				return nil
+			}
+
+			if string(header[4:8]) != "hdlr" {
+				start += 4
+			}
+		}
+	}
+
+	// The data atom's payload begins with its type and locale
+	if end-start < 8 || end-start > artMaxSize {
+		return nil
+	}
+
+	payload := make([]byte, end-start)
+
+	_, err = r.ReadAt(payload, start)
+	if err != nil {
+		return nil
+	}
+
+	return newAlbumArt(payload[8:])
+}
+
+// Returns the album art embedded in the audio file, or failing that, an
+// image in the same directory (e.g. folder.jpg). Returns nil if neither
+// is found.
+func readAlbumArt(path string) *albumArt {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+
+	art := id3Art(file)
+	if art == nil {
+		art = flacArt(file)
+	}
+	if art == nil {
+		art = mp4Art(file, info.Size())
+	}
+	if art != nil {
+		return art
+	}
+
+	dir := filepath.Dir(path)
+
+	for _, name := range artFiles {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || info.Size() > artMaxSize {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+
+		art = newAlbumArt(data)
+		if art != nil {
+			return art
+		}
+	}
+
+	return nil
+}
+
+func (app *application) serveAlbumArt(paths []string, vhosts map[string]string, index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		path := p.ByName("media")
+
+		switch {
+		case app.HashPaths:
+			resolved, found := index.resolve(path)
+			if !found {
+				app.notFound(w, r, path)
+
+				return
+			}
+
+			path = resolved
+		case runtime.GOOS == "windows":
+			path = fromUrlPath(path)
+		}
+
+		path, err := filepath.EvalSymlinks(path)
+		if err != nil || !app.pathIsValid(path, app.servedPaths(r, paths, vhosts)) {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		art := readAlbumArt(path)
+		if art == nil {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", art.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(art.data)))
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		written, err := w.Write(art.data)
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Album art of %s (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				path,
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A single administrative action, as written to the audit file.
+type auditEntry struct {
+	Time       string `json:"time"`
+	Action     string `json:"action"`
+	Client     string `json:"client"`
+	RequestId  string `json:"request_id"`
+	Authorized bool   `json:"authorized"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Query      string `json:"query,omitempty"`
+	Status     int    `json:"status"`
+	Outcome    string `json:"outcome"`
+	Duration   string `json:"duration"`
+}
+
+// Appends administrative actions to --audit-file as JSON lines.
+type auditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func (app *application) newAuditLog() (*auditLog, error) {
+	if app.AuditFile == "" {
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(app.AuditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{file: file}, nil
+}
+
+func (audit *auditLog) record(entry auditEntry, errorChannel chan<- error) {
+	if audit == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	_, err = audit.file.Write(append(line, '\n'))
+	if err != nil {
+		errorChannel <- err
+	}
+}
+
+func (audit *auditLog) Close() error {
+	if audit == nil {
+		return nil
+	}
+
+	return audit.file.Close()
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Records each invocation of an administrative endpoint, along with
+// the client which made it and whether it succeeded.
+func (app *application) audited(action string, next httprouter.Handle, errorChannel chan<- error) httprouter.Handle {
+	if app.audit == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		sw := &statusWriter{ResponseWriter: w}
+
+		next(sw, r, p)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		outcome := "success"
+		if sw.status >= http.StatusBadRequest {
+			outcome = "failure"
+		}
+
+		app.audit.record(auditEntry{
+			Time:       startTime.Format(time.RFC3339Nano),
+			Action:     action,
+			Client:     app.clientAddress(r),
+			RequestId:  requestId(r),
+			Authorized: app.authorized(r),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      r.URL.RawQuery,
+			Status:     sw.status,
+			Outcome:    outcome,
+			Duration:   time.Since(startTime).Round(time.Microsecond).String(),
+		}, errorChannel)
+	}
+}
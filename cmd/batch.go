@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types"
+)
+
+const (
+	batchDefaultCount int = 10
+	batchMaxCount     int = 100
+
+	// Number of selections attempted per requested file, before
+	// giving up on finding enough distinct files
+	batchAttempts int = 10
+)
+
+type batchFile struct {
+	Name   string `json:"name"`
+	View   string `json:"view"`
+	Source string `json:"source"`
+}
+
+func batchCount(r *http.Request) int {
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	switch {
+	case err != nil || count < 1:
+		return batchDefaultCount
+	case count > batchMaxCount:
+		return batchMaxCount
+	default:
+		return count
+	}
+}
+
+// Selects up to count distinct random files, using the same
+// selection logic as the root path.
+func (app *application) pickBatch(r *http.Request, paths []string, vhosts map[string]string, index *fileIndex, stats *serveStats, count int, formats types.Types, errorChannel chan<- error) []string {
+	within := app.vhostPath(r, vhosts)
+
+	rng := app.seedParams(r).source()
+
+	picked := make([]string, 0, count)
+
+	seen := make(map[string]bool, count)
+
+	var list []string
+
+	for attempts := 0; len(picked) < count && attempts < count*batchAttempts; attempts++ {
+		// Without an index, each call to fileList re-scans all paths
+		if app.Index || list == nil {
+			list = app.freshFileList(r.Context(), paths, within, index, stats, rng, formats, errorChannel)
+		}
+
+		if len(list) == 0 {
+			break
+		}
+
+		path, err := app.pickFile(list, stats, rng)
+		if err != nil || path == "" {
+			break
+		}
+
+		if seen[path] {
+			continue
+		}
+
+		seen[path] = true
+
+		picked = append(picked, path)
+	}
+
+	return picked
+}
+
+func (app *application) serveBatch(paths []string, vhosts map[string]string, index *fileIndex, stats *serveStats, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		picked := app.pickBatch(r, paths, vhosts, index, stats, batchCount(r), formats, errorChannel)
+
+		root := app.rootUrl(r)
+
+		files := make([]batchFile, len(picked))
+
+		for i, path := range picked {
+			files[i] = batchFile{
+				Name:   filepath.Base(path),
+				View:   root + app.mediaUri(path),
+				Source: root + app.generateFileUri(path),
+			}
+		}
+
+		app.serveJson(w, r, "Batch of random files", files, errorChannel)
+	}
+}
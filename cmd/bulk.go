@@ -0,0 +1,276 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types"
+)
+
+// Maximum number of files a single bulk request may act on.
+const bulkMaxFiles int = 1000
+
+// An action to apply to each of the specified files.
+type bulkRequest struct {
+	Action      string   `json:"action"`
+	Paths       []string `json:"paths"`
+	Destination string   `json:"destination,omitempty"`
+	Collection  string   `json:"collection,omitempty"`
+}
+
+// The outcome of the action for one of the requested files.
+type bulkResult struct {
+	Path        string `json:"path"`
+	Destination string `json:"destination,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Moves the file into the destination directory, returning its new path.
+func (app *application) bulkMove(path, destination string, index *fileIndex, formats types.Types) (string, error) {
+	destination = filepath.Join(destination, filepath.Base(path))
+
+	exists, err := fileExists(destination)
+	switch {
+	case err != nil:
+		return "", err
+	case exists:
+		return "", os.ErrExist
+	}
+
+	err = os.Rename(path, destination)
+	if err != nil {
+		return "", err
+	}
+
+	if app.Index {
+		index.move(path, destination, app.isSupported(destination, formats))
+	}
+
+	return destination, nil
+}
+
+// Returns the actions accepted by the bulk endpoint.
+func (app *application) bulkActions() []string {
+	if app.Collections {
+		return []string{"add", "delete", "move"}
+	}
+
+	return []string{"delete", "move"}
+}
+
+// Applies a delete, move, or addition to a collection to each of the
+// requested files, responding with the outcome for each. Failures for
+// individual files do not stop the rest.
+func (app *application) serveBulk(paths []string, vhosts map[string]string, index *fileIndex, notify *notifier, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		if !app.authorized(r) {
+			app.unauthorized(w, r)
+
+			return
+		}
+
+		var request bulkRequest
+
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		decoder.DisallowUnknownFields()
+
+		err := decoder.Decode(&request)
+		if err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		switch {
+		case !slices.Contains(app.bulkActions(), request.Action):
+			http.Error(w, "Action must be one of "+strings.Join(app.bulkActions(), ", "), http.StatusBadRequest)
+
+			return
+		case len(request.Paths) == 0 || len(request.Paths) > bulkMaxFiles:
+			http.Error(w, fmt.Sprintf("Between 1 and %d paths must be specified", bulkMaxFiles), http.StatusBadRequest)
+
+			return
+		case request.Action == "add" && !validCollection(request.Collection):
+			http.Error(w, fmt.Sprintf("Collection names must be at most %d letters, digits, dots, dashes or underscores", collectionMaxLength), http.StatusBadRequest)
+
+			return
+		}
+
+		destination := filepath.Clean(request.Destination)
+
+		if request.Action == "move" {
+			info, err := os.Stat(destination)
+			if !filepath.IsAbs(destination) || !app.pathIsValid(destination, app.servedPaths(r, paths, vhosts)) || err != nil || !info.IsDir() {
+				http.Error(w, "Destination must be a directory inside a served path", http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		results := make([]bulkResult, 0, len(request.Paths))
+
+		var failed int
+
+		for _, requested := range request.Paths {
+			result := bulkResult{Path: requested}
+
+			path, ok := app.requestedPath(r, requested, paths, vhosts, index)
+
+			exists := false
+			if ok {
+				exists, err = fileExists(path)
+			}
+
+			switch {
+			case !ok || (err == nil && !exists):
+				err = os.ErrNotExist
+			case err != nil:
+			case request.Action == "delete":
+				err = app.kill(path, index, notify)
+			case request.Action == "move":
+				result.Destination, err = app.bulkMove(path, destination, index, formats)
+			case request.Action == "add":
+				_, err = app.collections.add(request.Collection, path)
+			}
+
+			if err != nil {
+				failed++
+
+				result.Error = err.Error()
+
+				if ok && !os.IsNotExist(err) && !os.IsExist(err) && !errors.Is(err, ErrCollectionLimit) {
+					errorChannel <- err
+				}
+			}
+
+			if app.HashPaths && result.Destination != "" {
+				result.Destination = hashedPrefix + hashPath(result.Destination)
+			}
+
+			results = append(results, result)
+		}
+
+		index.Export(errorChannel)
+
+		if app.verbose() {
+			fmt.Printf("%s | BULK: %s of %d/%d files by %s in %s\n",
+				startTime.Format(logDate),
+				request.Action,
+				len(results)-failed,
+				len(results),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+
+		app.serveJson(w, r, "Bulk "+request.Action, results, errorChannel)
+	}
+}
+
+// Serves a page of randomly selected files, any of which can be selected
+// and then deleted, moved, or added to a collection via the bulk endpoint.
+func (app *application) serveBulkPage(paths []string, vhosts map[string]string, index *fileIndex, stats *serveStats, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		nonce, err := newNonce()
+		if err != nil {
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		}
+
+		picked := app.pickBatch(r, paths, vhosts, index, stats, batchCount(r), formats, errorChannel)
+
+		var htmlBody strings.Builder
+
+		htmlBody.WriteString(`<!DOCTYPE html><html lang="en"><head>`)
+		htmlBody.WriteString(getFavicon())
+		htmlBody.WriteString(`<style>body{font-family:sans-serif;margin:1em;}`)
+		htmlBody.WriteString(`.files{display:flex;flex-wrap:wrap;gap:1em;margin-top:1em;}`)
+		htmlBody.WriteString(`.files label{display:flex;flex-direction:column;align-items:center;width:12em;word-break:break-all;}`)
+		htmlBody.WriteString(`.files img{max-width:12em;max-height:12em;object-fit:contain;}`)
+		htmlBody.WriteString(`button,input{margin-right:.5em;}</style>`)
+		htmlBody.WriteString(fmt.Sprintf(`<title>roulette v%s</title></head><body>`, ReleaseVersion))
+
+		htmlBody.WriteString(`<form id="bulk">`)
+		htmlBody.WriteString(`<input type="password" name="token" placeholder="Admin token" required autocomplete="current-password">`)
+		if app.Collections {
+			htmlBody.WriteString(fmt.Sprintf(`<input name="collection" list="collections" placeholder="Collection" maxlength="%d" pattern="[A-Za-z0-9._\-]+">`, collectionMaxLength))
+			htmlBody.WriteString(`<datalist id="collections">`)
+			for _, name := range app.collections.names() {
+				htmlBody.WriteString(fmt.Sprintf(`<option value="%s">`, html.EscapeString(name)))
+			}
+			htmlBody.WriteString(`</datalist>`)
+			htmlBody.WriteString(`<button type="button" data-bulk="add">Add to collection</button>`)
+		}
+		htmlBody.WriteString(`<input name="destination" placeholder="Destination directory">`)
+		htmlBody.WriteString(`<button type="button" data-bulk="move">Move</button>`)
+		htmlBody.WriteString(`<button type="button" data-bulk="delete">Delete</button>`)
+
+		htmlBody.WriteString(`<div class="files">`)
+		for _, path := range picked {
+			value := path
+			if app.HashPaths {
+				value = hashedPrefix + hashPath(path)
+			}
+
+			fileName := html.EscapeString(filepath.Base(path))
+
+			htmlBody.WriteString(fmt.Sprintf(`<label><input type="checkbox" name="path" value="%s">`, html.EscapeString(value)))
+
+			format := formats.FileType(path)
+			if format != nil && format.Name() == "images" {
+				htmlBody.WriteString(fmt.Sprintf(`<img src="%s" alt="%s" loading="lazy">`,
+					html.EscapeString(app.Prefix+app.generateFileUri(path)),
+					fileName))
+			}
+
+			htmlBody.WriteString(fmt.Sprintf(`<a href="%s">%s</a></label>`,
+				html.EscapeString(app.Prefix+app.mediaUri(path)),
+				fileName))
+		}
+		htmlBody.WriteString(`</div></form>`)
+
+		htmlBody.WriteString(app.bulkScript(nonce))
+
+		htmlBody.WriteString(`</body></html>`)
+
+		w.Header().Set("Content-Type", "text/html")
+
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy(nonce, nil))
+
+		written, err := w.Write([]byte(htmlBody.String()))
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Selection of %d files (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				len(picked),
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond))
+		}
+	}
+}
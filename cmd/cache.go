@@ -0,0 +1,499 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types"
+)
+
+// Kinds of artifact derived from media files, which are cached.
+const (
+	cacheStoryboard string = "storyboard"
+	cacheStripped   string = "stripped"
+	cacheTranscode  string = "transcode"
+)
+
+var cacheKinds = []string{cacheStoryboard, cacheStripped, cacheTranscode}
+
+type cacheEntry struct {
+	key  string
+	kind string
+	size int64
+
+	// Contents of the entry, if the cache is held in memory
+	data []byte
+}
+
+type cacheCounts struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Size      string `json:"size"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type cacheReport struct {
+	Dir     string                  `json:"dir,omitempty"`
+	MaxSize string                  `json:"max_size"`
+	Size    string                  `json:"size"`
+	Kinds   map[string]*cacheCounts `json:"kinds"`
+}
+
+// A least-recently-used cache of artifacts derived from media files,
+// such as stripped images and storyboards, limited to a total size. If
+// a directory is configured, entries are stored there and survive
+// restarts; otherwise they are held in memory, and transcodes (which
+// are too large for that) are not cached at all.
+type artifactCache struct {
+	app *application
+
+	dir     string
+	maxSize int64
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int64
+	counts  map[string]*cacheCounts
+}
+
+func (app *application) newArtifactCache() (*artifactCache, error) {
+	maxSize, err := types.ParseSize(app.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &artifactCache{
+		app:     app,
+		dir:     app.CacheDir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		counts:  make(map[string]*cacheCounts),
+	}
+
+	for _, kind := range cacheKinds {
+		cache.counts[kind] = &cacheCounts{}
+	}
+
+	if cache.dir == "" {
+		return cache, nil
+	}
+
+	err = os.MkdirAll(cache.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cache.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+// Returns the key of an artifact derived from the file, which changes
+// whenever the file does.
+func cacheKey(kind, path string, info os.FileInfo) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", path, info.Size(), info.ModTime().UnixNano())))
+
+	return kind + "-" + hex.EncodeToString(hash[:])
+}
+
+// Adds the entries already present in the cache directory, ordered by
+// when they were last used, and removes any left behind part way through
+// being written.
+func (cache *artifactCache) load() error {
+	files, err := os.ReadDir(cache.dir)
+	if err != nil {
+		return err
+	}
+
+	type found struct {
+		entry   *cacheEntry
+		modTime time.Time
+	}
+
+	var existing []found
+
+	for _, file := range files {
+		name := file.Name()
+
+		if strings.HasPrefix(name, ".") {
+			os.Remove(filepath.Join(cache.dir, name))
+
+			continue
+		}
+
+		kind, _, valid := strings.Cut(name, "-")
+		if !valid || !slices.Contains(cacheKinds, kind) {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		existing = append(existing, found{
+			entry:   &cacheEntry{key: name, kind: kind, size: info.Size()},
+			modTime: info.ModTime(),
+		})
+	}
+
+	slices.SortFunc(existing, func(a, b found) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for _, f := range existing {
+		cache.add(f.entry)
+	}
+
+	cache.evict()
+
+	return nil
+}
+
+func (cache *artifactCache) path(key string) string {
+	return filepath.Join(cache.dir, key)
+}
+
+// Adds an entry as the most recently used. The mutex must be held.
+func (cache *artifactCache) add(entry *cacheEntry) {
+	cache.forget(entry.key)
+
+	cache.entries[entry.key] = cache.order.PushFront(entry)
+	cache.size += entry.size
+
+	counts := cache.counts[entry.kind]
+	counts.Entries++
+	counts.Bytes += entry.size
+}
+
+// Removes an entry from the cache, returning it if present, but leaves
+// its file in place. The mutex must be held.
+func (cache *artifactCache) forget(key string) *cacheEntry {
+	element, found := cache.entries[key]
+	if !found {
+		return nil
+	}
+
+	entry := element.Value.(*cacheEntry)
+
+	cache.order.Remove(element)
+	delete(cache.entries, key)
+	cache.size -= entry.size
+
+	counts := cache.counts[entry.kind]
+	counts.Entries--
+	counts.Bytes -= entry.size
+
+	return entry
+}
+
+// Removes an entry, along with its file if the cache is on disk. The
+// mutex must be held.
+func (cache *artifactCache) remove(key string) *cacheEntry {
+	entry := cache.forget(key)
+
+	if entry != nil && cache.dir != "" {
+		os.Remove(cache.path(key))
+	}
+
+	return entry
+}
+
+// Removes the least recently used entries until the cache fits within
+// its maximum size. The mutex must be held.
+func (cache *artifactCache) evict() {
+	for cache.size > cache.maxSize && cache.order.Len() > 0 {
+		entry := cache.remove(cache.order.Back().Value.(*cacheEntry).key)
+
+		cache.counts[entry.kind].Evictions++
+	}
+}
+
+// Marks an entry as the most recently used, returning it if present.
+func (cache *artifactCache) touch(kind, key string) *cacheEntry {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, found := cache.entries[key]
+
+	// Adds entries written by another process sharing the directory,
+	// such as roulette warm
+	if !found && cache.dir != "" {
+		info, err := os.Stat(cache.path(key))
+		if err == nil && info.Mode().IsRegular() {
+			cache.add(&cacheEntry{key: key, kind: kind, size: info.Size()})
+			cache.evict()
+
+			element, found = cache.entries[key]
+		}
+	}
+
+	if !found {
+		cache.counts[kind].Misses++
+
+		return nil
+	}
+
+	cache.counts[kind].Hits++
+
+	cache.order.MoveToFront(element)
+
+	// Preserves the order across restarts
+	if cache.dir != "" {
+		now := time.Now()
+
+		os.Chtimes(cache.path(key), now, now)
+	}
+
+	return element.Value.(*cacheEntry)
+}
+
+// Returns whether the artifact is cached, without marking it as used.
+func (cache *artifactCache) contains(key string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	_, found := cache.entries[key]
+
+	return found
+}
+
+// Returns the cached artifact, or generates and caches it if absent.
+func (cache *artifactCache) fetch(kind, key string, generate func() ([]byte, error)) ([]byte, error) {
+	entry := cache.touch(kind, key)
+	if entry != nil {
+		if cache.dir == "" {
+			return entry.data, nil
+		}
+
+		data, err := os.ReadFile(cache.path(key))
+		if err == nil {
+			return data, nil
+		}
+
+		cache.mutex.Lock()
+		cache.remove(key)
+		cache.mutex.Unlock()
+	}
+
+	data, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > cache.maxSize {
+		return data, nil
+	}
+
+	entry = &cacheEntry{key: key, kind: kind, size: int64(len(data))}
+
+	if cache.dir == "" {
+		entry.data = data
+	} else {
+		err = writeAtomic(cache.path(key), func(w io.Writer) error {
+			_, err := w.Write(data)
+
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.add(entry)
+	cache.evict()
+
+	return data, nil
+}
+
+// Returns the file holding the cached artifact, if the cache is on disk
+// and the artifact is present.
+func (cache *artifactCache) open(kind, key string) *os.File {
+	if cache.dir == "" || cache.touch(kind, key) == nil {
+		return nil
+	}
+
+	file, err := os.Open(cache.path(key))
+	if err != nil {
+		cache.mutex.Lock()
+		cache.remove(key)
+		cache.mutex.Unlock()
+
+		return nil
+	}
+
+	return file
+}
+
+// An artifact being written to the cache as it is generated, which is
+// only added once complete.
+type cacheWriter struct {
+	*os.File
+	cache *artifactCache
+	key   string
+	kind  string
+}
+
+// Returns a writer for the artifact, or nil if the cache is not on disk.
+func (cache *artifactCache) create(kind, key string) *cacheWriter {
+	if cache.dir == "" || cache.maxSize == 0 {
+		return nil
+	}
+
+	file, err := os.CreateTemp(cache.dir, "."+key+".*")
+	if err != nil {
+		return nil
+	}
+
+	return &cacheWriter{File: file, cache: cache, key: key, kind: kind}
+}
+
+// Adds the artifact to the cache, if it fits.
+func (writer *cacheWriter) commit() error {
+	temporary := writer.Name()
+
+	info, err := writer.Stat()
+	if err == nil {
+		err = writer.Close()
+	}
+
+	if err == nil && info.Size() <= writer.cache.maxSize {
+		err = os.Rename(temporary, writer.cache.path(writer.key))
+		if err == nil {
+			writer.cache.mutex.Lock()
+			defer writer.cache.mutex.Unlock()
+
+			writer.cache.add(&cacheEntry{key: writer.key, kind: writer.kind, size: info.Size()})
+			writer.cache.evict()
+
+			return nil
+		}
+	}
+
+	os.Remove(temporary)
+
+	return err
+}
+
+// Discards the partially written artifact.
+func (writer *cacheWriter) abort() {
+	writer.Close()
+
+	os.Remove(writer.Name())
+}
+
+// Removes every entry of the specified kind, or all entries if empty,
+// returning the number removed and their total size.
+func (cache *artifactCache) purge(kind string) (int, int64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	var removed int
+	var size int64
+
+	for element := cache.order.Front(); element != nil; {
+		next := element.Next()
+
+		entry := element.Value.(*cacheEntry)
+
+		if kind == "" || entry.kind == kind {
+			removed++
+			size += entry.size
+
+			cache.remove(entry.key)
+		}
+
+		element = next
+	}
+
+	return removed, size
+}
+
+func (cache *artifactCache) report() cacheReport {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	report := cacheReport{
+		Dir:     cache.dir,
+		MaxSize: cache.app.humanReadableSize(int(cache.maxSize)),
+		Size:    cache.app.humanReadableSize(int(cache.size)),
+		Kinds:   make(map[string]*cacheCounts, len(cache.counts)),
+	}
+
+	for kind, counts := range cache.counts {
+		c := *counts
+		c.Size = cache.app.humanReadableSize(int(c.Bytes))
+
+		report.Kinds[kind] = &c
+	}
+
+	return report
+}
+
+func (app *application) serveCacheStats(cache *artifactCache, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Cache statistics", cache.report(), errorChannel)
+	}
+}
+
+// Removes cached artifacts, optionally only those of the kind specified
+// by the kind query parameter.
+func (app *application) serveCachePurge(cache *artifactCache, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		kind := r.URL.Query().Get("kind")
+		if kind != "" && !slices.Contains(cacheKinds, kind) {
+			http.Error(w, "Cache kind must be one of "+strings.Join(cacheKinds, ", "), http.StatusBadRequest)
+
+			return
+		}
+
+		removed, size := cache.purge(kind)
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Cache purge of %d entries (%s) requested by %s\n",
+				time.Now().Format(logDate),
+				removed,
+				app.humanReadableSize(int(size)),
+				requester(r))
+		}
+
+		w.Header().Add("Content-Security-Policy", "default-src 'self';")
+
+		w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+
+		_, err := w.Write([]byte(fmt.Sprintf("Removed %d cached entries (%s)\n", removed, app.humanReadableSize(int(size)))))
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"seedno.de/seednode/roulette/types"
+)
+
+// Maximum number of bytes read from a caption file
+const captionMaxSize int64 = 4096
+
+var captionExtensions = []string{".caption", ".txt"}
+
+// Returns the contents of a sidecar caption file for the specified path
+// (e.g. photo.caption or photo.txt for photo.jpg), if one exists.
+func readCaption(path string) string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+
+	for _, extension := range captionExtensions {
+		file, err := os.Open(base + extension)
+		if err != nil {
+			continue
+		}
+
+		contents, err := io.ReadAll(io.LimitReader(file, captionMaxSize))
+
+		file.Close()
+
+		if err != nil {
+			continue
+		}
+
+		caption := strings.TrimSpace(string(contents))
+		if caption != "" {
+			return caption
+		}
+	}
+
+	return ""
+}
+
+// Returns the names, without extensions, of the images and videos
+// among the entries of a directory.
+func captionedNames(nodes []fs.DirEntry, formats types.Types) map[string]bool {
+	names := make(map[string]bool)
+
+	for _, node := range nodes {
+		if node.IsDir() {
+			continue
+		}
+
+		format := formats.FileType(node.Name())
+		if format == nil || (format.Name() != "images" && format.Name() != "video") {
+			continue
+		}
+
+		names[strings.TrimSuffix(node.Name(), filepath.Ext(node.Name()))] = true
+	}
+
+	return names
+}
+
+// Returns whether the file is a sidecar caption for an image or video in the
+// same directory, which is displayed alongside it rather than served itself.
+func isCaption(name string, captioned map[string]bool) bool {
+	extension := filepath.Ext(name)
+
+	return slices.Contains(captionExtensions, extension) && captioned[strings.TrimSuffix(name, extension)]
+}
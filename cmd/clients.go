@@ -0,0 +1,197 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Maximum number of clients tracked at once. Beyond this, the least
+// recently active client is forgotten to make room for each new one.
+const maxClients int = 10000
+
+type clientRecord struct {
+	requests   int
+	files      int
+	bytes      int64
+	lastActive time.Time
+}
+
+type clientSummary struct {
+	Address    string `json:"address"`
+	Requests   int    `json:"requests"`
+	Files      int    `json:"files"`
+	Bytes      int64  `json:"bytes"`
+	Size       string `json:"size"`
+	LastActive string `json:"last_active"`
+	lastActive time.Time
+}
+
+// Per-client request, file, and byte counts, keyed by address.
+type clientStats struct {
+	app *application
+
+	mutex   sync.Mutex
+	clients map[string]*clientRecord
+}
+
+func (app *application) newClientStats() *clientStats {
+	if !app.API || !app.Stats {
+		return nil
+	}
+
+	return &clientStats{
+		app:     app,
+		clients: make(map[string]*clientRecord),
+	}
+}
+
+// Returns the address of the client, without its port. The address set
+// by Cf-Connecting-Ip or X-Real-Ip is only used if the request was
+// received from a trusted proxy, as any client could otherwise claim
+// an arbitrary address.
+func (app *application) clientAddress(r *http.Request) string {
+	address := r.RemoteAddr
+	if app.fromTrustedProxy(r) {
+		address = realIP(r)
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return host
+}
+
+// Returns the record for the client, creating it if needed.
+// Callers must hold the lock.
+func (stats *clientStats) client(address string) *clientRecord {
+	record, found := stats.clients[address]
+	if found {
+		return record
+	}
+
+	if len(stats.clients) >= maxClients {
+		var oldest string
+
+		for k, v := range stats.clients {
+			if oldest == "" || v.lastActive.Before(stats.clients[oldest].lastActive) {
+				oldest = k
+			}
+		}
+
+		delete(stats.clients, oldest)
+	}
+
+	record = &clientRecord{}
+
+	stats.clients[address] = record
+
+	return record
+}
+
+func (stats *clientStats) request(address string, written int64) {
+	if stats == nil {
+		return
+	}
+
+	stats.mutex.Lock()
+	record := stats.client(address)
+	record.requests++
+	record.bytes += written
+	record.lastActive = time.Now()
+	stats.mutex.Unlock()
+}
+
+// Records that a file was served to the client.
+func (stats *clientStats) served(r *http.Request) {
+	if stats == nil {
+		return
+	}
+
+	stats.mutex.Lock()
+	stats.client(stats.app.clientAddress(r)).files++
+	stats.mutex.Unlock()
+}
+
+// Returns all tracked clients, most recently active first.
+func (stats *clientStats) summary() []clientSummary {
+	stats.mutex.Lock()
+	records := make(map[string]clientRecord, len(stats.clients))
+	for k, v := range stats.clients {
+		records[k] = *v
+	}
+	stats.mutex.Unlock()
+
+	summary := make([]clientSummary, 0, len(records))
+
+	for address, record := range records {
+		summary = append(summary, clientSummary{
+			Address:    address,
+			Requests:   record.requests,
+			Files:      record.files,
+			Bytes:      record.bytes,
+			Size:       stats.app.humanReadableSize(int(record.bytes)),
+			LastActive: record.lastActive.Format(logDate),
+			lastActive: record.lastActive,
+		})
+	}
+
+	slices.SortFunc(summary, func(a, b clientSummary) int {
+		if !a.lastActive.Equal(b.lastActive) {
+			return b.lastActive.Compare(a.lastActive)
+		}
+
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	return summary
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+
+	cw.written += int64(n)
+
+	return n, err
+}
+
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Counts the requests made by, and bytes sent to, each client.
+func (app *application) withClients(next http.Handler) http.Handler {
+	if app.clients == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingWriter{ResponseWriter: w}
+
+		next.ServeHTTP(cw, r)
+
+		app.clients.request(app.clientAddress(r), cw.written)
+	})
+}
+
+func (app *application) serveClients(errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Client report", app.clients.summary(), errorChannel)
+	}
+}
@@ -0,0 +1,517 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	collectionsPrefix string = `/collections`
+
+	collectionMaxLength int = 64
+
+	// Maximum number of collections, and of files in each, to bound the
+	// memory and state used
+	collectionsMax     int = 100
+	collectionMaxFiles int = 10000
+)
+
+var collectionName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+type collectionSummary struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+}
+
+// Named lists of files, persisted via --state-dir if set.
+type collectionStore struct {
+	app *application
+
+	mutex sync.RWMutex
+	files map[string][]string
+}
+
+func validCollection(name string) bool {
+	return len(name) <= collectionMaxLength && collectionName.MatchString(name)
+}
+
+// Returns the collection named by the query parameter, if it is valid.
+func (app *application) collectionParam(r *http.Request) string {
+	name := r.URL.Query().Get("collection")
+	if !app.Collections || !validCollection(name) {
+		return ""
+	}
+
+	return name
+}
+
+func (app *application) newCollectionStore() (*collectionStore, error) {
+	if !app.Collections {
+		return nil, nil
+	}
+
+	store := &collectionStore{
+		app:   app,
+		files: make(map[string][]string),
+	}
+
+	contents, err := app.loadState("", stateCollectionsKey)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return store, nil
+	case err != nil:
+		return nil, err
+	}
+
+	err = json.Unmarshal(contents, &store.files)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Writes the collections to disk, if persisted. The mutex must be held.
+func (store *collectionStore) save() error {
+	if store.app.state == nil {
+		return nil
+	}
+
+	contents, err := json.Marshal(store.files)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.app.saveState("", stateCollectionsKey, func(w io.Writer) error {
+		_, err := w.Write(contents)
+
+		return err
+	})
+
+	return err
+}
+
+func (store *collectionStore) list() []collectionSummary {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	summaries := make([]collectionSummary, 0, len(store.files))
+
+	for name, files := range store.files {
+		summaries = append(summaries, collectionSummary{Name: name, Files: len(files)})
+	}
+
+	slices.SortFunc(summaries, func(a, b collectionSummary) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return summaries
+}
+
+func (store *collectionStore) names() []string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	names := make([]string, 0, len(store.files))
+
+	for name := range store.files {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// Returns the files in the collection, in the order they were added.
+func (store *collectionStore) get(name string) ([]string, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	files, found := store.files[name]
+
+	return slices.Clone(files), found
+}
+
+// Adds the file to the collection, creating it if needed. Returns whether
+// it was added, rather than already present.
+func (store *collectionStore) add(name, path string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	files, found := store.files[name]
+
+	switch {
+	case slices.Contains(files, path):
+		return false, nil
+	case !found && len(store.files) >= collectionsMax:
+		return false, fmt.Errorf("%w: at most %d collections can be created", ErrCollectionLimit, collectionsMax)
+	case len(files) >= collectionMaxFiles:
+		return false, fmt.Errorf("%w: collections can contain at most %d files", ErrCollectionLimit, collectionMaxFiles)
+	}
+
+	store.files[name] = append(store.files[name], path)
+
+	return true, store.save()
+}
+
+// Removes the file from the collection, or the whole collection if path
+// is empty. Collections left empty are removed. Returns whether anything
+// was removed.
+func (store *collectionStore) remove(name, path string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	files, found := store.files[name]
+
+	switch {
+	case !found:
+		return false, nil
+	case path == "":
+		delete(store.files, name)
+	case !slices.Contains(files, path):
+		return false, nil
+	default:
+		files = slices.DeleteFunc(files, func(file string) bool {
+			return file == path
+		})
+
+		if len(files) == 0 {
+			delete(store.files, name)
+		} else {
+			store.files[name] = files
+		}
+	}
+
+	return true, store.save()
+}
+
+// Returns the files in the collection which still exist and are served
+// to the requester, optionally limited to those within scope.
+func (store *collectionStore) available(r *http.Request, name, scope string, paths []string, vhosts map[string]string) ([]string, bool) {
+	files, found := store.get(name)
+	if !found {
+		return nil, false
+	}
+
+	served := store.app.servedPaths(r, paths, vhosts)
+
+	if scope != "" {
+		scope = strings.TrimSuffix(scope, string(filepath.Separator)) + string(filepath.Separator)
+	}
+
+	available := make([]string, 0, len(files))
+
+	for _, file := range files {
+		if scope != "" && !strings.HasPrefix(file, scope) {
+			continue
+		}
+
+		exists, err := fileExists(file)
+		if err != nil || !exists || !store.app.pathIsValid(file, served) {
+			continue
+		}
+
+		available = append(available, file)
+	}
+
+	return available, true
+}
+
+// Returns a form for adding the file to a collection, listing the existing
+// collections as suggestions. As the admin token must be sent, the form is
+// submitted by collectionScript rather than by the browser.
+func (app *application) collectionForm(path string) string {
+	if app.HashPaths {
+		path = hashedPrefix + hashPath(path)
+	}
+
+	var form strings.Builder
+
+	form.WriteString(fmt.Sprintf(`<form data-collection="%s" style="display:inline;">`, html.EscapeString(app.Prefix+collectionsPrefix)))
+	form.WriteString(fmt.Sprintf(`<input type="hidden" name="path" value="%s">`, html.EscapeString(path)))
+	form.WriteString(`<input type="password" name="token" placeholder="Admin token" required autocomplete="current-password">`)
+	form.WriteString(fmt.Sprintf(`<input name="collection" list="collections" placeholder="Collection" required maxlength="%d" pattern="[A-Za-z0-9._\-]+">`, collectionMaxLength))
+	form.WriteString(`<datalist id="collections">`)
+	for _, name := range app.collections.names() {
+		form.WriteString(fmt.Sprintf(`<option value="%s">`, html.EscapeString(name)))
+	}
+	form.WriteString(`</datalist>`)
+	form.WriteString(`<button type="submit">Add to collection</button></form>`)
+
+	return form.String()
+}
+
+// Returns the collection named in the URL, responding with an error if it
+// is invalid or does not exist.
+func (app *application) requestedCollection(w http.ResponseWriter, r *http.Request, p httprouter.Params, paths []string, vhosts map[string]string) (string, []string, bool) {
+	name := p.ByName("name")
+	if !validCollection(name) {
+		app.notFound(w, r, name)
+
+		return "", nil, false
+	}
+
+	files, found := app.collections.available(r, name, "", paths, vhosts)
+	if !found {
+		app.notFound(w, r, name)
+
+		return "", nil, false
+	}
+
+	return name, files, true
+}
+
+func (app *application) serveCollections(errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Collections", app.collections.list(), errorChannel)
+	}
+}
+
+func (app *application) serveCollection(paths []string, vhosts map[string]string, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name, files, ok := app.requestedCollection(w, r, p, paths, vhosts)
+		if !ok {
+			return
+		}
+
+		root := app.rootUrl(r)
+
+		entries := make([]batchFile, len(files))
+
+		for i, path := range files {
+			entries[i] = batchFile{
+				Name:   filepath.Base(path),
+				View:   root + app.mediaUri(path),
+				Source: root + app.generateFileUri(path),
+			}
+		}
+
+		app.serveJson(w, r, "Collection "+name, entries, errorChannel)
+	}
+}
+
+// Serves the collection as an extended M3U playlist of source URLs.
+func (app *application) serveCollectionM3u(paths []string, vhosts map[string]string, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		name, files, ok := app.requestedCollection(w, r, p, paths, vhosts)
+		if !ok {
+			return
+		}
+
+		root := app.rootUrl(r)
+
+		var playlist strings.Builder
+
+		playlist.WriteString("#EXTM3U\n")
+
+		for _, path := range files {
+			playlist.WriteString(fmt.Sprintf("#EXTINF:-1,%s\n%s\n",
+				filepath.Base(path),
+				root+escapePath(app.generateFileUri(path))))
+		}
+
+		w.Header().Set("Content-Type", "audio/x-mpegurl;charset=UTF-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.m3u"`, name))
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		written, err := io.WriteString(w, playlist.String())
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Playlist of collection %s (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				name,
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+	}
+}
+
+func (app *application) serveCollectionZip(paths []string, vhosts map[string]string, z *zipper, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name, files, ok := app.requestedCollection(w, r, p, paths, vhosts)
+		if !ok {
+			return
+		}
+
+		if len(files) == 0 {
+			app.notFound(w, r, name)
+
+			return
+		}
+
+		z.serve(w, r, name, files, errorChannel)
+	}
+}
+
+// Adds a file to a collection, named either in the URL or, as when
+// submitted from a view page, in the collection form field.
+func (app *application) serveCollectionAdd(paths []string, vhosts map[string]string, index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !app.authorized(r) {
+			app.unauthorized(w, r)
+
+			return
+		}
+
+		name := p.ByName("name")
+		if name == "" {
+			name = r.FormValue("collection")
+		}
+
+		if !validCollection(name) {
+			http.Error(w, fmt.Sprintf("Collection names must be at most %d letters, digits, dots, dashes or underscores", collectionMaxLength), http.StatusBadRequest)
+
+			return
+		}
+
+		path, ok := app.requestedPath(r, r.FormValue("path"), paths, vhosts, index)
+
+		exists := false
+		if ok {
+			exists, _ = fileExists(path)
+		}
+
+		if !exists {
+			app.notFound(w, r, r.FormValue("path"))
+
+			return
+		}
+
+		added, err := app.collections.add(name, path)
+		switch {
+		case errors.Is(err, ErrCollectionLimit):
+			http.Error(w, err.Error(), http.StatusConflict)
+
+			return
+		case err != nil:
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		}
+
+		if added && app.verbose() {
+			fmt.Printf("%s | COLLECTION: Added %s to %s by %s\n",
+				time.Now().Format(logDate),
+				path,
+				name,
+				requester(r))
+		}
+
+		w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+
+		_, err = io.WriteString(w, fmt.Sprintf("Added to collection %s\n", name))
+		if err != nil {
+			errorChannel <- err
+		}
+	}
+}
+
+// Removes a file from a collection, or the whole collection if no path
+// is specified.
+func (app *application) serveCollectionRemove(paths []string, vhosts map[string]string, index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !app.authorized(r) {
+			app.unauthorized(w, r)
+
+			return
+		}
+
+		name := p.ByName("name")
+
+		var path string
+
+		if r.URL.Query().Has("path") {
+			var ok bool
+
+			path, ok = app.requestedPath(r, r.URL.Query().Get("path"), paths, vhosts, index)
+			if !ok {
+				app.notFound(w, r, r.URL.Query().Get("path"))
+
+				return
+			}
+		}
+
+		removed, err := app.collections.remove(name, path)
+		switch {
+		case err != nil:
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		case !removed:
+			app.notFound(w, r, name)
+
+			return
+		}
+
+		description := "collection " + name
+		if path != "" {
+			description = path + " from " + description
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | COLLECTION: Removed %s by %s\n",
+				time.Now().Format(logDate),
+				description,
+				requester(r))
+		}
+
+		w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+
+		_, err = io.WriteString(w, "Removed "+description+"\n")
+		if err != nil {
+			errorChannel <- err
+		}
+	}
+}
+
+func (app *application) registerCollectionHandlers(mux *httprouter.Router, paths []string, vhosts map[string]string, index *fileIndex, transfers *transferLimiter, z *zipper, errorChannel chan<- error) {
+	registerGet(mux, app.Prefix+collectionsPrefix, app.serveCollections(errorChannel))
+	registerGet(mux, app.Prefix+collectionsPrefix+"/:name", app.serveCollection(paths, vhosts, errorChannel))
+	registerGet(mux, app.Prefix+collectionsPrefix+"/:name/m3u", app.serveCollectionM3u(paths, vhosts, errorChannel))
+
+	if app.Zip {
+		registerGet(mux, app.Prefix+collectionsPrefix+"/:name/zip", app.limitTransfers(transfers, app.serveCollectionZip(paths, vhosts, z, errorChannel)))
+	}
+
+	if app.AdminToken == "" || app.ReadOnly {
+		return
+	}
+
+	mux.POST(app.Prefix+collectionsPrefix, app.audited("collection", app.serveCollectionAdd(paths, vhosts, index, errorChannel), errorChannel))
+	mux.POST(app.Prefix+collectionsPrefix+"/:name", app.audited("collection", app.serveCollectionAdd(paths, vhosts, index, errorChannel), errorChannel))
+	mux.DELETE(app.Prefix+collectionsPrefix+"/:name", app.audited("collection", app.serveCollectionRemove(paths, vhosts, index, errorChannel), errorChannel))
+}
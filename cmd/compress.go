@@ -0,0 +1,208 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingGzip string = "gzip"
+	encodingZstd string = "zstd"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+var zstdWriters = sync.Pool{
+	New: func() any {
+		encoder, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+
+		return encoder
+	},
+}
+
+// Returns the preferred encoding supported by the client, if any.
+// zstd is preferred over gzip, as it is both faster and smaller.
+func negotiateEncoding(r *http.Request) string {
+	var gzipAccepted, zstdAccepted bool
+
+	for _, value := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(value), ";")
+
+		q, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if found {
+			weight, err := strconv.ParseFloat(q, 64)
+			if err != nil || weight <= 0 {
+				continue
+			}
+		}
+
+		switch strings.ToLower(name) {
+		case encodingGzip:
+			gzipAccepted = true
+		case encodingZstd:
+			zstdAccepted = true
+		}
+	}
+
+	switch {
+	case zstdAccepted:
+		return encodingZstd
+	case gzipAccepted:
+		return encodingGzip
+	default:
+		return ""
+	}
+}
+
+// Media is generally compressed already, so only markup,
+// text, and data formats are worth compressing further.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json",
+		mediaType == "application/javascript",
+		mediaType == "application/xml",
+		mediaType == "image/svg+xml":
+		return true
+	default:
+		return false
+	}
+}
+
+// Decides whether to compress the response once its headers are known,
+// as handlers only set the Content-Type shortly before writing.
+type compressedWriter struct {
+	http.ResponseWriter
+	encoding string
+	encoder  io.WriteCloser
+	decided  bool
+}
+
+func (cw *compressedWriter) WriteHeader(status int) {
+	if !cw.decided {
+		cw.decide(status)
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressedWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		// Matches the detection performed by net/http on the first write,
+		// which would otherwise happen after the decision was made
+		_, set := cw.Header()["Content-Type"]
+		if !set {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.encoder == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+
+	return cw.encoder.Write(p)
+}
+
+func (cw *compressedWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressedWriter) decide(status int) {
+	cw.decided = true
+
+	header := cw.Header()
+
+	if status != http.StatusOK ||
+		header.Get("Content-Encoding") != "" ||
+		header.Get("Content-Range") != "" ||
+		!compressible(header.Get("Content-Type")) {
+		return
+	}
+
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", cw.encoding)
+
+	// Strong validators no longer match the encoded representation
+	etag := header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+
+	switch cw.encoding {
+	case encodingZstd:
+		encoder := zstdWriters.Get().(*zstd.Encoder)
+		encoder.Reset(cw.ResponseWriter)
+
+		cw.encoder = encoder
+	default:
+		encoder := gzipWriters.Get().(*gzip.Writer)
+		encoder.Reset(cw.ResponseWriter)
+
+		cw.encoder = encoder
+	}
+}
+
+// Flushes any compressed data, returning the encoder to its pool.
+func (cw *compressedWriter) close() {
+	if cw.encoder == nil {
+		return
+	}
+
+	cw.encoder.Close()
+
+	switch encoder := cw.encoder.(type) {
+	case *zstd.Encoder:
+		encoder.Reset(io.Discard)
+		zstdWriters.Put(encoder)
+	case *gzip.Writer:
+		encoder.Reset(io.Discard)
+		gzipWriters.Put(encoder)
+	}
+}
+
+// Compresses HTML, JSON, and text responses with gzip or zstd,
+// for clients which advertise support for either.
+func (app *application) withCompression(next http.Handler) http.Handler {
+	if !app.Compress {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		cw := &compressedWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
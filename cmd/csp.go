@@ -0,0 +1,74 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"seedno.de/seednode/roulette/types"
+)
+
+// Returns a random value for use as a per-request script nonce.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Returns the Content-Security-Policy for a view page, or for any other
+// page if format is nil. Only scripts served
+// by roulette itself or carrying the page's nonce are permitted to run,
+// so inline event handler attributes must not be used. Inline styles are
+// still allowed, as several formats (e.g. ANSI-colored text) rely on them.
+func contentSecurityPolicy(nonce string, format types.Type) string {
+	scripts := fmt.Sprintf("'self' 'nonce-%s'", nonce)
+
+	// Ruffle compiles WebAssembly
+	if format != nil && format.Name() == "flash" {
+		scripts += " 'wasm-unsafe-eval'"
+	}
+
+	return fmt.Sprintf("default-src 'self'; script-src %s; connect-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; media-src 'self' blob:; base-uri 'none'; form-action 'self'",
+		scripts,
+	)
+}
+
+// Returns a script which makes buttons with a data-href attribute navigate
+// to it when clicked, in place of inline onclick handlers.
+func buttonScript(nonce string) string {
+	return fmt.Sprintf(`<script nonce="%s">document.querySelectorAll("button[data-href]").forEach(function (button) { button.addEventListener("click", function () { window.location.href = button.dataset.href; }); });</script>`,
+		nonce)
+}
+
+// Returns a script which makes buttons with data-action and data-method
+// attributes send a request to the action when clicked, then display the
+// response and reload the page, in place of inline onclick handlers.
+func actionScript(nonce string) string {
+	return fmt.Sprintf(`<script nonce="%s">document.querySelectorAll("button[data-action]").forEach(function (button) { button.addEventListener("click", function () { fetch(button.dataset.action, {method: button.dataset.method}).then(r => r.text()).then(t => { alert(t); location.reload(); }); }); });</script>`,
+		nonce)
+}
+
+// Returns a script which submits forms with a data-collection attribute
+// along with the admin token entered into them, then displays the response.
+func collectionScript(nonce string) string {
+	return fmt.Sprintf(`<script nonce="%s">document.querySelectorAll("form[data-collection]").forEach(function (form) { form.addEventListener("submit", function (event) { event.preventDefault(); const data = new URLSearchParams(new FormData(form)); data.delete("token"); fetch(form.dataset.collection, {method: "POST", headers: {"Authorization": "Bearer " + form.elements.token.value}, body: data}).then(r => r.text()).then(t => alert(t)); }); });</script>`,
+		nonce)
+}
+
+// Returns a script which makes buttons with a data-bulk attribute send the
+// checked files to the bulk endpoint, then display how many succeeded and
+// reload the page.
+func (app *application) bulkScript(nonce string) string {
+	return fmt.Sprintf(`<script nonce="%s">document.querySelectorAll("button[data-bulk]").forEach(function (button) { button.addEventListener("click", function () { const form = button.form; const paths = Array.from(form.querySelectorAll("input[name=path]:checked"), input => input.value); if (paths.length === 0) { return; } const body = {action: button.dataset.bulk, paths: paths}; if (form.elements.destination) { body.destination = form.elements.destination.value; } if (form.elements.collection) { body.collection = form.elements.collection.value; } fetch(%q, {method: "POST", headers: {"Authorization": "Bearer " + form.elements.token.value, "Content-Type": "application/json"}, body: JSON.stringify(body)}).then(r => r.ok ? r.json().then(results => results.filter(result => !result.error).length + " of " + results.length + " files succeeded") : r.text()).then(t => { alert(t); location.reload(); }); }); });</script>`,
+		nonce,
+		app.Prefix+"/api/v1/files")
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types"
+)
+
+// Derives a seed which is stable for the remainder of the current day,
+// offset by the seed query parameter or --seed flag, if provided.
+func (app *application) dailySeed(r *http.Request, now time.Time) randomSeed {
+	seed := app.seedParams(r)
+
+	seed.enabled = true
+
+	seed.step = uint64(now.Year()*10000 + int(now.Month())*100 + now.Day())
+
+	return seed
+}
+
+func (app *application) pickDaily(r *http.Request, paths []string, vhosts map[string]string, index *fileIndex, formats types.Types, errorChannel chan<- error) string {
+	rng := app.dailySeed(r, time.Now()).source()
+
+	list := app.fileList(r.Context(), paths, app.vhostPath(r, vhosts), index, rng, formats, errorChannel)
+	if len(list) == 0 {
+		return ""
+	}
+
+	// Scans without an index return files in no particular order
+	if !app.Index {
+		slices.Sort(list)
+	}
+
+	return list[rng.IntN(len(list))]
+}
+
+func (app *application) serveDaily(paths []string, vhosts map[string]string, index *fileIndex, source bool, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		path := app.pickDaily(r, paths, vhosts, index, formats, errorChannel)
+		if path == "" {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		var newUrl string
+
+		switch {
+		case source:
+			newUrl = app.rootUrl(r) + app.generateFileUri(path)
+		default:
+			newUrl = app.rootUrl(r) + app.mediaUri(path)
+		}
+
+		http.Redirect(w, r, newUrl, redirectStatusCode)
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Daily pick %s to %s in %s\n",
+				startTime.Format(logDate),
+				path,
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types"
+)
+
+const dashboardLength int = 10
+
+// Returns the path of the admin dashboard, which is the admin prefix itself
+// if one is set, as the root path is otherwise already in use.
+func (app *application) dashboardPath() string {
+	if app.AdminPrefix != "" {
+		return app.Prefix + app.AdminPrefix + "/"
+	}
+
+	return app.Prefix + "/admin/"
+}
+
+func (app *application) dashboardAction(label, method, path string) string {
+	return fmt.Sprintf(`<button data-action="%s" data-method="%s">%s</button>`,
+		html.EscapeString(app.Prefix+app.AdminPrefix+path),
+		method,
+		label)
+}
+
+func (app *application) serveDashboard(paths []string, index *fileIndex, stats *serveStats, recent *errorBuffer, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		nonce, err := newNonce()
+		if err != nil {
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		}
+
+		var htmlBody strings.Builder
+
+		htmlBody.WriteString(`<!DOCTYPE html><html lang="en"><head>`)
+		htmlBody.WriteString(getFavicon())
+		htmlBody.WriteString(`<style>body{font-family:sans-serif;margin:1em;}`)
+		htmlBody.WriteString(`table,td,th,tr{border:1px solid black;border-collapse:collapse;}td,th{white-space:nowrap;padding:.3em .5em;text-align:left;}`)
+		htmlBody.WriteString(`button{margin-right:.5em;}</style>`)
+		htmlBody.WriteString(fmt.Sprintf(`<title>roulette v%s</title></head><body>`, ReleaseVersion))
+		htmlBody.WriteString(fmt.Sprintf(`<h1>roulette v%s</h1>`, ReleaseVersion))
+
+		htmlBody.WriteString(`<h2>Paths</h2><table>`)
+		for _, path := range paths {
+			htmlBody.WriteString(fmt.Sprintf(`<tr><td>%s</td></tr>`, html.EscapeString(path)))
+		}
+		htmlBody.WriteString(`</table>`)
+
+		htmlBody.WriteString(fmt.Sprintf(`<h2>Enabled formats</h2><p>%s</p>`, strings.Join(formats.Names(), ", ")))
+
+		if app.AdminToken != "" && !app.ReadOnly {
+			htmlBody.WriteString(fmt.Sprintf(`<p><a href="%s">Select files</a></p>`, html.EscapeString(app.Prefix+app.AdminPrefix+"/select")))
+		}
+
+		if app.Index {
+			s := index.stats(paths)
+
+			index.mutex.RLock()
+			directories := len(index.pathIndex)
+			index.mutex.RUnlock()
+
+			htmlBody.WriteString(`<h2>Index</h2><table>`)
+			htmlBody.WriteString(fmt.Sprintf(`<tr><th>Files</th><td>%d</td></tr>`, s.Total))
+			htmlBody.WriteString(fmt.Sprintf(`<tr><th>Directories</th><td>%d</td></tr>`, directories))
+			htmlBody.WriteString(fmt.Sprintf(`<tr><th>Last scan</th><td>%s</td></tr>`, s.LastScan))
+			htmlBody.WriteString(fmt.Sprintf(`<tr><th>Scan duration</th><td>%s</td></tr>`, s.ScanLength))
+			htmlBody.WriteString(`</table>`)
+
+			if !app.ReadOnly {
+				htmlBody.WriteString(`<p>`)
+				htmlBody.WriteString(app.dashboardAction("Rebuild index", "POST", "/index/rebuild"))
+				htmlBody.WriteString(app.dashboardAction("Prune index", "POST", "/index/prune"))
+				htmlBody.WriteString(`</p>`)
+			}
+		}
+
+		if app.Stats {
+			htmlBody.WriteString(fmt.Sprintf(`<h2>Most served</h2><p>%d files served in total.</p><table>`, stats.total()))
+			htmlBody.WriteString(`<tr><th>Path</th><th>Count</th><th>Last served</th></tr>`)
+			for _, file := range stats.mostServed(dashboardLength) {
+				htmlBody.WriteString(fmt.Sprintf(`<tr><td>%s</td><td>%d</td><td>%s</td></tr>`,
+					html.EscapeString(file.Path),
+					file.Count,
+					file.LastServed))
+			}
+			htmlBody.WriteString(`</table>`)
+		}
+
+		if app.ErrorBuffer > 0 {
+			recentErrors := recent.list()
+			slices.Reverse(recentErrors)
+
+			htmlBody.WriteString(`<h2>Recent errors</h2><table>`)
+			htmlBody.WriteString(`<tr><th>Time</th><th>Error</th></tr>`)
+			for _, e := range recentErrors[:min(len(recentErrors), dashboardLength)] {
+				htmlBody.WriteString(fmt.Sprintf(`<tr><td>%s</td><td>%s</td></tr>`,
+					e.Time.Format(logDate),
+					html.EscapeString(e.Error)))
+			}
+			htmlBody.WriteString(`</table>`)
+		}
+
+		htmlBody.WriteString(actionScript(nonce))
+
+		htmlBody.WriteString(`</body></html>`)
+
+		w.Header().Set("Content-Type", "text/html")
+
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy(nonce, nil))
+
+		written, err := w.Write([]byte(htmlBody.String()))
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Admin dashboard (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond))
+		}
+	}
+}
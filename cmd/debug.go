@@ -0,0 +1,273 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Returns a sorted copy of the index contents.
+func (index *fileIndex) dump() []string {
+	index.mutex.RLock()
+	list := make([]string, len(index.list))
+	copy(list, index.list)
+	index.mutex.RUnlock()
+
+	slices.Sort(list)
+
+	return list
+}
+
+type indexDiff struct {
+	Added   []string    `json:"added"`
+	Removed []string    `json:"removed"`
+	Moved   []movedFile `json:"moved,omitempty"`
+}
+
+type movedFile struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Returns the files added to and removed from the index
+// by the most recent rebuild.
+func (index *fileIndex) diff() *indexDiff {
+	index.mutex.RLock()
+	current := slices.Clone(index.list)
+	previous := slices.Clone(index.previous)
+	currentHashes := index.contents
+	priorHashes := index.priorHashes
+	index.mutex.RUnlock()
+
+	slices.Sort(current)
+	slices.Sort(previous)
+
+	diff := &indexDiff{
+		Added:   []string{},
+		Removed: []string{},
+	}
+
+	i, j := 0, 0
+
+	for i < len(current) || j < len(previous) {
+		switch {
+		case j == len(previous) || i < len(current) && current[i] < previous[j]:
+			diff.Added = append(diff.Added, current[i])
+			i++
+		case i == len(current) || previous[j] < current[i]:
+			diff.Removed = append(diff.Removed, previous[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+
+	if index.app.HashContents {
+		diff.moved(currentHashes, priorHashes)
+	}
+
+	return diff
+}
+
+// Pairs up removed and added files with identical contents,
+// reporting them as moved instead.
+func (diff *indexDiff) moved(currentHashes, priorHashes map[string]contentHash) {
+	removed := make(map[string][]string)
+
+	for _, path := range diff.Removed {
+		sum := priorHashes[path].sum
+		if sum != "" {
+			removed[sum] = append(removed[sum], path)
+		}
+	}
+
+	var moved []movedFile
+
+	diff.Added = slices.DeleteFunc(diff.Added, func(path string) bool {
+		sum := currentHashes[path].sum
+		if sum == "" || len(removed[sum]) == 0 {
+			return false
+		}
+
+		moved = append(moved, movedFile{From: removed[sum][0], To: path})
+
+		removed[sum] = removed[sum][1:]
+
+		return true
+	})
+
+	diff.Removed = slices.DeleteFunc(diff.Removed, func(path string) bool {
+		return slices.ContainsFunc(moved, func(m movedFile) bool { return m.From == path })
+	})
+
+	diff.Moved = moved
+}
+
+type treeNode struct {
+	Name     string      `json:"name"`
+	Children []*treeNode `json:"children,omitempty"`
+	Files    []string    `json:"files,omitempty"`
+}
+
+// Returns the named child of the node, creating it if needed. As paths are
+// processed in sorted order, any existing match is always the last child.
+func (node *treeNode) child(name string) *treeNode {
+	if len(node.Children) > 0 && node.Children[len(node.Children)-1].Name == name {
+		return node.Children[len(node.Children)-1]
+	}
+
+	child := &treeNode{Name: name}
+
+	node.Children = append(node.Children, child)
+
+	return child
+}
+
+// Converts a sorted list of file paths into a nested directory structure.
+func makeTree(list []string) *treeNode {
+	root := &treeNode{Name: "/"}
+
+	for _, path := range list {
+		dir, file := filepath.Split(path)
+
+		node := root
+
+		for _, name := range strings.Split(filepath.ToSlash(dir), "/") {
+			if name != "" {
+				node = node.child(name)
+			}
+		}
+
+		node.Files = append(node.Files, file)
+	}
+
+	return root
+}
+
+// Returns the requested page of the index, along with the page
+// number and total number of pages. If pagination is disabled,
+// or no page is requested, the entire index is returned.
+func (app *application) paginateIndex(list []string, p httprouter.Params) ([]string, int, int) {
+	if app.PageLength == 0 {
+		return list, 1, 1
+	}
+
+	pages := (len(list) + app.PageLength - 1) / app.PageLength
+	if pages == 0 {
+		pages = 1
+	}
+
+	page, err := strconv.Atoi(p.ByName("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	start := (page - 1) * app.PageLength
+	if start >= len(list) {
+		return []string{}, page, pages
+	}
+
+	stop := min(start+app.PageLength, len(list))
+
+	return list[start:stop], page, pages
+}
+
+func (app *application) serveIndexHtml(index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		list := index.dump()
+
+		page, current, pages := app.paginateIndex(list, p)
+
+		var queryParams string
+		if app.Sorting {
+			queryParams = "?sort=asc"
+		}
+
+		var htmlBody strings.Builder
+
+		htmlBody.WriteString(`<!DOCTYPE html><html lang="en"><head>`)
+		htmlBody.WriteString(getFavicon())
+		htmlBody.WriteString(`<style>a{text-decoration:none;height:100%;width:100%;color:inherit;cursor:pointer;}`)
+		htmlBody.WriteString(`table,td,tr{border:1px solid black;border-collapse:collapse;}td{white-space:nowrap;padding:.5em;}</style>`)
+		htmlBody.WriteString(fmt.Sprintf("<title>Index contains %d files</title></head><body>", len(list)))
+
+		if app.PageLength != 0 {
+			htmlBody.WriteString(fmt.Sprintf(`<p><a href="%s%s/index/html/%d">Prev</a> | Page %d of %d | <a href="%s%s/index/html/%d">Next</a></p>`,
+				app.Prefix,
+				app.AdminPrefix,
+				max(current-1, 1),
+				current,
+				pages,
+				app.Prefix,
+				app.AdminPrefix,
+				min(current+1, pages)))
+		}
+
+		htmlBody.WriteString(`<table>`)
+		for _, v := range page {
+			// Full paths are not exposed when files are addressed by hash
+			name := v
+			if app.HashPaths {
+				name = hashedPrefix + hashPath(v)
+			}
+
+			htmlBody.WriteString(fmt.Sprintf(`<tr><td><a href="%s">%s</a></td></tr>`,
+				html.EscapeString(app.Prefix+escapePath(app.mediaUri(v))+queryParams),
+				html.EscapeString(name)))
+		}
+		htmlBody.WriteString(`</table></body></html>`)
+
+		w.Header().Add("Content-Security-Policy", "default-src 'self'; style-src 'self' 'unsafe-inline';")
+
+		w.Header().Set("Content-Type", "text/html")
+
+		written, err := w.Write([]byte(htmlBody.String()))
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: HTML index page (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond))
+		}
+	}
+}
+
+func (app *application) serveIndexJson(index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		page, _, _ := app.paginateIndex(index.dump(), p)
+
+		app.serveJson(w, r, "JSON index page", page, errorChannel)
+	}
+}
+
+func (app *application) serveIndexTree(index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "JSON index tree", makeTree(index.dump()), errorChannel)
+	}
+}
+
+func (app *application) serveIndexDiff(index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "JSON index diff", index.diff(), errorChannel)
+	}
+}
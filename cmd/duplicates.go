@@ -0,0 +1,200 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A hash of the contents of a file, along with the size and modification
+// time it was computed at, so it is only recomputed when the file changes.
+type contentHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+type duplicateGroup struct {
+	Size  int64    `json:"size"`
+	Files []string `json:"files"`
+}
+
+func hashContents(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Returns content hashes for the files in the list, reusing hashes of
+// unchanged files from the previous run. Unless all is set, only files
+// which share their size with another file are hashed, as no others can
+// be duplicates; the remainder are returned without a sum.
+func (app *application) hashFiles(list []string, previous map[string]contentHash, all bool) map[string]contentHash {
+	hashes := make(map[string]contentHash, len(list))
+
+	var mutex sync.Mutex
+
+	limit := make(chan struct{}, app.Concurrency)
+
+	var wg sync.WaitGroup
+
+	for _, path := range list {
+		limit <- struct{}{}
+
+		wg.Add(1)
+
+		go func(path string) {
+			defer func() {
+				<-limit
+
+				wg.Done()
+			}()
+
+			info, err := os.Stat(path)
+			if err != nil {
+				return
+			}
+
+			mutex.Lock()
+			hashes[path] = contentHash{size: info.Size(), modTime: info.ModTime()}
+			mutex.Unlock()
+		}(path)
+	}
+
+	wg.Wait()
+
+	sizes := make(map[int64]int)
+
+	for _, hash := range hashes {
+		sizes[hash.size]++
+	}
+
+	// Iterate over a copy, as hashes are written concurrently below
+	for path, hash := range maps.Clone(hashes) {
+		if !all && sizes[hash.size] < 2 {
+			continue
+		}
+
+		cached, found := previous[path]
+		if found && cached.size == hash.size && cached.modTime.Equal(hash.modTime) && cached.sum != "" {
+			hash.sum = cached.sum
+
+			mutex.Lock()
+			hashes[path] = hash
+			mutex.Unlock()
+
+			continue
+		}
+
+		limit <- struct{}{}
+
+		wg.Add(1)
+
+		go func(path string, hash contentHash) {
+			defer func() {
+				<-limit
+
+				wg.Done()
+			}()
+
+			sum, err := hashContents(path)
+			if err != nil {
+				return
+			}
+
+			hash.sum = sum
+
+			mutex.Lock()
+			hashes[path] = hash
+			mutex.Unlock()
+		}(path, hash)
+	}
+
+	wg.Wait()
+
+	return hashes
+}
+
+// Returns groups of byte-identical files, based on their content hashes.
+func duplicateGroups(hashes map[string]contentHash) []duplicateGroup {
+	matches := make(map[string][]string)
+
+	for path, hash := range hashes {
+		if hash.sum != "" {
+			matches[hash.sum] = append(matches[hash.sum], path)
+		}
+	}
+
+	var groups []duplicateGroup
+
+	for _, files := range matches {
+		if len(files) < 2 {
+			continue
+		}
+
+		slices.Sort(files)
+
+		groups = append(groups, duplicateGroup{
+			Size:  hashes[files[0]].size,
+			Files: files,
+		})
+	}
+
+	slices.SortFunc(groups, func(a, b duplicateGroup) int {
+		return strings.Compare(a.Files[0], b.Files[0])
+	})
+
+	return groups
+}
+
+// Returns every copy of each duplicate file except the first, which
+// is kept eligible for selection.
+func redundantCopies(groups []duplicateGroup) map[string]bool {
+	redundant := make(map[string]bool)
+
+	for _, group := range groups {
+		for _, path := range group.Files[1:] {
+			redundant[path] = true
+		}
+	}
+
+	return redundant
+}
+
+func (app *application) serveDuplicates(index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		index.mutex.RLock()
+		groups := slices.Clone(index.duplicates)
+		index.mutex.RUnlock()
+
+		if groups == nil {
+			groups = []duplicateGroup{}
+		}
+
+		app.serveJson(w, r, "Duplicate files", groups, errorChannel)
+	}
+}
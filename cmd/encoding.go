@@ -0,0 +1,227 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	compressionLz4  string = "lz4"
+	compressionNone string = "none"
+	compressionZstd string = "zstd"
+
+	indexFormatGob  string = "gob"
+	indexFormatJson string = "json"
+
+	// Number of entries written to each chunk of a gob index file
+	indexChunkLength int = 10000
+)
+
+// Magic numbers at the start of every lz4 and zstd frame.
+var (
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// The lz4 compression level corresponding to each --index-compression-level.
+var lz4Levels = map[string]lz4.CompressionLevel{
+	"fastest": lz4.Fast,
+	"default": lz4.Level1,
+	"better":  lz4.Level5,
+	"best":    lz4.Level9,
+}
+
+func (app *application) validIndexEncoding() bool {
+	switch app.Compression {
+	case compressionNone:
+	case compressionLz4:
+		_, found := lz4Levels[app.CompressLevel]
+		if !found {
+			return false
+		}
+	case compressionZstd:
+		found, _ := zstd.EncoderLevelFromString(app.CompressLevel)
+		if !found {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return app.IndexFormat == indexFormatGob || app.IndexFormat == indexFormatJson
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Wraps the writer according to --index-compression. The returned writer
+// must be closed to flush any buffered data.
+func (app *application) compressIndex(w io.Writer) (io.WriteCloser, error) {
+	switch app.Compression {
+	case compressionNone:
+		return nopWriteCloser{w}, nil
+	case compressionLz4:
+		writer := lz4.NewWriter(w)
+
+		err := writer.Apply(lz4.CompressionLevelOption(lz4Levels[app.CompressLevel]))
+		if err != nil {
+			return nil, err
+		}
+
+		return writer, nil
+	}
+
+	_, level := zstd.EncoderLevelFromString(app.CompressLevel)
+
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+}
+
+// Wraps the reader in a decompressor if the data is lz4- or zstd-compressed,
+// so that index files are read correctly regardless of the current flags.
+func decompressIndex(r io.Reader) (io.Reader, func(), error) {
+	buffered := bufio.NewReader(r)
+
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(magic, lz4Magic) {
+		return lz4.NewReader(buffered), func() {}, nil
+	}
+
+	if !bytes.Equal(magic, zstdMagic) {
+		return buffered, func() {}, nil
+	}
+
+	decoder, err := zstd.NewReader(buffered)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return decoder, decoder.Close, nil
+}
+
+// Writes the list in the format selected by --index-format.
+func (app *application) encodeIndex(w io.Writer, list []string) error {
+	if app.IndexFormat == indexFormatJson {
+		return encodeIndexJson(w, list)
+	}
+
+	enc := gob.NewEncoder(w)
+
+	// Entries are written in chunks, so that the encoder never has to
+	// buffer the entire index in memory
+	for chunk := range slices.Chunk(list, indexChunkLength) {
+		err := enc.Encode(chunk)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes the list as a JSON array, one entry at a time.
+func encodeIndexJson(w io.Writer, list []string) error {
+	buffered := bufio.NewWriter(w)
+
+	buffered.WriteString("[")
+
+	for i, entry := range list {
+		if i > 0 {
+			buffered.WriteString(",")
+		}
+
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		buffered.Write(encoded)
+	}
+
+	buffered.WriteString("]\n")
+
+	return buffered.Flush()
+}
+
+// Reads a list written in either format. Gob streams never begin with an
+// opening bracket, so JSON arrays can be told apart from them.
+func decodeIndex(r io.Reader) ([]string, error) {
+	buffered := bufio.NewReader(r)
+
+	first, err := buffered.Peek(1)
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case first[0] == '[':
+		return decodeIndexJson(buffered)
+	}
+
+	dec := gob.NewDecoder(buffered)
+
+	var list []string
+
+	// Index files written by earlier versions consist of a single chunk
+	for {
+		var chunk []string
+
+		err = dec.Decode(&chunk)
+		if errors.Is(err, io.EOF) {
+			return list, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, chunk...)
+	}
+}
+
+// Reads a JSON array one entry at a time, rather than all at once.
+func decodeIndexJson(r io.Reader) ([]string, error) {
+	dec := json.NewDecoder(r)
+
+	_, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []string
+
+	for dec.More() {
+		var entry string
+
+		err = dec.Decode(&entry)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, entry)
+	}
+
+	_, err = dec.Token()
+
+	return list, err
+}
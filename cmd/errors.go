@@ -9,26 +9,77 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
+
+	"github.com/julienschmidt/httprouter"
 )
 
 var (
+	ErrCollectionLimit       = errors.New("collection limit reached")
+	ErrDaemonUnsupported     = errors.New("--daemon is not supported on Windows, use \"roulette service install\" instead")
+	ErrFailedValidation      = errors.New("file failed validation for its detected type")
 	ErrInvalidAdminPrefix    = errors.New("admin path must match the pattern " + AllowedCharacters)
+	ErrInvalidBaseUrl        = errors.New("base URL must be an absolute http or https URL")
+	ErrInvalidCacheSize      = errors.New("cache size must be a non-negative number with an optional unit (e.g. \"512MB\" or \"1GiB\")")
 	ErrInvalidConcurrency    = errors.New("concurrency limit must be a positive integer")
+	ErrInvalidDuplicates     = errors.New("duplicate detection requires the index to be enabled, and is required to skip duplicates")
+	ErrInvalidErrorBuffer    = errors.New("error buffer size must be a non-negative integer")
+	ErrInvalidExtensionless  = errors.New("files with no extension can only be assigned an enabled file type")
 	ErrInvalidFileCountRange = errors.New("maximum file count limit must be greater than or equal to minimum file count limit")
 	ErrInvalidFileCountValue = errors.New("file count limits must be non-negative integers no greater than 2147483647")
+	ErrInvalidFormatFlag     = errors.New("format flags must be ones registered by a built-in format, with a valid value")
+	ErrInvalidHashContents   = errors.New("content hashing requires the index to be enabled")
+	ErrInvalidHashPaths      = errors.New("hashed paths require the index to be enabled")
+	ErrInvalidHeader         = errors.New("headers must be of the form \"Name: value\"")
+	ErrInvalidHotlinkAllow   = errors.New("hotlink allowlist requires --hotlink-protection")
 	ErrInvalidIgnoreFile     = errors.New("ignore filename must match the pattern " + AllowedCharacters)
+	ErrInvalidImageData      = errors.New("image data is malformed or truncated")
+	ErrInvalidIndexBackend   = errors.New("index backend must be one of: memory, redis, and redis requires --index and --redis-url")
+	ErrInvalidIndexEncoding  = errors.New("index compression must be one of: zstd, lz4, none, with a level of fastest, default, better, or best, and index format must be one of: gob, json")
+	ErrInvalidList           = errors.New("failed to fetch file list")
+	ErrInvalidListUrl        = errors.New("list URL must be an absolute http or https URL")
+	ErrInvalidMapping        = errors.New("extension mappings must be of the form .extension=type, where type is an enabled file type")
+	ErrInvalidMaxTransfers   = errors.New("maximum transfers per client must be a non-negative integer")
+	ErrInvalidMount          = errors.New("mounts must be of the form /prefix=path, with a unique prefix not used by any other handler")
+	ErrInvalidNoRepeat       = errors.New("no-repeat window must be a non-negative integer")
+	ErrInvalidNotifyUrl      = errors.New("notification URLs must be absolute http or https URLs")
 	ErrInvalidOverrideFile   = errors.New("override filename must match the pattern " + AllowedCharacters)
-	ErrInvalidPort           = errors.New("listen port must be an integer between 1 and 65535 inclusive")
+	ErrInvalidPageLength     = errors.New("page length must be a non-negative integer")
+	ErrInvalidPathWeight     = errors.New("path weights must be of the form path=weight, with weight a positive number, and require --sampling weighted")
+	ErrInvalidPort           = errors.New("listen port must be an integer between 0 and 65535 inclusive")
+	ErrInvalidRedisUrl       = errors.New("redis URL must be of the form redis://[:password@]host[:port][/database]")
+	ErrInvalidRefresh        = errors.New("per-format refresh intervals must be non-negative durations (e.g. \"5s\" or \"0\")")
+	ErrInvalidTrustedProxy   = errors.New("trusted proxies must be valid IP addresses or CIDR ranges")
+	ErrInvalidTypes          = errors.New("types must be a comma-separated list containing any of: audio, code, flash, images, text, video")
+	ErrInvalidSampling       = errors.New("sampling mode must be one of: per-dir, uniform, weighted")
+	ErrInvalidSchedule       = errors.New("schedules must be of the form target=[days ]HH:MM-HH:MM, where target is a path or file type (e.g. \"/mnt/sfw=Mon-Fri 09:00-17:00\")")
+	ErrInvalidSettings       = errors.New("settings must be valid JSON, with code_theme a supported theme and refresh a non-negative duration")
+	ErrInvalidShare          = errors.New("share tokens require --share-secret, at least one path, and a positive TTL (e.g. \"24h\")")
+	ErrInvalidShowLocation   = errors.New("image locations cannot be shown while metadata is stripped")
+	ErrInvalidSimilar        = errors.New("similar image detection requires the index to be enabled")
+	ErrInvalidSlowRequest    = errors.New("slow request threshold must be a positive duration (e.g. \"2s\")")
+	ErrInvalidVhost          = errors.New("virtual hosts must be of the form hostname=path, with each hostname specified only once")
+	ErrInvalidWarm           = errors.New("warming the cache requires --cache-dir or --state-dir, and --strip-metadata or --storyboards")
+	ErrInvalidWarmWorkers    = errors.New("warm workers must be a positive integer")
+	ErrInvalidZipMaxSize     = errors.New("zip size limit must be a non-negative number with an optional unit (e.g. \"512MB\" or \"1GiB\")")
+	ErrMissingFfmpeg         = errors.New("transcoding requires ffmpeg to be installed and in PATH")
+	ErrMissingGotifyToken    = errors.New("gotify URL requires an application token")
+	ErrMissingRuffle         = errors.New("flash support requires ruffle assets, which are embedded by running update-ruffle.sh before building")
+	ErrMissingStoryboard     = errors.New("storyboards require ffmpeg and ffprobe to be installed and in PATH")
+	ErrNoPaths               = errors.New("at least one path, mount, or virtual host must be specified")
 	ErrNoMediaFound          = errors.New("no supported media formats found which match all criteria")
+	ErrRedisNil              = errors.New("redis key does not exist")
+	ErrServiceUnsupported    = errors.New("services are only supported on Windows, use --daemon or a service manager such as systemd instead")
+	ErrStateDirInUse         = errors.New("state directory is in use by another process")
 )
 
-func notFound(w http.ResponseWriter, r *http.Request, path string) error {
-	if Verbose {
+func (app *application) notFound(w http.ResponseWriter, r *http.Request, path string) error {
+	if app.verbose() {
 		fmt.Printf("%s | ERROR: Unavailable file %s requested by %s\n",
 			time.Now().Format(logDate),
 			path,
-			r.RemoteAddr,
+			requester(r),
 		)
 	}
 
@@ -44,12 +95,12 @@ func notFound(w http.ResponseWriter, r *http.Request, path string) error {
 	return nil
 }
 
-func serverError(w http.ResponseWriter, r *http.Request, i interface{}) {
-	if Verbose {
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, i interface{}) {
+	if app.verbose() {
 		fmt.Printf("%s | ERROR: Invalid request for %s from %s\n",
 			time.Now().Format(logDate),
 			r.URL.Path,
-			r.RemoteAddr)
+			requester(r))
 	}
 
 	w.Header().Add("Content-Type", "text/html")
@@ -57,6 +108,64 @@ func serverError(w http.ResponseWriter, r *http.Request, i interface{}) {
 	io.WriteString(w, newPage("Server Error", "An error has occurred. Please try again."))
 }
 
-func serverErrorHandler() func(http.ResponseWriter, *http.Request, interface{}) {
-	return serverError
+func (app *application) serverErrorHandler() func(http.ResponseWriter, *http.Request, interface{}) {
+	return app.serverError
+}
+
+type loggedError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// Ring buffer retaining the most recent errors received on the error
+// channel, so they remain available after scrolling off stdout.
+type errorBuffer struct {
+	mutex  sync.RWMutex
+	errors []loggedError
+	next   int
+	full   bool
+}
+
+func newErrorBuffer(size int) *errorBuffer {
+	return &errorBuffer{
+		errors: make([]loggedError, size),
+	}
+}
+
+func (buffer *errorBuffer) add(err error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if len(buffer.errors) == 0 {
+		return
+	}
+
+	buffer.errors[buffer.next] = loggedError{
+		Time:  time.Now(),
+		Error: err.Error(),
+	}
+
+	buffer.next = (buffer.next + 1) % len(buffer.errors)
+
+	if buffer.next == 0 {
+		buffer.full = true
+	}
+}
+
+// Returns the buffered errors, from oldest to newest.
+func (buffer *errorBuffer) list() []loggedError {
+	buffer.mutex.RLock()
+	defer buffer.mutex.RUnlock()
+
+	if !buffer.full {
+		return append([]loggedError{}, buffer.errors[:buffer.next]...)
+	}
+
+	return append(append([]loggedError{}, buffer.errors[buffer.next:]...), buffer.errors[:buffer.next]...)
+}
+
+func (app *application) serveErrors(buffer *errorBuffer, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "error log", buffer.list(), errorChannel)
+	}
 }
@@ -0,0 +1,55 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"os"
+	"strings"
+)
+
+// Returns the content hash of the file from the index, provided the file
+// has not changed since it was hashed. This is suitable for use as a cache
+// key, as it follows the file's contents rather than its path.
+func (index *fileIndex) contentSum(path string) string {
+	index.mutex.RLock()
+	hash, found := index.contents[path]
+	index.mutex.RUnlock()
+
+	if !found || hash.sum == "" {
+		return ""
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != hash.size || !info.ModTime().Equal(hash.modTime) {
+		return ""
+	}
+
+	return hash.sum
+}
+
+// Returns a strong ETag for the file, or an empty string if its contents
+// have not been hashed.
+func (index *fileIndex) etag(path string) string {
+	sum := index.contentSum(path)
+	if sum == "" {
+		return ""
+	}
+
+	return `"` + sum + `"`
+}
+
+// Returns whether the If-None-Match request header matches the ETag.
+// Per RFC 9110, comparison is weak, so W/ prefixes are ignored.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
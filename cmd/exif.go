@@ -0,0 +1,191 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	exifOrientationTag uint16 = 0x0112
+	exifGpsTag         uint16 = 0x8825
+
+	exifShort    uint16 = 3
+	exifLong     uint16 = 4
+	exifRational uint16 = 5
+)
+
+// Reads tags from TIFF-structured EXIF data. A nil reader, or one over
+// malformed data, finds no tags.
+type exifReader struct {
+	tiff  []byte
+	order binary.ByteOrder
+}
+
+// Returns a reader over EXIF data, with or without the leading
+// "Exif\x00\x00" identifier, or nil if the data is not EXIF.
+func newExifReader(data []byte) *exifReader {
+	tiff := bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+	if len(tiff) < 8 {
+		return nil
+	}
+
+	switch string(tiff[:2]) {
+	case "II":
+		return &exifReader{tiff: tiff, order: binary.LittleEndian}
+	case "MM":
+		return &exifReader{tiff: tiff, order: binary.BigEndian}
+	default:
+		return nil
+	}
+}
+
+// Returns the type, count, and value field of a tag in the directory at
+// the specified offset. Values of four bytes or fewer are stored in the
+// field itself, and larger ones at the offset it contains.
+func (e *exifReader) lookup(directory int, tag uint16) (uint16, int, []byte, bool) {
+	if e == nil || directory < 8 || directory+2 > len(e.tiff) {
+		return 0, 0, nil, false
+	}
+
+	entries := int(e.order.Uint16(e.tiff[directory:]))
+
+	for i := 0; i < entries; i++ {
+		entry := directory + 2 + i*12
+		if entry+12 > len(e.tiff) {
+			return 0, 0, nil, false
+		}
+
+		if e.order.Uint16(e.tiff[entry:]) == tag {
+			return e.order.Uint16(e.tiff[entry+2:]), int(e.order.Uint32(e.tiff[entry+4:])), e.tiff[entry+8 : entry+12], true
+		}
+	}
+
+	return 0, 0, nil, false
+}
+
+// Returns the offset of the first image directory.
+func (e *exifReader) first() int {
+	if e == nil {
+		return 0
+	}
+
+	return int(e.order.Uint32(e.tiff[4:]))
+}
+
+// Returns the EXIF orientation, or zero if none is specified.
+func (e *exifReader) orientation() uint16 {
+	valueType, _, field, found := e.lookup(e.first(), exifOrientationTag)
+	if !found || valueType != exifShort {
+		return 0
+	}
+
+	orientation := e.order.Uint16(field)
+	if orientation < 1 || orientation > 8 {
+		return 0
+	}
+
+	return orientation
+}
+
+// Returns the rational values stored at the offset in the field.
+func (e *exifReader) rationals(field []byte, count int) ([]float64, bool) {
+	offset := int(e.order.Uint32(field))
+	if offset < 8 || count < 1 || offset+count*8 > len(e.tiff) {
+		return nil, false
+	}
+
+	values := make([]float64, count)
+
+	for i := range values {
+		numerator := e.order.Uint32(e.tiff[offset+i*8:])
+		denominator := e.order.Uint32(e.tiff[offset+i*8+4:])
+		if denominator == 0 {
+			return nil, false
+		}
+
+		values[i] = float64(numerator) / float64(denominator)
+	}
+
+	return values, true
+}
+
+// Returns the EXIF data embedded in a JPEG, PNG, or WebP image, searching
+// only as much of the file as was read.
+func findExif(path string, data []byte) []byte {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".jfif", ".pjp", ".pjpeg":
+		if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+			return nil
+		}
+
+		for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+			marker := data[i+1]
+
+			if marker == 0xFF {
+				i++
+
+				continue
+			}
+
+			// No metadata follows the start of scan
+			if marker == 0xDA {
+				return nil
+			}
+
+			length := int(binary.BigEndian.Uint16(data[i+2:]))
+			if length < 2 || i+2+length > len(data) {
+				return nil
+			}
+
+			segment := data[i+4 : i+2+length]
+
+			if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return segment
+			}
+
+			i += 2 + length
+		}
+	case ".png", ".apng":
+		if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+			return nil
+		}
+
+		for i := 8; i+12 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[i:]))
+			if length < 0 || i+12+length > len(data) {
+				return nil
+			}
+
+			if string(data[i+4:i+8]) == "eXIf" {
+				return data[i+8 : i+8+length]
+			}
+
+			i += 12 + length
+		}
+	case ".webp":
+		if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+			return nil
+		}
+
+		for i := 12; i+8 <= len(data); {
+			length := int(binary.LittleEndian.Uint32(data[i+4:]))
+			if length < 0 || i+8+length > len(data) {
+				return nil
+			}
+
+			if string(data[i:i+4]) == "EXIF" {
+				return data[i+8 : i+8+length]
+			}
+
+			i += 8 + length + length%2
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,304 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types"
+	"seedno.de/seednode/roulette/types/images"
+)
+
+type fileMetadata struct {
+	Path      string  `json:"path,omitempty"`
+	Name      string  `json:"name"`
+	Size      int64   `json:"size"`
+	Modified  string  `json:"modified"`
+	Format    string  `json:"format"`
+	MediaType string  `json:"media_type"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	Duration  float64 `json:"duration,omitempty"`
+	View      string  `json:"view"`
+	Source    string  `json:"source"`
+}
+
+// Translates a path provided by an API client into a file path, accepting
+// hashed identifiers if --hash-paths is enabled. Returns false if the
+// resulting path is outside of the paths served for the request.
+func (app *application) requestedPath(r *http.Request, requested string, paths []string, vhosts map[string]string, index *fileIndex) (string, bool) {
+	path := requested
+
+	if app.HashPaths {
+		resolved, found := index.resolve(requested)
+		if !found {
+			return "", false
+		}
+
+		path = resolved
+	}
+
+	path = filepath.Clean(path)
+
+	if !filepath.IsAbs(path) || !app.pathIsValid(path, app.servedPaths(r, paths, vhosts)) {
+		return "", false
+	}
+
+	return path, true
+}
+
+func (app *application) metadata(r *http.Request, path string, formats types.Types) (*fileMetadata, error) {
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		return nil, err
+	case info.IsDir():
+		return nil, ErrNoMediaFound
+	}
+
+	format, extension := app.detectFormat(path, formats)
+
+	if format == nil {
+		return nil, ErrNoMediaFound
+	}
+
+	root := app.rootUrl(r)
+
+	m := &fileMetadata{
+		Name:      filepath.Base(path),
+		Size:      info.Size(),
+		Modified:  info.ModTime().Format(time.RFC3339),
+		Format:    format.Name(),
+		MediaType: format.MediaType(extension),
+		View:      root + app.mediaUri(path),
+		Source:    root + app.generateFileUri(path),
+	}
+
+	if !app.HashPaths {
+		m.Path = path
+	}
+
+	if format.Name() == "images" {
+		dimensions, err := images.ImageDimensions(path)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Width = dimensions.Width()
+		m.Height = dimensions.Height()
+	}
+
+	// Files ffprobe is unable to read are still described, without a duration
+	if format.Name() == "audio" || format.Name() == "video" {
+		m.Duration, _ = mediaDuration(path)
+	}
+
+	return m, nil
+}
+
+func (app *application) serveMetadata(paths []string, vhosts map[string]string, index *fileIndex, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		requested := r.URL.Query().Get("path")
+
+		path, ok := app.requestedPath(r, requested, paths, vhosts, index)
+		if !ok {
+			app.notFound(w, r, requested)
+
+			return
+		}
+
+		m, err := app.metadata(r, path, formats)
+		if err != nil {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		app.serveJson(w, r, "File metadata for "+path, m, errorChannel)
+	}
+}
+
+// Reports whether the request carries the token specified via --admin-token.
+func (app *application) authorized(r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return app.AdminToken != "" && found && subtle.ConstantTimeCompare([]byte(token), []byte(app.AdminToken)) == 1
+}
+
+func (app *application) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if app.verbose() {
+		fmt.Printf("%s | ERROR: Unauthorized request for %s from %s\n",
+			time.Now().Format(logDate),
+			r.URL.Path,
+			requester(r))
+	}
+
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func (app *application) serveDelete(paths []string, vhosts map[string]string, index *fileIndex, notify *notifier, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		if !app.authorized(r) {
+			app.unauthorized(w, r)
+
+			return
+		}
+
+		requested := r.URL.Query().Get("path")
+
+		path, ok := app.requestedPath(r, requested, paths, vhosts, index)
+		if !ok {
+			app.notFound(w, r, requested)
+
+			return
+		}
+
+		exists, err := fileExists(path)
+		if err != nil {
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		}
+		if !exists {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		err = app.kill(path, index, notify)
+		if err != nil {
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		}
+
+		index.Export(errorChannel)
+
+		w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+
+		_, err = w.Write([]byte(fmt.Sprintf("Removed %s\n", requested)))
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | DELETE: %s removed by %s in %s\n",
+				startTime.Format(logDate),
+				path,
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+	}
+}
+
+// Returns the path a file should be moved to, given a destination
+// which is either an existing directory or the new path of the file.
+func moveDestination(path, destination string) string {
+	info, err := os.Stat(destination)
+	if err == nil && info.IsDir() {
+		return filepath.Join(destination, filepath.Base(path))
+	}
+
+	return destination
+}
+
+func (app *application) serveMove(paths []string, vhosts map[string]string, index *fileIndex, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		if !app.authorized(r) {
+			app.unauthorized(w, r)
+
+			return
+		}
+
+		requested := r.URL.Query().Get("path")
+
+		path, ok := app.requestedPath(r, requested, paths, vhosts, index)
+		if !ok {
+			app.notFound(w, r, requested)
+
+			return
+		}
+
+		destination := filepath.Clean(r.URL.Query().Get("destination"))
+
+		if !filepath.IsAbs(destination) || !app.pathIsValid(destination, app.servedPaths(r, paths, vhosts)) {
+			http.Error(w, "Destination must be inside a served path", http.StatusBadRequest)
+
+			return
+		}
+
+		destination = moveDestination(path, destination)
+
+		exists, err := fileExists(destination)
+		switch {
+		case err != nil:
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		case exists:
+			http.Error(w, "Destination already exists", http.StatusConflict)
+
+			return
+		}
+
+		err = os.Rename(path, destination)
+		if err != nil {
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		}
+
+		if app.Index {
+			index.move(path, destination, app.isSupported(destination, formats))
+
+			index.Export(errorChannel)
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | MOVE: %s moved to %s by %s in %s\n",
+				startTime.Format(logDate),
+				path,
+				destination,
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+
+		m, err := app.metadata(r, destination, formats)
+		if err != nil {
+			w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+
+			w.Write([]byte("Moved file\n"))
+
+			return
+		}
+
+		app.serveJson(w, r, "File metadata for "+destination, m, errorChannel)
+	}
+}
@@ -5,8 +5,10 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"image"
 	"io/fs"
 	"math/rand/v2"
 	"os"
@@ -21,6 +23,17 @@ import (
 	"seedno.de/seednode/roulette/types"
 )
 
+// Directories holding deleted files, which are skipped unless
+// --include-trash is set. Names beginning with .Trash- (followed by a
+// user ID) are also skipped.
+var trashDirectories = []string{
+	"#recycle",
+	".Trash",
+	".Trashes",
+	".recycle",
+	"@Recycle",
+}
+
 type scanStats struct {
 	filesMatched       chan int
 	filesSkipped       chan int
@@ -28,8 +41,61 @@ type scanStats struct {
 	directoriesSkipped chan int
 }
 
-func humanReadableSize(bytes int) string {
-	unit := 1000
+// Results of a previous scan of a single directory, used to skip
+// re-reading directories whose modification time has not changed.
+type directoryRecord struct {
+	modTime      time.Time
+	skipped      bool
+	filesSkipped int
+	files        []string
+	directories  []string
+}
+
+type directoryCache struct {
+	mutex    sync.Mutex
+	previous map[string]*directoryRecord
+	current  map[string]*directoryRecord
+	reused   int
+}
+
+func newDirectoryCache(previous map[string]*directoryRecord) *directoryCache {
+	return &directoryCache{
+		previous: previous,
+		current:  make(map[string]*directoryRecord),
+	}
+}
+
+func (cache *directoryCache) lookup(path string, modTime time.Time) *directoryRecord {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	record, exists := cache.previous[path]
+	if !exists || !record.modTime.Equal(modTime) {
+		return nil
+	}
+
+	cache.reused++
+
+	return record
+}
+
+func (cache *directoryCache) store(path string, record *directoryRecord) {
+	cache.mutex.Lock()
+	cache.current[path] = record
+	cache.mutex.Unlock()
+}
+
+func validSize(size string) bool {
+	_, err := types.ParseSize(size)
+
+	return err == nil
+}
+
+func (app *application) humanReadableSize(bytes int) string {
+	unit, prefixes, suffix := 1000, "kMGTPE", "B"
+	if app.BinaryPrefix {
+		unit, prefixes, suffix = 1024, "KMGTPE", "iB"
+	}
 
 	if bytes < unit {
 		return fmt.Sprintf("%d B", bytes)
@@ -42,27 +108,29 @@ func humanReadableSize(bytes int) string {
 		exp++
 	}
 
-	return fmt.Sprintf("%.1f %cB",
+	return fmt.Sprintf("%.1f %c%s",
 		float64(bytes)/float64(div),
-		"kMGTPE"[exp])
+		prefixes[exp],
+		suffix)
 }
 
-func kill(path string, index *fileIndex) error {
+func (app *application) kill(path string, index *fileIndex, notify *notifier) error {
 	err := os.Remove(path)
 	if err != nil {
 		return err
 	}
 
-	if Index {
+	notify.removed(path)
+
+	if app.Index {
 		index.remove(path)
-		index.generate()
 	}
 
-	return nil
+	return app.sharedIndex.remove(path)
 }
 
-func newFile(list []string, sortOrder string, filename *regexp.Regexp, formats types.Types) (string, error) {
-	path, err := pickFile(list)
+func (app *application) newFile(list []string, stats *serveStats, rng *rand.Rand, sortOrder string, filename *regexp.Regexp, formats types.Types) (string, error) {
+	path, err := app.pickFile(list, stats, rng)
 	if err != nil {
 		return "", err
 	}
@@ -164,7 +232,7 @@ func fileExists(path string) (bool, error) {
 	}
 }
 
-func pathIsValid(path string, paths []string) bool {
+func (app *application) pathIsValid(path string, paths []string) bool {
 	var matchesPrefix = false
 
 	for i := 0; i < len(paths); i++ {
@@ -176,7 +244,7 @@ func pathIsValid(path string, paths []string) bool {
 	}
 
 	switch {
-	case Verbose && !matchesPrefix:
+	case app.verbose() && !matchesPrefix:
 		fmt.Printf("%s | ERROR: File outside specified path(s): %s\n",
 			time.Now().Format(logDate),
 			path)
@@ -189,8 +257,77 @@ func pathIsValid(path string, paths []string) bool {
 	}
 }
 
-func hasSupportedFiles(path string, formats types.Types) (bool, error) {
-	if AllowEmpty {
+func (app *application) isSupported(path string, formats types.Types) bool {
+	if formats.Validate(path) {
+		return true
+	}
+
+	if app.Sniff {
+		format, _ := formats.Sniff(path)
+
+		return format != nil
+	}
+
+	return false
+}
+
+// Returns the format of the file, and the extension it is treated as
+// having. If --sniff is set, files whose extension is missing or
+// unregistered are detected by their contents, with those lacking an
+// extension only falling back to the --extensionless type if that fails.
+func (app *application) detectFormat(path string, formats types.Types) (types.Type, string) {
+	extension := filepath.Ext(path)
+
+	format := formats.FileType(path)
+
+	if app.Sniff && (format == nil || extension == "") {
+		sniffed, sniffedExtension := formats.Sniff(path)
+		if sniffed != nil {
+			return sniffed, sniffedExtension
+		}
+	}
+
+	return format, extension
+}
+
+// Returns whether the file passes validation for its format and, if it is
+// an image, can be decoded. Files which fail are added to the problems
+// report.
+func (app *application) displayable(path string, formats types.Types, errorChannel chan<- error) bool {
+	format, _ := app.detectFormat(path, formats)
+
+	switch {
+	case format == nil:
+		return true
+	case !format.Validate(path):
+		errorChannel <- &fileProblem{path: path, err: ErrFailedValidation}
+
+		return false
+	case format.Name() != "images":
+		return true
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		errorChannel <- err
+
+		return false
+	}
+	defer file.Close()
+
+	// Formats without a decoder (e.g. AVIF) are left to the browser
+	_, _, err = image.DecodeConfig(file)
+	if err != nil && !errors.Is(err, image.ErrFormat) {
+		errorChannel <- &fileProblem{path: path, err: ErrInvalidImageData}
+
+		return false
+	}
+
+	return true
+}
+
+func (app *application) hasSupportedFiles(path string, formats types.Types) (bool, error) {
+	if app.AllowEmpty {
 		return true, nil
 	}
 
@@ -202,9 +339,11 @@ func hasSupportedFiles(path string, formats types.Types) (bool, error) {
 		}
 
 		switch {
-		case !Recursive && info.IsDir() && p != path:
+		case !app.Recursive && info.IsDir() && p != path:
 			return filepath.SkipDir
-		case !info.IsDir() && formats.Validate(p):
+		case !app.IncludeTrash && info.IsDir() && p != path && isTrash(info.Name()):
+			return filepath.SkipDir
+		case !info.IsDir() && app.isSupported(p, formats):
 			hasRegisteredFiles <- true
 
 			return filepath.SkipAll
@@ -224,13 +363,48 @@ func hasSupportedFiles(path string, formats types.Types) (bool, error) {
 	}
 }
 
-func walkPath(path string, fileChannel chan<- string, wg1 *sync.WaitGroup, stats *scanStats, limit chan struct{}, formats types.Types, errorChannel chan<- error) {
-	limit <- struct{}{}
+// Returns whether the directory name is one used by desktop environments,
+// operating systems, or NAS appliances to hold deleted files.
+func isTrash(name string) bool {
+	switch {
+	case strings.HasPrefix(name, ".Trash-"):
+		return true
+	case strings.EqualFold(name, "$RECYCLE.BIN"), strings.EqualFold(name, "RECYCLER"):
+		return true
+	}
+
+	return slices.Contains(trashDirectories, name)
+}
+
+func (app *application) walkPath(ctx context.Context, path string, fileChannel chan<- string, wg1 *sync.WaitGroup, stats *scanStats, limit chan struct{}, cache *directoryCache, formats types.Types, errorChannel chan<- error) {
+	select {
+	case limit <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
 
 	defer func() {
 		<-limit
 	}()
 
+	info, err := os.Stat(path)
+	if err != nil {
+		stats.directoriesSkipped <- 1
+
+		errorChannel <- err
+
+		return
+	}
+
+	record := cache.lookup(path, info.ModTime())
+	if record != nil {
+		app.walkCachedPath(ctx, path, record, fileChannel, wg1, stats, limit, cache, formats, errorChannel)
+
+		return
+	}
+
+	record = &directoryRecord{modTime: info.ModTime()}
+
 	nodes, err := os.ReadDir(path)
 	if err != nil {
 		stats.directoriesSkipped <- 1
@@ -249,11 +423,11 @@ func walkPath(path string, fileChannel chan<- string, wg1 *sync.WaitGroup, stats
 		if !node.IsDir() {
 			files++
 
-			if Ignore != "" && node.Name() == Ignore {
+			if app.Ignore != "" && node.Name() == app.Ignore {
 				skipDir = true
 			}
 
-			if Override != "" && node.Name() == Override {
+			if app.Override != "" && node.Name() == app.Override {
 				overrideDir = true
 			}
 		}
@@ -261,18 +435,29 @@ func walkPath(path string, fileChannel chan<- string, wg1 *sync.WaitGroup, stats
 
 	var skipFiles = false
 
-	if !overrideDir && (files > MaxFiles || files < MinFiles || skipDir) {
+	if !overrideDir && (files > app.MaxFiles || files < app.MinFiles || skipDir) {
 		stats.filesSkipped <- files
 		stats.directoriesSkipped <- 1
 
+		record.skipped = true
+		record.filesSkipped = files
+
 		skipFiles = true
 	} else {
 		stats.directoriesMatched <- 1
 	}
 
+	captioned := captionedNames(nodes, formats)
+
+	var mutex sync.Mutex
+
 	var wg2 sync.WaitGroup
 
 	for _, node := range nodes {
+		if ctx.Err() != nil {
+			break
+		}
+
 		wg2.Add(1)
 
 		go func(node fs.DirEntry) {
@@ -281,13 +466,19 @@ func walkPath(path string, fileChannel chan<- string, wg1 *sync.WaitGroup, stats
 			fullPath := filepath.Join(path, node.Name())
 
 			switch {
-			case node.IsDir() && Recursive:
+			case node.IsDir() && app.Recursive && !app.IncludeTrash && isTrash(node.Name()):
+				stats.directoriesSkipped <- 1
+			case node.IsDir() && app.Recursive:
+				mutex.Lock()
+				record.directories = append(record.directories, fullPath)
+				mutex.Unlock()
+
 				wg1.Add(1)
 
 				go func() {
 					defer wg1.Done()
 
-					walkPath(fullPath, fileChannel, wg1, stats, limit, formats, errorChannel)
+					app.walkPath(ctx, fullPath, fileChannel, wg1, stats, limit, cache, formats, errorChannel)
 				}()
 
 			case !node.IsDir() && !skipFiles:
@@ -296,23 +487,70 @@ func walkPath(path string, fileChannel chan<- string, wg1 *sync.WaitGroup, stats
 				switch {
 				case err != nil:
 					errorChannel <- err
-				case formats.Validate(path) || Fallback:
+				case isCaption(node.Name(), captioned):
+				case app.isSupported(path, formats) || app.Fallback:
+					mutex.Lock()
+					record.files = append(record.files, path)
+					mutex.Unlock()
+
 					fileChannel <- path
 
 					stats.filesMatched <- 1
 
 					return
+				case formats.FileType(path) != nil:
+					errorChannel <- &fileProblem{path: path, err: ErrFailedValidation}
 				}
 
+				mutex.Lock()
+				record.filesSkipped++
+				mutex.Unlock()
+
 				stats.filesSkipped <- 1
 			}
 		}(node)
 	}
 
 	wg2.Wait()
+
+	if ctx.Err() == nil {
+		cache.store(path, record)
+	}
 }
 
-func scanPaths(paths []string, formats types.Types, errorChannel chan<- error) []string {
+// Replays the results of a previous scan for a directory which has not been
+// modified since, then continues walking its subdirectories as usual.
+func (app *application) walkCachedPath(ctx context.Context, path string, record *directoryRecord, fileChannel chan<- string, wg1 *sync.WaitGroup, stats *scanStats, limit chan struct{}, cache *directoryCache, formats types.Types, errorChannel chan<- error) {
+	if record.skipped {
+		stats.directoriesSkipped <- 1
+	} else {
+		stats.directoriesMatched <- 1
+	}
+
+	if record.filesSkipped > 0 {
+		stats.filesSkipped <- record.filesSkipped
+	}
+
+	for _, file := range record.files {
+		fileChannel <- file
+
+		stats.filesMatched <- 1
+	}
+
+	for _, directory := range record.directories {
+		wg1.Add(1)
+
+		go func(directory string) {
+			defer wg1.Done()
+
+			app.walkPath(ctx, directory, fileChannel, wg1, stats, limit, cache, formats, errorChannel)
+		}(directory)
+	}
+
+	cache.store(path, record)
+}
+
+func (app *application) scanPaths(ctx context.Context, paths []string, cache *directoryCache, formats types.Types, errorChannel chan<- error) ([]string, error) {
 	startTime := time.Now()
 
 	var filesMatched, filesSkipped int
@@ -401,7 +639,7 @@ func scanPaths(paths []string, formats types.Types, errorChannel chan<- error) [
 		}
 	}()
 
-	limit := make(chan struct{}, Concurrency)
+	limit := make(chan struct{}, app.Concurrency)
 
 	var wg1 sync.WaitGroup
 
@@ -411,7 +649,7 @@ func scanPaths(paths []string, formats types.Types, errorChannel chan<- error) [
 		go func(i int) {
 			defer wg1.Done()
 
-			walkPath(paths[i], fileChannel, &wg1, stats, limit, formats, errorChannel)
+			app.walkPath(ctx, paths[i], fileChannel, &wg1, stats, limit, cache, formats, errorChannel)
 		}(i)
 	}
 
@@ -421,7 +659,17 @@ func scanPaths(paths []string, formats types.Types, errorChannel chan<- error) [
 
 	wg0.Wait()
 
-	if Verbose {
+	if ctx.Err() != nil {
+		if app.verbose() {
+			fmt.Printf("%s | INDEX: Scan canceled after %s\n",
+				time.Now().Format(logDate),
+				time.Since(startTime).Round(time.Microsecond))
+		}
+
+		return nil, ctx.Err()
+	}
+
+	if app.verbose() {
 		fmt.Printf("%s | INDEX: Selected %d/%d files across %d/%d directories in %s\n",
 			time.Now().Format(logDate),
 			filesMatched,
@@ -433,43 +681,93 @@ func scanPaths(paths []string, formats types.Types, errorChannel chan<- error) [
 
 	slices.Sort(list)
 
-	return list
+	return list, nil
 }
 
-func fileList(paths []string, index *fileIndex, formats types.Types, errorChannel chan<- error) []string {
+// Returns a list of candidate files. If within is non-empty,
+// only files inside that path are returned.
+func (app *application) fileList(ctx context.Context, paths []string, within string, index *fileIndex, rng *rand.Rand, formats types.Types, errorChannel chan<- error) []string {
 	switch {
-	case Index && !index.isEmpty():
-		return index.pathMap[index.getDirectory()]
-	case Index && index.isEmpty():
-		index.set(scanPaths(paths, formats, errorChannel), errorChannel)
+	case app.Index && !index.isEmpty():
+		return index.sampleScheduled(rng, paths, within, formats)
+	case app.Index && index.isEmpty():
+		cache := newDirectoryCache(nil)
+
+		startTime := time.Now()
+
+		list, err := app.scanPaths(ctx, paths, cache, formats, errorChannel)
+		if err != nil {
+			return nil
+		}
+
+		list = app.mergeListed(list, "", formats, errorChannel)
+
+		index.set(list, errorChannel)
+
+		app.sharedIndex.publish(list, errorChannel)
 
-		return index.pathMap[index.getDirectory()]
+		index.setScan(cache.current, startTime)
+
+		if index.isEmpty() {
+			return nil
+		}
+
+		return index.sampleScheduled(rng, paths, within, formats)
 	default:
-		return scanPaths(paths, formats, errorChannel)
+		if within != "" {
+			paths = []string{within}
+		}
+
+		list, err := app.scanPaths(ctx, paths, newDirectoryCache(nil), formats, errorChannel)
+		if err != nil {
+			return nil
+		}
+
+		list = app.mergeListed(list, within, formats, errorChannel)
+
+		return app.sampleList(app.scheduled(list, formats), paths, app.Sampling, rng)
 	}
 }
 
-func pickFile(list []string) (string, error) {
+// Returns a list of candidate files as fileList does, sampling another
+// directory from the index in place of one whose files have all been
+// served within the --no-repeat window.
+func (app *application) freshFileList(ctx context.Context, paths []string, within string, index *fileIndex, stats *serveStats, rng *rand.Rand, formats types.Types, errorChannel chan<- error) []string {
+	list := app.fileList(ctx, paths, within, index, rng, formats, errorChannel)
+
+	for attempts := 1; app.Index && app.NoRepeat > 0 && attempts < noRepeatAttempts && len(list) > 0 && len(stats.notRecent(list)) == 0; attempts++ {
+		list = app.fileList(ctx, paths, within, index, rng, formats, errorChannel)
+	}
+
+	return list
+}
+
+func (app *application) pickFile(list []string, stats *serveStats, rng *rand.Rand) (string, error) {
 	fileCount := len(list)
 
 	switch {
-	case fileCount < 1 && AllowEmpty:
+	case fileCount < 1 && app.AllowEmpty:
 		return "", nil
 	case fileCount < 1:
 		return "", ErrNoMediaFound
 	}
 
-	return list[rand.IntN(fileCount)], nil
-}
+	// Files served within the --no-repeat window are passed over,
+	// unless every candidate has been served recently
+	fresh := stats.notRecent(list)
+	if len(fresh) > 0 {
+		list = fresh
+	}
 
-func preparePath(prefix, path string) string {
-	if runtime.GOOS == "windows" {
-		return fmt.Sprintf("%s/%s",
-			prefix,
-			filepath.ToSlash(path))
+	if app.PreferUnseen {
+		return stats.pickUnseen(list, rng), nil
 	}
 
-	return prefix + path
+	return list[rng.IntN(len(list))], nil
+}
+
+func preparePath(prefix, path string) string {
+	return prefix + urlPath(path)
 }
 
 func normalizePath(path string) (string, error) {
@@ -494,10 +792,26 @@ func normalizePath(path string) (string, error) {
 		return "", err
 	}
 
-	return absolutePath, nil
+	return trimLongPathPrefix(absolutePath), nil
+}
+
+// Removes the \\?\ prefix from Windows long paths (e.g. \\?\C:\Photos or
+// \\?\UNC\server\share), as it cannot be represented in URLs. The standard
+// library adds it back as needed when accessing files.
+func trimLongPathPrefix(path string) string {
+	if runtime.GOOS != "windows" {
+		return path
+	}
+
+	share, found := strings.CutPrefix(path, `\\?\UNC\`)
+	if found {
+		return `\\` + share
+	}
+
+	return strings.TrimPrefix(path, `\\?\`)
 }
 
-func validatePaths(args []string, formats types.Types) ([]string, error) {
+func (app *application) validatePaths(args []string, formats types.Types) ([]string, error) {
 	var paths []string
 
 	for i := 0; i < len(args); i++ {
@@ -508,14 +822,14 @@ func validatePaths(args []string, formats types.Types) ([]string, error) {
 
 		pathMatches := args[i] == path
 
-		hasSupportedFiles, err := hasSupportedFiles(path, formats)
+		hasSupportedFiles, err := app.hasSupportedFiles(path, formats)
 		if err != nil {
 			return nil, err
 		}
 
 		switch {
 		case pathMatches && hasSupportedFiles:
-			if Verbose {
+			if app.verbose() {
 				fmt.Printf("%s | PATHS: Added %s\n",
 					time.Now().Format(logDate),
 					args[i])
@@ -523,7 +837,7 @@ func validatePaths(args []string, formats types.Types) ([]string, error) {
 
 			paths = append(paths, path)
 		case !pathMatches && hasSupportedFiles:
-			if Verbose {
+			if app.verbose() {
 				fmt.Printf("%s | PATHS: Added %s [resolved to %s]\n",
 					time.Now().Format(logDate),
 					args[i],
@@ -532,13 +846,13 @@ func validatePaths(args []string, formats types.Types) ([]string, error) {
 
 			paths = append(paths, path)
 		case pathMatches && !hasSupportedFiles:
-			if Verbose {
+			if app.verbose() {
 				fmt.Printf("%s | PATHS: Skipped %s (No supported files found)\n",
 					time.Now().Format(logDate),
 					args[i])
 			}
 		case !pathMatches && !hasSupportedFiles:
-			if Verbose {
+			if app.verbose() {
 				fmt.Printf("%s | PATHS: Skipped %s [resolved to %s] (No supported files found)\n",
 					time.Now().Format(logDate),
 					args[i],
@@ -0,0 +1,35 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Renders a button (also bound to the F key) which toggles fullscreen
+// display of the media element on the page, falling back to the entire
+// page if there is none.
+func fullscreenButton(nonce string) string {
+	var htmlBody strings.Builder
+
+	htmlBody.WriteString(`<button id="fullscreen-toggle" style="position:fixed;top:0.5rem;right:0.5rem;z-index:1;" aria-pressed="false">Fullscreen</button>`)
+	htmlBody.WriteString(fmt.Sprintf(`<script nonce="%s">(function(){`, nonce))
+	htmlBody.WriteString(`var toggle = document.getElementById("fullscreen-toggle");`)
+	htmlBody.WriteString(`if (!document.fullscreenEnabled) { toggle.style.display = "none"; return; }`)
+	htmlBody.WriteString(`function target() {`)
+	htmlBody.WriteString(`return document.querySelector("ruffle-embed, ruffle-player, video, img:not(.similar)") || document.documentElement;}`)
+	htmlBody.WriteString(`function toggleFullscreen() {`)
+	htmlBody.WriteString(`if (document.fullscreenElement) { document.exitFullscreen(); } else { target().requestFullscreen(); }}`)
+	htmlBody.WriteString(`toggle.addEventListener("click", toggleFullscreen);`)
+	htmlBody.WriteString(`document.addEventListener("fullscreenchange", function() {`)
+	htmlBody.WriteString(`toggle.textContent = document.fullscreenElement ? "Exit fullscreen" : "Fullscreen";`)
+	htmlBody.WriteString(`toggle.setAttribute("aria-pressed", document.fullscreenElement !== null);});`)
+	htmlBody.WriteString(`document.addEventListener("keyup", function(e) {`)
+	htmlBody.WriteString(`if ((e.key == "f" || e.key == "F") && !e.ctrlKey && !e.metaKey && !e.altKey) { toggleFullscreen(); }});`)
+	htmlBody.WriteString(`})();</script>`)
+
+	return htmlBody.String()
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	hashedPrefix string = `/h/`
+	hashLength   int    = 12
+)
+
+// Returns a short, opaque identifier for the specified path, used in
+// place of the path itself in URLs when --hash-paths is enabled.
+func hashPath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+
+	return hex.EncodeToString(sum[:])[:hashLength]
+}
+
+func generateHashes(list []string) map[string]string {
+	hashes := make(map[string]string, len(list))
+
+	for _, path := range list {
+		hashes[hashPath(path)] = path
+	}
+
+	return hashes
+}
+
+// Translates a hashed URI (e.g. /h/3fa9c2e1b07d) back into the
+// corresponding path, if it is present in the index.
+func (index *fileIndex) resolve(uri string) (string, bool) {
+	hash, found := strings.CutPrefix(uri, hashedPrefix)
+	if !found {
+		return "", false
+	}
+
+	index.mutex.RLock()
+	path, exists := index.hashes[hash]
+	index.mutex.RUnlock()
+
+	return path, exists
+}
+
+// Returns the path component used to address the specified file on view pages.
+func (app *application) mediaUri(path string) string {
+	if app.HashPaths {
+		return mediaPrefix + hashedPrefix + hashPath(path)
+	}
+
+	return preparePath(mediaPrefix, path)
+}
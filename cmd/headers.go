@@ -0,0 +1,109 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Header names must consist solely of token characters, per RFC 9110.
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+type customHeader struct {
+	name  string
+	value string
+}
+
+func (app *application) parseHeaders(headers []string) ([]customHeader, error) {
+	parsed := make([]customHeader, 0, len(headers))
+
+	for _, h := range headers {
+		name, value, found := strings.Cut(h, ":")
+		if !found || !headerName.MatchString(name) || strings.ContainsAny(value, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+
+		header := customHeader{
+			name:  textproto.CanonicalMIMEHeaderKey(name),
+			value: strings.TrimSpace(value),
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | HEADER: Setting %s to %q\n",
+				time.Now().Format(logDate),
+				header.name,
+				header.value,
+			)
+		}
+
+		parsed = append(parsed, header)
+	}
+
+	return parsed, nil
+}
+
+// Applies the custom headers once the handler has set its own,
+// so that any header set by roulette can be overridden.
+type headerWriter struct {
+	app *application
+
+	http.ResponseWriter
+	applied bool
+}
+
+func (hw *headerWriter) WriteHeader(status int) {
+	if !hw.applied {
+		hw.applied = true
+
+		for _, header := range hw.app.customHeaders {
+			if header.value == "" {
+				hw.Header().Del(header.name)
+
+				continue
+			}
+
+			hw.Header().Set(header.name, header.value)
+		}
+	}
+
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerWriter) Write(p []byte) (int, error) {
+	if !hw.applied {
+		hw.WriteHeader(http.StatusOK)
+	}
+
+	return hw.ResponseWriter.Write(p)
+}
+
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// Sets the headers specified via --header on every response. A header
+// with an empty value is removed from responses instead.
+func (app *application) withHeaders(next http.Handler) http.Handler {
+	if len(app.customHeaders) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerWriter{app: app, ResponseWriter: w}
+
+		next.ServeHTTP(hw, r)
+
+		// Handlers which set headers without writing a body
+		// (e.g. HEAD requests) still receive them
+		if !hw.applied {
+			hw.WriteHeader(http.StatusOK)
+		}
+	})
+}
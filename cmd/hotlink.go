@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Returns the hostname, without any port, of the specified URL or host.
+func hostname(host string) string {
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.ToLower(host)
+	}
+
+	return strings.ToLower(name)
+}
+
+// Returns whether the host is one of the sites allowed via --hotlink-allow.
+// Entries beginning with "*." match any subdomain of the remainder.
+func (app *application) hotlinkAllowed(host string) bool {
+	for _, allowed := range app.HotlinkAllow {
+		allowed = strings.ToLower(allowed)
+
+		suffix, wildcard := strings.CutPrefix(allowed, "*")
+		switch {
+		case wildcard && strings.HasSuffix(host, suffix):
+			return true
+		case host == allowed:
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns whether the request was made by a page on another site. Requests
+// without an Origin or Referer header (e.g. direct navigation, or clients
+// which strip them for privacy) are not considered hotlinks, nor are those
+// carrying the admin token.
+func (app *application) hotlinked(r *http.Request) bool {
+	if !app.HotlinkProtect || app.authorized(r) {
+		return false
+	}
+
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Referer()
+	}
+
+	if source == "" {
+		return false
+	}
+
+	parsed, err := url.Parse(source)
+	if err != nil || parsed.Host == "" {
+		return true
+	}
+
+	host := hostname(parsed.Host)
+
+	if host == hostname(app.requestHost(r)) || app.hotlinkAllowed(host) {
+		return false
+	}
+
+	if app.BaseUrl != "" {
+		base, err := url.Parse(app.BaseUrl)
+		if err == nil && host == hostname(base.Host) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (app *application) rejectHotlink(w http.ResponseWriter, r *http.Request) {
+	if app.verbose() {
+		fmt.Printf("%s | ERROR: Hotlinked request for %s from %s (referred by %s)\n",
+			time.Now().Format(logDate),
+			r.URL.Path,
+			requester(r),
+			r.Referer(),
+		)
+	}
+
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
@@ -5,85 +5,370 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package cmd
 
 import (
-	"encoding/gob"
+	"context"
 	"fmt"
+	"io"
+	"maps"
 	"math/rand/v2"
 	"net/http"
-	"os"
-	"path"
+	"path/filepath"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"github.com/klauspost/compress/zstd"
 	"seedno.de/seednode/roulette/types"
 )
 
 type fileIndex struct {
-	mutex     *sync.RWMutex
-	pathMap   map[string][]string
-	pathIndex []string
-	list      []string
+	app *application
+
+	mutex       *sync.RWMutex
+	pathMap     map[string]*indexDirectory
+	pathIndex   []string
+	hashes      map[string]string
+	contents    map[string]contentHash
+	duplicates  []duplicateGroup
+	perceptual  map[string]perceptualHash
+	list        []string
+	positions   map[string]int
+	previous    []string
+	priorHashes map[string]contentHash
+	directories map[string]*directoryRecord
+	cancel      context.CancelFunc
+	scanTime    time.Time
+	scanLength  time.Duration
 }
 
-func (index *fileIndex) remove(path string) {
+// The files in a single directory of the index, in sorted order. Each
+// directory has its own lock, so that removing a file only blocks
+// readers of the directory containing it.
+type indexDirectory struct {
+	mutex sync.RWMutex
+	files []string
+}
+
+// Returns a copy of the files in the directory, which remains
+// valid after subsequent changes to the index.
+func (directory *indexDirectory) snapshot() []string {
+	if directory == nil {
+		return nil
+	}
+
+	directory.mutex.RLock()
+	defer directory.mutex.RUnlock()
+
+	return slices.Clone(directory.files)
+}
+
+func (directory *indexDirectory) length() int {
+	if directory == nil {
+		return 0
+	}
+
+	directory.mutex.RLock()
+	defer directory.mutex.RUnlock()
+
+	return len(directory.files)
+}
+
+// Removes a file from the directory, returning the number of files left.
+func (directory *indexDirectory) delete(file string) int {
+	directory.mutex.Lock()
+	defer directory.mutex.Unlock()
+
+	position, found := slices.BinarySearch(directory.files, file)
+	if found {
+		directory.files = slices.Delete(directory.files, position, position+1)
+	}
+
+	return len(directory.files)
+}
+
+// Returns a copy of the files in the specified directory of the index.
+func (index *fileIndex) directory(dir string) []string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	return index.pathMap[dir].snapshot()
+}
+
+// Returns the first and last files in the specified directory of the
+// index, without copying the rest.
+func (index *fileIndex) bounds(dir string) (string, string) {
 	index.mutex.RLock()
-	t := make([]string, len(index.list))
-	copy(t, index.list)
+	directory := index.pathMap[dir]
 	index.mutex.RUnlock()
 
-	var position int
+	if directory == nil {
+		return "", ""
+	}
+
+	directory.mutex.RLock()
+	defer directory.mutex.RUnlock()
 
-	for k, v := range t {
-		if path == v {
-			position = k
+	if len(directory.files) == 0 {
+		return "", ""
+	}
 
-			break
-		}
+	return directory.files[0], directory.files[len(directory.files)-1]
+}
+
+// Maps each entry in the list to its position, so that
+// entries can be removed without searching the list.
+func positionsOf(list []string) map[string]int {
+	positions := make(map[string]int, len(list))
+
+	for i, v := range list {
+		positions[v] = i
 	}
 
-	t[position] = t[len(t)-1]
+	return positions
+}
 
+// Removes a file from the index in place. Only its own entry and the
+// directory containing it are modified, so the index is not regenerated
+// unless derived data spanning multiple directories (duplicate groups or
+// perceptual hashes) must be recalculated.
+func (index *fileIndex) remove(file string) {
 	index.mutex.Lock()
-	index.list = make([]string, len(t)-1)
-	copy(index.list, t[:len(t)-1])
+
+	position, found := index.positions[file]
+	if !found {
+		index.mutex.Unlock()
+
+		return
+	}
+
+	// The list is unordered, so the last entry is moved into the gap
+	last := len(index.list) - 1
+
+	index.list[position] = index.list[last]
+	index.positions[index.list[position]] = position
+	index.list[last] = ""
+	index.list = index.list[:last]
+
+	delete(index.positions, file)
+
+	if index.hashes != nil {
+		delete(index.hashes, hashPath(file))
+	}
+
+	// Content hashes are read without holding the lock while
+	// regenerating the index, so they are replaced
+	_, hashed := index.contents[file]
+	if hashed {
+		index.contents = maps.Clone(index.contents)
+
+		delete(index.contents, file)
+	}
+
+	dir, _ := filepath.Split(file)
+
+	directory := index.pathMap[dir]
 	index.mutex.Unlock()
+
+	if index.app.Duplicates || index.app.Similar {
+		index.generate()
+
+		return
+	}
+
+	if directory == nil || directory.delete(file) > 0 {
+		return
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	// The directory may have been refilled or replaced in the meantime
+	if index.pathMap[dir] != directory || directory.length() > 0 {
+		return
+	}
+
+	delete(index.pathMap, dir)
+
+	position, found = slices.BinarySearch(index.pathIndex, dir)
+	if found {
+		index.pathIndex = slices.Delete(index.pathIndex, position, position+1)
+	}
 }
 
-func (index *fileIndex) getDirectory() string {
+// Replaces an entry in the index with its new path, updating the list,
+// directory map, and hash table under a single lock. If keep is false, the
+// entry is removed instead (e.g. if the new path is not a supported file).
+func (index *fileIndex) move(from, to string, keep bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	position, found := index.positions[from]
+	if !found {
+		return
+	}
+
+	delete(index.positions, from)
+
+	if keep {
+		index.list[position] = to
+		index.positions[to] = position
+	} else {
+		last := len(index.list) - 1
+
+		index.list[position] = index.list[last]
+		index.positions[index.list[position]] = position
+		index.list[last] = ""
+		index.list = index.list[:last]
+	}
+
+	fromDir, _ := filepath.Split(from)
+
+	directory := index.pathMap[fromDir]
+	if directory != nil && directory.delete(from) == 0 {
+		delete(index.pathMap, fromDir)
+
+		position, found := slices.BinarySearch(index.pathIndex, fromDir)
+		if found {
+			index.pathIndex = slices.Delete(index.pathIndex, position, position+1)
+		}
+	}
+
+	if index.hashes != nil {
+		delete(index.hashes, hashPath(from))
+	}
+
+	// Content hashes are read without holding the lock while
+	// regenerating the index, so they are replaced
+	hash, hashed := index.contents[from]
+	if hashed {
+		index.contents = maps.Clone(index.contents)
+
+		delete(index.contents, from)
+	}
+
+	if !keep {
+		return
+	}
+
+	toDir, _ := filepath.Split(to)
+
+	directory = index.pathMap[toDir]
+	if directory == nil {
+		directory = &indexDirectory{}
+		index.pathMap[toDir] = directory
+
+		position, _ := slices.BinarySearch(index.pathIndex, toDir)
+		index.pathIndex = slices.Insert(index.pathIndex, position, toDir)
+	}
+
+	directory.mutex.Lock()
+	position, _ = slices.BinarySearch(directory.files, to)
+	directory.files = slices.Insert(directory.files, position, to)
+	directory.mutex.Unlock()
+
+	if index.hashes != nil {
+		index.hashes[hashPath(to)] = to
+	}
+
+	if hashed {
+		index.contents[to] = hash
+	}
+}
+
+// Returns a random directory from the index. If within is non-empty, only
+// directories inside that path are considered.
+func (index *fileIndex) getDirectory(rng *rand.Rand, within string) string {
 	index.mutex.RLock()
-	retVal := index.pathIndex[rand.IntN(len(index.pathIndex))]
-	index.mutex.RUnlock()
+	defer index.mutex.RUnlock()
+
+	low, high := index.directoryRange(within)
+
+	if low == high {
+		return ""
+	}
 
-	return retVal
+	return index.pathIndex[low+rng.IntN(high-low)]
 }
 
 func (index *fileIndex) generate() {
 	i := make([]string, 0)
-	d := make(map[string][]string)
+	d := make(map[string]*indexDirectory)
+
+	var contents map[string]contentHash
+
+	var duplicates []duplicateGroup
+
+	var redundant map[string]bool
+
+	if index.app.Duplicates || index.app.HashContents {
+		index.mutex.RLock()
+		list := slices.Clone(index.list)
+		previous := index.contents
+		index.mutex.RUnlock()
+
+		contents = index.app.hashFiles(list, previous, index.app.HashContents)
+	}
+
+	if index.app.Duplicates {
+		duplicates = duplicateGroups(contents)
+
+		if index.app.SkipDuplicates {
+			redundant = redundantCopies(duplicates)
+		}
+	}
+
+	var perceptual map[string]perceptualHash
+
+	if index.app.Similar {
+		index.mutex.RLock()
+		list := slices.Clone(index.list)
+		previous := index.perceptual
+		index.mutex.RUnlock()
+
+		perceptual = findSimilar(list, previous)
+	}
 
 	index.mutex.RLock()
 	for _, v := range index.list {
-		dir, _ := path.Split(v)
+		if redundant[v] {
+			continue
+		}
+
+		dir, _ := filepath.Split(v)
 
-		d[dir] = append(d[dir], v)
+		directory, found := d[dir]
+		if !found {
+			directory = &indexDirectory{}
+			d[dir] = directory
 
-		if !slices.Contains(i, dir) {
 			i = append(i, dir)
 		}
+
+		directory.files = append(directory.files, v)
 	}
 	index.mutex.RUnlock()
 
-	for k := range d {
-		slices.Sort(d[k])
+	for _, directory := range d {
+		slices.Sort(directory.files)
 	}
 
 	slices.Sort(i)
 
+	var h map[string]string
+
+	if index.app.HashPaths {
+		index.mutex.RLock()
+		h = generateHashes(index.list)
+		index.mutex.RUnlock()
+	}
+
 	index.mutex.Lock()
 	index.pathMap = d
 	index.pathIndex = i
+	index.hashes = h
+	index.contents = contents
+	index.duplicates = duplicates
+	index.perceptual = perceptual
 	index.mutex.Unlock()
 }
 
@@ -95,23 +380,36 @@ func (index *fileIndex) set(val []string, errorChannel chan<- error) {
 	}
 
 	index.mutex.Lock()
+	index.previous = index.list
+	index.priorHashes = index.contents
 	index.list = make([]string, length)
 	copy(index.list, val)
+	index.positions = positionsOf(index.list)
 	index.mutex.Unlock()
 
 	index.generate()
 
-	if Index && IndexFile != "" {
-		index.Export(IndexFile, errorChannel)
-	}
+	index.Export(errorChannel)
 }
 
-func (index *fileIndex) clear() {
+// Records the results of a completed scan, for use by
+// subsequent incremental rebuilds and the stats endpoint.
+func (index *fileIndex) setScan(directories map[string]*directoryRecord, startTime time.Time) {
 	index.mutex.Lock()
-	index.list = nil
+	index.directories = directories
+	index.scanTime = startTime
+	index.scanLength = time.Since(startTime)
 	index.mutex.Unlock()
 }
 
+func (index *fileIndex) contains(file string) bool {
+	index.mutex.RLock()
+	_, found := index.positions[file]
+	index.mutex.RUnlock()
+
+	return found
+}
+
 func (index *fileIndex) isEmpty() bool {
 	index.mutex.RLock()
 	length := len(index.list)
@@ -120,143 +418,226 @@ func (index *fileIndex) isEmpty() bool {
 	return length == 0
 }
 
-func (index *fileIndex) Export(path string, errorChannel chan<- error) {
-	startTime := time.Now()
-
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		errorChannel <- err
-
+// Writes the index to --index-file if set, or otherwise to the state
+// database, if --state-dir is set.
+func (index *fileIndex) Export(errorChannel chan<- error) {
+	if !index.app.Index || !index.app.persisted(index.app.IndexFile) {
 		return
 	}
-	defer file.Close()
 
-	encoder, err := zstd.NewWriter(file, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
-	if err != nil {
-		errorChannel <- err
+	startTime := time.Now()
 
-		return
-	}
-	defer encoder.Close()
+	var length int
 
-	enc := gob.NewEncoder(encoder)
+	size, err := index.app.saveState(index.app.IndexFile, stateIndexKey, func(w io.Writer) error {
+		writer, err := index.app.compressIndex(w)
+		if err != nil {
+			return err
+		}
+		defer writer.Close()
 
-	index.mutex.RLock()
-	err = enc.Encode(&index.list)
-	if err != nil {
+		index.mutex.RLock()
+		err = index.app.encodeIndex(writer, index.list)
+		length = len(index.list)
 		index.mutex.RUnlock()
+		if err != nil {
+			return err
+		}
 
-		errorChannel <- err
-
-		return
-	}
-	length := len(index.list)
-	index.mutex.RUnlock()
-
-	// Close encoder prior to checking file size,
-	// to ensure the correct value is returned.
-	encoder.Close()
-
-	stats, err := file.Stat()
+		// Close writer prior to syncing the file,
+		// to ensure all compressed data is written.
+		return writer.Close()
+	})
 	if err != nil {
 		errorChannel <- err
 
 		return
 	}
 
-	if Verbose {
+	if index.app.verbose() {
 		fmt.Printf("%s | INDEX: Exported %d entries to %s (%s) in %s\n",
 			time.Now().Format(logDate),
 			length,
-			path,
-			humanReadableSize(int(stats.Size())),
+			index.app.stateLocation(index.app.IndexFile, stateIndexKey),
+			index.app.humanReadableSize(int(size)),
 			time.Since(startTime).Round(time.Microsecond),
 		)
 	}
 }
 
-func (index *fileIndex) Import(path string, errorChannel chan<- error) {
+// Reads an index file, or the index persisted in the state database if
+// path is empty.
+func (app *application) readIndexFile(path string, errorChannel chan<- error) []string {
 	startTime := time.Now()
 
-	file, err := os.OpenFile(path, os.O_RDONLY, 0600)
+	file, size, err := app.readState(path, stateIndexKey)
 	if err != nil {
 		errorChannel <- err
 
-		return
+		return nil
 	}
 	defer file.Close()
 
-	stats, err := file.Stat()
+	reader, closeReader, err := decompressIndex(file)
 	if err != nil {
 		errorChannel <- err
 
-		return
+		return nil
 	}
+	defer closeReader()
 
-	reader, err := zstd.NewReader(file)
+	list, err := decodeIndex(reader)
 	if err != nil {
 		errorChannel <- err
 
-		return
+		return nil
 	}
-	defer reader.Close()
 
-	dec := gob.NewDecoder(reader)
+	if app.verbose() {
+		fmt.Printf("%s | INDEX: Imported %d entries from %s (%s) in %s\n",
+			time.Now().Format(logDate),
+			len(list),
+			app.stateLocation(path, stateIndexKey),
+			app.humanReadableSize(int(size)),
+			time.Since(startTime).Round(time.Microsecond),
+		)
+	}
 
-	list := make([]string, 0)
+	return list
+}
 
-	err = dec.Decode(&list)
-	if err != nil {
-		errorChannel <- err
+// Loads and merges the specified index files. Duplicate entries are
+// collapsed, and entries outside of the specified paths are dropped.
+func (index *fileIndex) Import(files, paths []string, errorChannel chan<- error) {
+	var list []string
 
+	for _, file := range files {
+		list = append(list, index.app.readIndexFile(file, errorChannel)...)
+	}
+
+	if len(list) == 0 {
 		return
 	}
 
+	total := len(list)
+
+	slices.Sort(list)
+
+	list = slices.Compact(list)
+
+	duplicates := total - len(list)
+
+	list = slices.DeleteFunc(list, func(file string) bool {
+		return !slices.ContainsFunc(paths, func(path string) bool {
+			return file == path || strings.HasPrefix(file, strings.TrimSuffix(path, string(filepath.Separator))+string(filepath.Separator))
+		})
+	})
+
+	outside := total - duplicates - len(list)
+
 	index.mutex.Lock()
 	index.list = list
-	length := len(index.list)
+	index.positions = positionsOf(list)
 	index.mutex.Unlock()
 
 	index.generate()
 
-	if Verbose {
-		fmt.Printf("%s | INDEX: Imported %d entries from %s (%s) in %s\n",
+	if index.app.verbose() && len(files) > 1 {
+		fmt.Printf("%s | INDEX: Merged %d index files into %d entries (%d duplicates, %d outside specified paths)\n",
 			time.Now().Format(logDate),
-			length,
-			path,
-			humanReadableSize(int(stats.Size())),
-			time.Since(startTime).Round(time.Microsecond),
+			len(files),
+			len(list),
+			duplicates,
+			outside,
 		)
 	}
 }
 
-func rebuildIndex(paths []string, index *fileIndex, formats types.Types, errorChannel chan<- error) {
-	index.clear()
+// Scans all paths and replaces the index contents with the results.
+// Any rebuild already in progress is canceled, so that consecutive
+// requests do not result in multiple concurrent scans.
+//
+// Incremental rebuilds only re-read directories whose modification
+// time has changed since the previous scan.
+func (app *application) rebuildIndex(ctx context.Context, paths []string, index *fileIndex, formats types.Types, incremental bool, errorChannel chan<- error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	fileList(paths, index, formats, errorChannel)
+	var previous map[string]*directoryRecord
+
+	index.mutex.Lock()
+	if index.cancel != nil {
+		index.cancel()
+	}
+	index.cancel = cancel
+
+	if incremental {
+		previous = index.directories
+	}
+	index.mutex.Unlock()
+
+	cache := newDirectoryCache(previous)
+
+	startTime := time.Now()
+
+	list, err := app.scanPaths(ctx, paths, cache, formats, errorChannel)
+	if err != nil {
+		return
+	}
+
+	list = app.mergeListed(list, "", formats, errorChannel)
+
+	index.set(list, errorChannel)
+
+	app.sharedIndex.publish(list, errorChannel)
+
+	index.setScan(cache.current, startTime)
+
+	if app.verbose() && incremental {
+		fmt.Printf("%s | INDEX: Reused %d/%d unchanged directories\n",
+			time.Now().Format(logDate),
+			cache.reused,
+			len(cache.current))
+	}
 }
 
-func importIndex(paths []string, index *fileIndex, formats types.Types, errorChannel chan<- error) {
-	if IndexFile != "" {
-		index.Import(IndexFile, errorChannel)
+func (app *application) importIndex(ctx context.Context, paths []string, index *fileIndex, formats types.Types, errorChannel chan<- error) {
+	var files []string
+
+	// An empty path refers to the index in the state database
+	if app.persisted(app.IndexFile) {
+		files = append(files, app.IndexFile)
 	}
 
-	fileList(paths, index, formats, errorChannel)
+	files = append(files, app.IndexImport...)
+
+	if len(files) > 0 {
+		index.Import(files, paths, errorChannel)
+
+		if app.ImportSave && len(app.IndexImport) > 0 && !index.isEmpty() {
+			index.Export(errorChannel)
+		}
+	}
+
+	// Replicas sharing an index only scan if no other replica has yet
+	app.sharedIndex.load(index, errorChannel)
+
+	app.fileList(ctx, paths, "", index, randomSeed{}.source(), formats, errorChannel)
 }
 
-func serveIndexRebuild(paths []string, index *fileIndex, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+func (app *application) serveIndexRebuild(ctx context.Context, paths []string, index *fileIndex, formats types.Types, errorChannel chan<- error) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		if Verbose {
+		if app.verbose() {
 			fmt.Printf("%s | SERVE: Index rebuild requested by %s\n",
 				time.Now().Format(logDate),
-				realIP(r))
+				requester(r))
 		}
 
 		w.Header().Add("Content-Security-Policy", "default-src 'self';")
 
 		w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
 
-		rebuildIndex(paths, index, formats, errorChannel)
+		app.rebuildIndex(ctx, paths, index, formats, false, errorChannel)
 
 		_, err := w.Write([]byte("Ok\n"))
 		if err != nil {
@@ -267,8 +648,8 @@ func serveIndexRebuild(paths []string, index *fileIndex, formats types.Types, er
 	}
 }
 
-func registerIndexInterval(paths []string, index *fileIndex, formats types.Types, quit <-chan struct{}, errorChannel chan<- error) {
-	interval, err := time.ParseDuration(IndexInterval)
+func (app *application) registerIndexInterval(ctx context.Context, paths []string, index *fileIndex, formats types.Types, errorChannel chan<- error) {
+	interval, err := time.ParseDuration(app.IndexInterval)
 	if err != nil {
 		errorChannel <- err
 
@@ -277,7 +658,7 @@ func registerIndexInterval(paths []string, index *fileIndex, formats types.Types
 
 	ticker := time.NewTicker(interval)
 
-	if Verbose {
+	if app.verbose() {
 		next := time.Now().Add(interval).Truncate(time.Second)
 		fmt.Printf("%s | INDEX: Next scheduled rebuild will run at %s\n", time.Now().Format(logDate), next.Format(logDate))
 	}
@@ -288,16 +669,16 @@ func registerIndexInterval(paths []string, index *fileIndex, formats types.Types
 			case <-ticker.C:
 				next := time.Now().Add(interval).Truncate(time.Second)
 
-				if Verbose {
+				if app.verbose() {
 					fmt.Printf("%s | INDEX: Started scheduled index rebuild\n", time.Now().Format(logDate))
 				}
 
-				rebuildIndex(paths, index, formats, errorChannel)
+				app.rebuildIndex(ctx, paths, index, formats, true, errorChannel)
 
-				if Verbose {
+				if app.verbose() {
 					fmt.Printf("%s | INDEX: Next scheduled rebuild will run at %s\n", time.Now().Format(logDate), next.Format(logDate))
 				}
-			case <-quit:
+			case <-ctx.Done():
 				ticker.Stop()
 
 				return
@@ -5,15 +5,20 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/alecthomas/chroma/v2/styles"
 	"github.com/julienschmidt/httprouter"
 	"seedno.de/seednode/roulette/types"
 )
 
-func serveExtensions(formats types.Types, available bool, errorChannel chan<- error) httprouter.Handle {
+func (app *application) serveExtensions(formats types.Types, available bool, errorChannel chan<- error) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		startTime := time.Now()
 
@@ -34,17 +39,17 @@ func serveExtensions(formats types.Types, available bool, errorChannel chan<- er
 			errorChannel <- err
 		}
 
-		if Verbose {
+		if app.verbose() {
 			fmt.Printf("%s | SERVE: Registered extension list (%s) to %s in %s\n",
 				startTime.Format(logDate),
-				humanReadableSize(written),
-				realIP(r),
+				app.humanReadableSize(written),
+				requester(r),
 				time.Since(startTime).Round(time.Microsecond))
 		}
 	}
 }
 
-func serveMediaTypes(formats types.Types, available bool, errorChannel chan<- error) httprouter.Handle {
+func (app *application) serveMediaTypes(formats types.Types, available bool, errorChannel chan<- error) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		startTime := time.Now()
 
@@ -65,23 +70,163 @@ func serveMediaTypes(formats types.Types, available bool, errorChannel chan<- er
 			errorChannel <- err
 		}
 
-		if Verbose {
+		if app.verbose() {
 			fmt.Printf("%s | SERVE: Available media type list (%s) to %s in %s\n",
 				startTime.Format(logDate),
-				humanReadableSize(written),
-				realIP(r),
+				app.humanReadableSize(written),
+				requester(r),
 				time.Since(startTime).Round(time.Microsecond))
 		}
 	}
 }
 
-func registerAPIHandlers(mux *httprouter.Router, paths []string, index *fileIndex, formats types.Types, errorChannel chan<- error) {
-	if Index {
-		mux.POST(Prefix+AdminPrefix+"/index/rebuild", serveIndexRebuild(paths, index, formats, errorChannel))
+func (app *application) serveThemes(errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		w.Header().Add("Content-Security-Policy", "default-src 'self';")
+
+		w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+
+		written, err := w.Write([]byte(strings.Join(styles.Names(), "\n") + "\n"))
+		if err != nil {
+			errorChannel <- err
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Available code theme list (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond))
+		}
+	}
+}
+
+func (app *application) serveJson(w http.ResponseWriter, r *http.Request, description string, value any, errorChannel chan<- error) {
+	startTime := time.Now()
+
+	response, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		errorChannel <- err
+
+		app.serverError(w, r, nil)
+
+		return
+	}
+
+	response = append(response, []byte("\n")...)
+
+	w.Header().Add("Content-Security-Policy", "default-src 'self';")
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	written, err := w.Write(response)
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	if app.verbose() {
+		fmt.Printf("%s | SERVE: %s (%s) to %s in %s\n",
+			startTime.Format(logDate),
+			description,
+			app.humanReadableSize(written),
+			requester(r),
+			time.Since(startTime).Round(time.Microsecond))
+	}
+}
+
+func (app *application) registerAPIHandlers(ctx context.Context, mux *httprouter.Router, paths []string, vhosts map[string]string, index *fileIndex, stats *serveStats, notify *notifier, recent *errorBuffer, problems *problemReport, cache *artifactCache, formats types.Types, errorChannel chan<- error) {
+	registerGet(mux, app.Prefix+"/api/v1/file", app.serveMetadata(paths, vhosts, index, formats, errorChannel))
+	if app.AdminToken != "" && !app.ReadOnly {
+		mux.DELETE(app.Prefix+"/api/v1/file", app.audited("delete", app.serveDelete(paths, vhosts, index, notify, errorChannel), errorChannel))
+		mux.POST(app.Prefix+"/api/v1/move", app.audited("move", app.serveMove(paths, vhosts, index, formats, errorChannel), errorChannel))
+		mux.POST(app.Prefix+"/api/v1/files", app.audited("bulk", app.serveBulk(paths, vhosts, index, notify, formats, errorChannel), errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/select", app.serveBulkPage(paths, vhosts, index, stats, formats, errorChannel))
+	}
+
+	registerGet(mux, app.Prefix+"/api/v1/random", app.serveBatch(paths, vhosts, index, stats, formats, errorChannel))
+
+	if app.AdminToken != "" && app.ShareSecret != "" {
+		mux.POST(app.Prefix+app.AdminPrefix+"/token", app.audited("token", app.serveShareCreate(paths, errorChannel), errorChannel))
+	}
+
+	if app.Index {
+		if app.Duplicates {
+			registerGet(mux, app.Prefix+app.AdminPrefix+"/duplicates", app.serveDuplicates(index, errorChannel))
+		}
+
+		if app.Similar {
+			registerGet(mux, app.Prefix+app.AdminPrefix+"/similar", app.serveSimilar(index, errorChannel))
+		}
+
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/index/diff", app.serveIndexDiff(index, errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/index/html", app.serveIndexHtml(index, errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/index/html/:page", app.serveIndexHtml(index, errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/index/json", app.serveIndexJson(index, errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/index/json/:page", app.serveIndexJson(index, errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/index/stats", app.serveIndexStats(paths, index, errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/index/tree", app.serveIndexTree(index, errorChannel))
+	}
+
+	if app.Index && !app.ReadOnly {
+		mux.POST(app.Prefix+app.AdminPrefix+"/index/prune", app.audited("prune", app.serveIndexPrune(ctx, index, errorChannel), errorChannel))
+		mux.POST(app.Prefix+app.AdminPrefix+"/index/rebuild", app.audited("rebuild", app.serveIndexRebuild(ctx, paths, index, formats, errorChannel), errorChannel))
+	}
+
+	if app.Stats {
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/stats/most", app.serveMostServed(stats, errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/stats/most/:count", app.serveMostServed(stats, errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/metrics", app.serveMetricsText(errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/clients", app.serveClients(errorChannel))
+	}
+
+	if app.Stats && app.Index {
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/stats/never", app.serveNeverServed(stats, index, errorChannel))
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/stats/never/:count", app.serveNeverServed(stats, index, errorChannel))
+	}
+
+	if app.ErrorBuffer > 0 {
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/errors", app.serveErrors(recent, errorChannel))
+	}
+
+	registerGet(mux, app.Prefix+app.AdminPrefix+"/problems", app.serveProblems(problems, errorChannel))
+
+	registerGet(mux, app.Prefix+app.AdminPrefix+"/cache/stats", app.serveCacheStats(cache, errorChannel))
+
+	if !app.ReadOnly {
+		mux.POST(app.Prefix+app.AdminPrefix+"/cache/purge", app.audited("purge", app.serveCachePurge(cache, errorChannel), errorChannel))
+	}
+
+	if app.Index {
+		warm := &warmer{app: app}
+
+		registerGet(mux, app.Prefix+app.AdminPrefix+"/cache/warm", app.serveWarmProgress(warm, errorChannel))
+
+		if !app.ReadOnly {
+			mux.POST(app.Prefix+app.AdminPrefix+"/cache/warm", app.audited("warm", app.serveWarm(ctx, warm, index, cache, formats, errorChannel), errorChannel))
+		}
+	}
+
+	registerGet(mux, app.dashboardPath(), app.serveDashboard(paths, index, stats, recent, formats, errorChannel))
+
+	registerGet(mux, app.Prefix+app.AdminPrefix+"/config", app.serveSettings(errorChannel))
+
+	if app.AdminToken != "" && !app.ReadOnly {
+		mux.PATCH(app.Prefix+app.AdminPrefix+"/config", app.audited("config", app.serveSettingsUpdate(errorChannel), errorChannel))
 	}
 
-	mux.GET(Prefix+AdminPrefix+"/extensions/available", serveExtensions(formats, true, errorChannel))
-	mux.GET(Prefix+AdminPrefix+"/extensions/enabled", serveExtensions(formats, false, errorChannel))
-	mux.GET(Prefix+AdminPrefix+"/types/available", serveMediaTypes(formats, true, errorChannel))
-	mux.GET(Prefix+AdminPrefix+"/types/enabled", serveMediaTypes(formats, false, errorChannel))
+	registerGet(mux, app.Prefix+app.AdminPrefix+"/extensions/available", app.serveExtensions(formats, true, errorChannel))
+	registerGet(mux, app.Prefix+app.AdminPrefix+"/extensions/enabled", app.serveExtensions(formats, false, errorChannel))
+	registerGet(mux, app.Prefix+app.AdminPrefix+"/themes/available", app.serveThemes(errorChannel))
+	registerGet(mux, app.Prefix+app.AdminPrefix+"/types/available", app.serveMediaTypes(formats, true, errorChannel))
+	registerGet(mux, app.Prefix+app.AdminPrefix+"/types/enabled", app.serveMediaTypes(formats, false, errorChannel))
 }
@@ -0,0 +1,410 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types"
+)
+
+const (
+	// Length of time a fetched list is reused before it is fetched again
+	listLifetime time.Duration = 5 * time.Minute
+	listTimeout  time.Duration = 30 * time.Second
+
+	// Maximum size of a list, to avoid exhausting memory
+	listMaxSize int64 = 64 * 1024 * 1024
+
+	remotePrefix string = `/remote`
+)
+
+// A newline-separated list of files, fetched from a remote URL and
+// merged into the results of each scan.
+type remoteList struct {
+	app *application
+
+	mutex    sync.RWMutex
+	fetching sync.Mutex
+	client   *http.Client
+	url      string
+	paths    []string
+	files    []string
+	urls     []string
+	fetched  time.Time
+}
+
+func (app *application) newRemoteList(paths []string) *remoteList {
+	if app.ListUrl == "" {
+		return nil
+	}
+
+	return &remoteList{
+		app:    app,
+		client: &http.Client{Timeout: listTimeout},
+		url:    app.ListUrl,
+		paths:  paths,
+	}
+}
+
+// Returns whether the format can be displayed from a remote URL, without
+// roulette reading the file itself.
+func remoteSupported(format types.Type) bool {
+	if format == nil {
+		return false
+	}
+
+	switch format.Name() {
+	case "audio", "images", "video":
+		return true
+	default:
+		return false
+	}
+}
+
+// Fetches the list, keeping absolute paths to existing files of an enabled
+// type within the specified paths, as well as http and https URLs of
+// enabled audio, image, and video types. Blank lines and lines beginning
+// with # are ignored.
+func (remote *remoteList) fetch(formats types.Types) ([]string, []string, error) {
+	startTime := time.Now()
+
+	resp, err := remote.client.Get(remote.url)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%w: %s returned %s", ErrInvalidList, remote.url, resp.Status)
+	}
+
+	var files, urls []string
+
+	var skipped int
+
+	scanner := bufio.NewScanner(http.MaxBytesReader(nil, resp.Body, listMaxSize))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+			parsed, err := url.Parse(line)
+			if err != nil || !validUrl(line) || !remoteSupported(formats.FileType(parsed.Path)) {
+				skipped++
+
+				continue
+			}
+
+			urls = append(urls, parsed.String())
+
+			continue
+		}
+
+		if !filepath.IsAbs(line) || formats.FileType(line) == nil {
+			skipped++
+
+			continue
+		}
+
+		path, err := filepath.EvalSymlinks(filepath.Clean(line))
+		if err != nil {
+			skipped++
+
+			continue
+		}
+
+		// Listed files are subject to the same restrictions as scanned ones
+		if !remote.app.pathIsValid(path, remote.paths) {
+			skipped++
+
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			skipped++
+
+			continue
+		}
+
+		files = append(files, path)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slices.Sort(files)
+
+	files = slices.Compact(files)
+
+	slices.Sort(urls)
+
+	urls = slices.Compact(urls)
+
+	if remote.app.verbose() {
+		fmt.Printf("%s | LIST: Fetched %d files and %d URLs (skipped %d entries) from %s in %s\n",
+			time.Now().Format(logDate),
+			len(files),
+			len(urls),
+			skipped,
+			remote.url,
+			time.Since(startTime).Round(time.Microsecond),
+		)
+	}
+
+	return files, urls, nil
+}
+
+// Fetches the list again if it has expired. If fetching fails, the
+// previous list continues to be used.
+func (remote *remoteList) refresh(formats types.Types, errorChannel chan<- error) {
+	remote.mutex.RLock()
+	expired := time.Since(remote.fetched) > listLifetime
+	remote.mutex.RUnlock()
+
+	if expired {
+		remote.fetching.Lock()
+
+		// Another request may have fetched the list while waiting
+		remote.mutex.RLock()
+		expired = time.Since(remote.fetched) > listLifetime
+		remote.mutex.RUnlock()
+
+		if expired {
+			files, urls, err := remote.fetch(formats)
+
+			remote.mutex.Lock()
+			if err == nil {
+				remote.files = files
+				remote.urls = urls
+			}
+			// Failed fetches are not retried until the list expires again
+			remote.fetched = time.Now()
+			remote.mutex.Unlock()
+
+			if err != nil {
+				errorChannel <- err
+			}
+		}
+
+		remote.fetching.Unlock()
+	}
+}
+
+// Returns the listed files. If within is non-empty, only files inside
+// that path are returned.
+func (remote *remoteList) entries(within string, formats types.Types, errorChannel chan<- error) []string {
+	if remote == nil {
+		return nil
+	}
+
+	remote.refresh(formats, errorChannel)
+
+	remote.mutex.RLock()
+	files := remote.files
+	remote.mutex.RUnlock()
+
+	if within == "" {
+		return files
+	}
+
+	prefix := strings.TrimSuffix(within, "/") + "/"
+
+	return slices.DeleteFunc(slices.Clone(files), func(path string) bool {
+		return !strings.HasPrefix(path, prefix)
+	})
+}
+
+// Selects one of the listed URLs, with each URL as likely to be chosen as
+// each of the count local files being selected from. Returns an empty
+// string if a local file should be selected instead.
+func (remote *remoteList) pick(count int, rng *rand.Rand) string {
+	if remote == nil {
+		return ""
+	}
+
+	remote.mutex.RLock()
+	defer remote.mutex.RUnlock()
+
+	if len(remote.urls) == 0 {
+		return ""
+	}
+
+	i := rng.IntN(count + len(remote.urls))
+	if i < count {
+		return ""
+	}
+
+	return remote.urls[i-count]
+}
+
+// Returns whether the URL was included in the most recently fetched list.
+func (remote *remoteList) listed(u string) bool {
+	if remote == nil {
+		return false
+	}
+
+	remote.mutex.RLock()
+	defer remote.mutex.RUnlock()
+
+	_, found := slices.BinarySearch(remote.urls, u)
+
+	return found
+}
+
+func remoteUri(u string) string {
+	return remotePrefix + "?url=" + url.QueryEscape(u)
+}
+
+// Merges the listed files into a sorted list of scanned files.
+func (app *application) mergeListed(list []string, within string, formats types.Types, errorChannel chan<- error) []string {
+	listed := app.remoteFiles.entries(within, formats, errorChannel)
+	if len(listed) == 0 {
+		return list
+	}
+
+	list = append(list, listed...)
+
+	slices.Sort(list)
+
+	return slices.Compact(list)
+}
+
+// Displays a file from a listed URL. As roulette never reads the file
+// itself, only the browser's native audio, image, and video players are
+// used, and the file's origin is permitted by the Content-Security-Policy.
+func (app *application) serveRemote(formats types.Types, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		u := r.URL.Query().Get("url")
+
+		if !app.remoteFiles.listed(u) {
+			app.notFound(w, r, u)
+
+			return
+		}
+
+		parsed, err := url.Parse(u)
+		if err != nil {
+			app.notFound(w, r, u)
+
+			return
+		}
+
+		format := formats.FileType(parsed.Path)
+		if !remoteSupported(format) {
+			app.notFound(w, r, u)
+
+			return
+		}
+
+		nonce, err := newNonce()
+		if err != nil {
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		}
+
+		origin := parsed.Scheme + "://" + parsed.Host
+
+		fileName := html.EscapeString(filepath.Base(parsed.Path))
+
+		fileUri := html.EscapeString(parsed.String())
+
+		sortOrder := app.sortOrder(r)
+
+		queryParams := app.generateQueryParams(sortOrder, app.refreshParam(r), app.seedParams(r), playbackParams(r), app.collectionParam(r), app.mountParam(r))
+
+		rootUrl := app.Prefix + app.mountParam(r) + "/" + queryParams
+
+		refreshTimer, refreshInterval := app.refreshInterval(r, format)
+
+		var htmlBody strings.Builder
+		htmlBody.WriteString(`<!DOCTYPE html><html class="bg" lang="en"><head>`)
+		htmlBody.WriteString(getFavicon())
+		htmlBody.WriteString(fmt.Sprintf(`<style>%s</style>`, format.CSS()))
+		htmlBody.WriteString(fmt.Sprintf(`<title>%s</title></head><body>`, fileName))
+
+		if refreshInterval != "0ms" {
+			htmlBody.WriteString(refreshFunction(rootUrl, refreshTimer, nonce))
+		}
+
+		switch format.Name() {
+		case "audio":
+			htmlBody.WriteString(fmt.Sprintf(`<a href="%s"><audio controls autoplay loop preload="auto" src="%s" aria-label="Roulette selected: %s">Your browser does not support the audio tag.</audio></a>`,
+				rootUrl,
+				fileUri,
+				fileName))
+		case "images":
+			htmlBody.WriteString(fmt.Sprintf(`<a href="%s"><img src="%s" alt="Roulette selected: %s"></a>`,
+				rootUrl,
+				fileUri,
+				fileName))
+		case "video":
+			htmlBody.WriteString(fmt.Sprintf(`<a href="%s"><video controls autoplay loop preload="auto" src="%s" aria-label="Roulette selected: %s">Your browser does not support the video tag.</video></a>`,
+				rootUrl,
+				fileUri,
+				fileName))
+		}
+
+		htmlBody.WriteString(`</body></html>`)
+
+		formattedPage := htmlBody.String() + "\n"
+
+		w.Header().Set("Content-Type", "text/html")
+
+		w.Header().Set("Content-Security-Policy", fmt.Sprintf("default-src 'self'; script-src 'self' 'nonce-%s'; style-src 'self' 'unsafe-inline'; img-src 'self' data: %s; media-src 'self' %s; base-uri 'none'; form-action 'self'",
+			nonce,
+			origin,
+			origin,
+		))
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(formattedPage)))
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		written, err := io.WriteString(w, formattedPage)
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: %s (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				u,
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+	}
+}
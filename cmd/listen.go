@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Returns the network to listen on for the address. IP addresses are bound
+// to their own address family, so that IPv4 and IPv6 wildcard addresses
+// (e.g. 0.0.0.0 and ::) can be bound on the same port at once.
+func listenNetwork(address string) string {
+	ip := net.ParseIP(address)
+
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// Opens a listener for each bind address. If any fails,
+// those already opened are closed again.
+func listen(addresses []string, port int) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addresses))
+
+	for _, address := range addresses {
+		listener, err := net.Listen(listenNetwork(address), net.JoinHostPort(address, strconv.Itoa(port)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+
+		// Subsequent addresses share the port assigned to the first
+		assigned, ok := listener.Addr().(*net.TCPAddr)
+		if port == 0 && ok {
+			port = assigned.Port
+		}
+	}
+
+	return listeners, nil
+}
+
+// Returns the URL of the root path on the listener. Wildcard addresses are
+// replaced with the loopback address of the same family, so that the URL
+// can be opened directly.
+func (app *application) listenUrl(listener net.Listener) string {
+	address, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Sprintf("http://%s%s/", listener.Addr(), app.Prefix)
+	}
+
+	ip := address.IP
+
+	switch {
+	case !ip.IsUnspecified():
+	case ip.To4() != nil:
+		ip = net.IPv4(127, 0, 0, 1)
+	default:
+		ip = net.IPv6loopback
+	}
+
+	return fmt.Sprintf("http://%s%s/", net.JoinHostPort(ip.String(), strconv.Itoa(address.Port)), app.Prefix)
+}
+
+// Writes the URL of each listener to the file specified via --url-file,
+// one per line, so that the port can be discovered when using --port 0.
+func (app *application) writeUrlFile(listeners []net.Listener) error {
+	urls := make([]string, 0, len(listeners))
+
+	for _, listener := range listeners {
+		urls = append(urls, app.listenUrl(listener))
+	}
+
+	return writeAtomic(app.UrlFile, func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(urls, "\n")+"\n")
+
+		return err
+	})
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// Amount of each image read when searching for EXIF data, which
+	// JPEG images must store within their first 64KiB segment
+	locationReadLength int64 = 256 * 1024
+)
+
+// Returns the GPS coordinates an image was taken at, in decimal degrees.
+func imageLocation(path string) (float64, float64, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, locationReadLength))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, 0, false, err
+	}
+
+	exif := newExifReader(findExif(path, data))
+
+	valueType, _, field, found := exif.lookup(exif.first(), exifGpsTag)
+	if !found || valueType != exifLong {
+		return 0, 0, false, nil
+	}
+
+	gps := int(exif.order.Uint32(field))
+
+	latitude, found := exif.coordinate(gps, 0x0001, 0x0002)
+	if !found || latitude < -90 || latitude > 90 {
+		return 0, 0, false, nil
+	}
+
+	longitude, found := exif.coordinate(gps, 0x0003, 0x0004)
+	if !found || longitude < -180 || longitude > 180 {
+		return 0, 0, false, nil
+	}
+
+	return latitude, longitude, true, nil
+}
+
+// Returns a coordinate from the GPS directory, converted from degrees,
+// minutes, and seconds, and negated for the southern or western hemisphere.
+func (e *exifReader) coordinate(directory int, refTag, valueTag uint16) (float64, bool) {
+	_, _, ref, found := e.lookup(directory, refTag)
+	if !found {
+		return 0, false
+	}
+
+	valueType, count, field, found := e.lookup(directory, valueTag)
+	if !found || valueType != exifRational || count != 3 {
+		return 0, false
+	}
+
+	values, found := e.rationals(field, count)
+	if !found {
+		return 0, false
+	}
+
+	coordinate := values[0] + values[1]/60 + values[2]/3600
+
+	switch ref[0] {
+	case 'N', 'E':
+		return coordinate, true
+	case 'S', 'W':
+		return -coordinate, true
+	default:
+		return 0, false
+	}
+}
+
+// Renders a link to the location an image was taken at on OpenStreetMap,
+// or nothing if it is not geotagged.
+func locationLink(path string, errorChannel chan<- error) string {
+	latitude, longitude, found, err := imageLocation(path)
+	if err != nil {
+		errorChannel <- err
+
+		return ""
+	}
+
+	if !found {
+		return ""
+	}
+
+	return fmt.Sprintf(`<a href="https://www.openstreetmap.org/?mlat=%.6f&amp;mlon=%.6f#map=15/%.6f/%.6f" target="_blank" rel="noopener noreferrer" style="position:fixed;top:0.5rem;left:0.5rem;z-index:1;display:inline;height:auto;width:auto;" title="%.6f, %.6f">View on map</a>`,
+		latitude,
+		longitude,
+		latitude,
+		longitude,
+		latitude,
+		longitude,
+	)
+}
@@ -0,0 +1,210 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+)
+
+// Returns whether metadata is removed from the file when served.
+func (app *application) stripsMetadata(path string) bool {
+	if !app.StripMetadata {
+		return false
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".jfif", ".pjp", ".pjpeg", ".png", ".apng", ".webp":
+		return true
+	default:
+		return false
+	}
+}
+
+func stripMetadata(path string, data []byte) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".jfif", ".pjp", ".pjpeg":
+		return stripJpeg(data)
+	case ".png", ".apng":
+		return stripPng(data)
+	case ".webp":
+		return stripWebp(data)
+	default:
+		return data, nil
+	}
+}
+
+// Removes EXIF, XMP, IPTC, and comment segments from a JPEG image. The
+// EXIF orientation is preserved, as browsers use it to rotate the image.
+func stripJpeg(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, ErrInvalidImageData
+	}
+
+	var output bytes.Buffer
+
+	output.Write(data[:2])
+
+	orientation := uint16(0)
+	written := false
+
+	for i := 2; ; {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, ErrInvalidImageData
+		}
+
+		marker := data[i+1]
+
+		// Fill bytes may precede a marker
+		if marker == 0xFF {
+			i++
+
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, ErrInvalidImageData
+		}
+
+		segment := data[i : i+2+length]
+
+		i += 2 + length
+
+		switch marker {
+		case 0xE1:
+			if o := newExifReader(segment[4:]).orientation(); o != 0 {
+				orientation = o
+			}
+
+			continue
+		case 0xED, 0xFE:
+			continue
+		}
+
+		// Place the orientation ahead of the frame, after any JFIF header
+		if !written && marker != 0xE0 && orientation != 0 {
+			output.Write(orientationSegment(orientation))
+
+			written = true
+		}
+
+		output.Write(segment)
+
+		// The entropy-coded image data follows the start of scan
+		if marker == 0xDA {
+			output.Write(data[i:])
+
+			return output.Bytes(), nil
+		}
+	}
+}
+
+// Returns an APP1 segment containing only the specified EXIF orientation.
+func orientationSegment(orientation uint16) []byte {
+	segment := []byte{
+		0xFF, 0xE1, 0x00, 0x22,
+		'E', 'x', 'i', 'f', 0x00, 0x00,
+		// Big-endian TIFF header, with the first IFD immediately following
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08,
+		// One entry: tag 0x0112 (orientation), type SHORT, count 1
+		0x00, 0x01,
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		// No further IFDs
+		0x00, 0x00, 0x00, 0x00,
+	}
+
+	binary.BigEndian.PutUint16(segment[28:], orientation)
+
+	return segment
+}
+
+// Removes EXIF, textual, and timestamp chunks from a PNG image.
+func stripPng(data []byte) ([]byte, error) {
+	signature := []byte("\x89PNG\r\n\x1a\n")
+
+	if !bytes.HasPrefix(data, signature) {
+		return nil, ErrInvalidImageData
+	}
+
+	var output bytes.Buffer
+
+	output.Write(signature)
+
+	for i := len(signature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, ErrInvalidImageData
+		}
+
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length < 0 || i+12+length > len(data) {
+			return nil, ErrInvalidImageData
+		}
+
+		chunk := data[i : i+12+length]
+
+		i += 12 + length
+
+		switch string(chunk[4:8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+			continue
+		}
+
+		output.Write(chunk)
+	}
+
+	return output.Bytes(), nil
+}
+
+// Removes EXIF and XMP chunks from a WebP image.
+func stripWebp(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrInvalidImageData
+	}
+
+	var output bytes.Buffer
+
+	output.Write(data[:12])
+
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, ErrInvalidImageData
+		}
+
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+
+		// Chunks are padded to an even length
+		padded := length + length%2
+		if padded < 0 || i+8+padded > len(data) {
+			return nil, ErrInvalidImageData
+		}
+
+		chunk := data[i : i+8+padded]
+
+		i += 8 + padded
+
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			// Clear the flags indicating EXIF and XMP chunks are present
+			chunk = bytes.Clone(chunk)
+
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04
+			}
+		}
+
+		output.Write(chunk)
+	}
+
+	stripped := output.Bytes()
+
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+
+	return stripped, nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type metricLabels struct {
+	format string
+	path   string
+}
+
+// Counts of files served, labeled by format and by the path (as
+// specified on the command line) containing each file, for export
+// in the Prometheus text format.
+type serveMetrics struct {
+	mutex  sync.Mutex
+	served map[metricLabels]int
+}
+
+func (app *application) newServeMetrics() *serveMetrics {
+	if !app.API || !app.Stats {
+		return nil
+	}
+
+	return &serveMetrics{
+		served: make(map[metricLabels]int),
+	}
+}
+
+// Returns the specified path containing the file. If paths are nested,
+// the most specific one is used.
+func topLevelPath(file string, paths []string) string {
+	var longest string
+
+	for _, path := range paths {
+		within := file == path || strings.HasPrefix(file, strings.TrimSuffix(path, string(filepath.Separator))+string(filepath.Separator))
+
+		if within && len(path) > len(longest) {
+			longest = path
+		}
+	}
+
+	return longest
+}
+
+func (metrics *serveMetrics) record(format, file string, paths []string) {
+	if metrics == nil {
+		return
+	}
+
+	labels := metricLabels{
+		format: format,
+		path:   topLevelPath(file, paths),
+	}
+
+	metrics.mutex.Lock()
+	metrics.served[labels]++
+	metrics.mutex.Unlock()
+}
+
+// Escapes a label value per the Prometheus text exposition format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func (metrics *serveMetrics) text() string {
+	metrics.mutex.Lock()
+	labels := make([]metricLabels, 0, len(metrics.served))
+	counts := make(map[metricLabels]int, len(metrics.served))
+	for k, v := range metrics.served {
+		labels = append(labels, k)
+		counts[k] = v
+	}
+	metrics.mutex.Unlock()
+
+	slices.SortFunc(labels, func(a, b metricLabels) int {
+		if a.format != b.format {
+			return strings.Compare(a.format, b.format)
+		}
+
+		return strings.Compare(a.path, b.path)
+	})
+
+	var text strings.Builder
+
+	text.WriteString("# HELP roulette_files_served_total Number of files served, by format and path.\n")
+	text.WriteString("# TYPE roulette_files_served_total counter\n")
+
+	for _, l := range labels {
+		text.WriteString(fmt.Sprintf("roulette_files_served_total{format=\"%s\",path=\"%s\"} %d\n",
+			escapeLabel(l.format),
+			escapeLabel(l.path),
+			counts[l],
+		))
+	}
+
+	return text.String()
+}
+
+func (app *application) serveMetricsText(errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		response := app.metrics.text()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		written, err := w.Write([]byte(response))
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Metrics (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond))
+		}
+	}
+}
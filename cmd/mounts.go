@@ -0,0 +1,191 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"seedno.de/seednode/roulette/types"
+)
+
+var (
+	validMountPrefix = regexp.MustCompile(`^/[A-Za-z0-9._\-]+$`)
+	validVhost       = regexp.MustCompile(`^[a-z0-9.\-]+$`)
+
+	// First path segments already used by other handlers
+	reservedMountPrefixes = []string{
+		"/admin",
+		"/api",
+		"/art",
+		"/collections",
+		"/daily",
+		"/debug",
+		"/duplicates",
+		"/errors",
+		"/extensions",
+		"/favicon.ico",
+		"/favicons",
+		"/index",
+		"/problems",
+		"/robots.txt",
+		"/ruffle",
+		"/sibling",
+		"/similar",
+		"/source",
+		"/stats",
+		"/storyboard",
+		"/themes",
+		"/types",
+		"/version",
+		"/view",
+		"/zip",
+	}
+)
+
+// A path served under its own URL prefix, in addition to the root.
+type mount struct {
+	prefix string
+	path   string
+}
+
+func (app *application) parseMounts(mounts []string, formats types.Types) ([]mount, error) {
+	var parsed []mount
+
+	for _, m := range mounts {
+		prefix, path, found := strings.Cut(m, "=")
+		if !found || path == "" {
+			return nil, ErrInvalidMount
+		}
+
+		prefix = "/" + strings.Trim(prefix, "/")
+
+		if !validMountPrefix.MatchString(prefix) ||
+			slices.Contains(reservedMountPrefixes, prefix) ||
+			prefix == app.AdminPrefix ||
+			slices.ContainsFunc(parsed, func(m mount) bool { return m.prefix == prefix }) {
+			return nil, ErrInvalidMount
+		}
+
+		paths, err := app.validatePaths([]string{path}, formats)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(paths) == 0 {
+			continue
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | MOUNT: Serving %s at %s\n",
+				time.Now().Format(logDate),
+				paths[0],
+				prefix,
+			)
+		}
+
+		parsed = append(parsed, mount{prefix: prefix, path: paths[0]})
+	}
+
+	return parsed, nil
+}
+
+// Returns the prefix of the mount a selection was made from, so that
+// subsequent selections are made from the same mount.
+func (app *application) mountParam(r *http.Request) string {
+	mount := r.URL.Query().Get("mount")
+	if !validMountPrefix.MatchString(mount) || slices.Contains(reservedMountPrefixes, mount) || mount == app.AdminPrefix {
+		return ""
+	}
+
+	return mount
+}
+
+// Returns the specified paths, along with the path of each mount and virtual host.
+func mountedPaths(paths []string, mounts []mount, vhosts map[string]string) []string {
+	for _, m := range mounts {
+		if !slices.Contains(paths, m.path) {
+			paths = append(paths, m.path)
+		}
+	}
+
+	for _, path := range vhosts {
+		if !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+
+	slices.Sort(paths)
+
+	return paths
+}
+
+// Maps each hostname specified via --vhost to the path served for it.
+func (app *application) parseVhosts(vhosts []string, formats types.Types) (map[string]string, error) {
+	parsed := make(map[string]string)
+
+	for _, v := range vhosts {
+		host, path, found := strings.Cut(v, "=")
+		if !found || path == "" {
+			return nil, ErrInvalidVhost
+		}
+
+		host = strings.ToLower(host)
+
+		_, exists := parsed[host]
+		if exists || !validVhost.MatchString(host) {
+			return nil, ErrInvalidVhost
+		}
+
+		paths, err := app.validatePaths([]string{path}, formats)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(paths) == 0 {
+			continue
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | VHOST: Serving %s at %s\n",
+				time.Now().Format(logDate),
+				paths[0],
+				host,
+			)
+		}
+
+		parsed[host] = paths[0]
+	}
+
+	return parsed, nil
+}
+
+// Returns the path served for the host the request was made to,
+// or an empty string if no matching virtual host was specified.
+func (app *application) vhostPath(r *http.Request, vhosts map[string]string) string {
+	host := app.requestHost(r)
+
+	h, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = h
+	}
+
+	return vhosts[strings.ToLower(host)]
+}
+
+// Returns the paths files may be served from for the request.
+func (app *application) servedPaths(r *http.Request, paths []string, vhosts map[string]string) []string {
+	path := app.vhostPath(r, vhosts)
+	if path == "" {
+		return sharedPaths(r, paths)
+	}
+
+	return sharedPaths(r, []string{path})
+}
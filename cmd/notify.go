@@ -0,0 +1,189 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifyCooldown  time.Duration = 30 * time.Second
+	notifyThreshold int           = 10
+	notifyTimeout   time.Duration = 10 * time.Second
+)
+
+// Pushes errors and deletions to ntfy and/or Gotify, so they are not
+// lost in stdout. Notifications are limited to one per cooldown period,
+// with any suppressed in between summarized in the next one sent.
+type notifier struct {
+	app *application
+
+	mutex       sync.Mutex
+	client      *http.Client
+	last        time.Time
+	suppressed  int
+	permissions int
+	missing     int
+}
+
+func (app *application) newNotifier() *notifier {
+	if app.NtfyUrl == "" && app.GotifyUrl == "" {
+		return nil
+	}
+
+	return &notifier{
+		app:    app,
+		client: &http.Client{Timeout: notifyTimeout},
+	}
+}
+
+// Permission and missing file errors are expected on most filesystems, so
+// are only sent once they have repeatedly occurred. Files which fail
+// validation are never sent, matching what is logged without --debug.
+func (n *notifier) error(err error) {
+	if n == nil {
+		return
+	}
+
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		n.repeated(&n.permissions, "permission errors", err)
+	case errors.Is(err, os.ErrNotExist):
+		n.repeated(&n.missing, "missing file errors", err)
+	case errors.Is(err, ErrFailedValidation), errors.Is(err, ErrInvalidImageData):
+		return
+	default:
+		n.notify("Error", err.Error())
+	}
+}
+
+// Increments the counter, notifying and resetting it once the threshold is reached.
+func (n *notifier) repeated(counter *int, kind string, err error) {
+	n.mutex.Lock()
+	*counter++
+	count := *counter
+	if count >= notifyThreshold {
+		*counter = 0
+	}
+	n.mutex.Unlock()
+
+	if count < notifyThreshold {
+		return
+	}
+
+	n.notify("Repeated "+kind, fmt.Sprintf("%d %s, most recently: %v", count, kind, err))
+}
+
+func (n *notifier) removed(path string) {
+	if n == nil {
+		return
+	}
+
+	n.notify("File deleted", fmt.Sprintf("Removed %s after serving", path))
+}
+
+func (n *notifier) notify(title, message string) {
+	n.mutex.Lock()
+	if time.Since(n.last) < notifyCooldown {
+		n.suppressed++
+		n.mutex.Unlock()
+
+		return
+	}
+
+	if n.suppressed > 0 {
+		message = fmt.Sprintf("%s (%d earlier notifications suppressed)", message, n.suppressed)
+	}
+
+	n.last = time.Now()
+	n.suppressed = 0
+	n.mutex.Unlock()
+
+	title = "roulette: " + title
+
+	go func() {
+		if n.app.NtfyUrl != "" {
+			n.ntfy(title, message)
+		}
+
+		if n.app.GotifyUrl != "" {
+			n.gotify(title, message)
+		}
+	}()
+}
+
+func (n *notifier) ntfy(title, message string) {
+	req, err := http.NewRequest(http.MethodPost, n.app.NtfyUrl, strings.NewReader(message))
+	if err != nil {
+		n.failed("ntfy", err)
+
+		return
+	}
+
+	req.Header.Set("Title", title)
+
+	n.send("ntfy", req)
+}
+
+func (n *notifier) gotify(title, message string) {
+	body, err := json.Marshal(struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}{
+		Title:    title,
+		Message:  message,
+		Priority: 5,
+	})
+	if err != nil {
+		n.failed("Gotify", err)
+
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(n.app.GotifyUrl, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		n.failed("Gotify", err)
+
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", n.app.GotifyToken)
+
+	n.send("Gotify", req)
+}
+
+func (n *notifier) send(service string, req *http.Request) {
+	resp, err := n.client.Do(req)
+	if err != nil {
+		n.failed(service, err)
+
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		n.failed(service, fmt.Errorf("unexpected status %s", resp.Status))
+	}
+}
+
+// Failures are only logged, as sending them to the error channel would
+// trigger yet another notification.
+func (n *notifier) failed(service string, err error) {
+	fmt.Printf("%s | ERROR: Failed to send %s notification: %v\n",
+		time.Now().Format(logDate),
+		service,
+		err,
+	)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"os/exec"
+	"runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// Listens only on localhost, on any free port, unless a bind
+// address or port was specified explicitly.
+func applyOpen(cmd *cobra.Command, cfg *Config) {
+	if !cfg.Open {
+		return
+	}
+
+	if !cmd.Flags().Changed("bind") {
+		cfg.Bind = []string{"127.0.0.1"}
+	}
+
+	if !cmd.Flags().Changed("port") {
+		cfg.Port = 0
+	}
+}
+
+// Opens the URL in the system's default browser.
+func openBrowser(url string) error {
+	var browser *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		browser = exec.Command("open", url)
+	case "windows":
+		browser = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		browser = exec.Command("xdg-open", url)
+	}
+
+	err := browser.Start()
+	if err != nil {
+		return err
+	}
+
+	// Reaps the process once the browser (or launcher) exits
+	go browser.Wait()
+
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Whether audio and video start playing automatically, repeat once
+// finished, and start muted. Autoplay is only set if requested, as its
+// default is configured by the audio and video formats.
+type playback struct {
+	autoplay *bool
+	loop     bool
+	muted    bool
+}
+
+func defaultPlayback() playback {
+	return playback{loop: true}
+}
+
+// Returns the playback settings requested via the autoplay, loop, and
+// muted query parameters, falling back to the server's defaults.
+func playbackParams(r *http.Request) playback {
+	query := r.URL.Query()
+
+	p := defaultPlayback()
+
+	autoplay, err := strconv.ParseBool(query.Get("autoplay"))
+	if err == nil {
+		p.autoplay = &autoplay
+	}
+
+	for key, value := range map[string]*bool{"loop": &p.loop, "muted": &p.muted} {
+		parsed, err := strconv.ParseBool(query.Get(key))
+		if err == nil {
+			*value = parsed
+		}
+	}
+
+	return p
+}
+
+// Returns the query parameters for any settings which were requested or
+// differ from the server's defaults, so that they carry over to
+// subsequent pages.
+func (p playback) params() string {
+	defaults := defaultPlayback()
+
+	var params []string
+
+	if p.autoplay != nil {
+		params = append(params, "autoplay="+boolParam(*p.autoplay))
+	}
+
+	if p.loop != defaults.loop {
+		params = append(params, "loop="+boolParam(p.loop))
+	}
+
+	if p.muted != defaults.muted {
+		params = append(params, "muted="+boolParam(p.muted))
+	}
+
+	return strings.Join(params, "&")
+}
+
+func boolParam(value bool) string {
+	if value {
+		return "1"
+	}
+
+	return "0"
+}
@@ -0,0 +1,57 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	probeTimeout time.Duration = 10 * time.Second
+)
+
+// Location of ffprobe, or an empty string if it is not installed.
+var ffprobe = sync.OnceValue(func() string {
+	path, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return ""
+	}
+
+	return path
+})
+
+// Returns the duration of an audio or video file in seconds, as reported
+// by ffprobe. Returns zero if ffprobe is not installed.
+func mediaDuration(path string) (float64, error) {
+	if ffprobe() == "" {
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, ffprobe(),
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	).Output()
+	if err != nil {
+		return 0, err
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil {
+		// Streams without a known duration are reported as N/A
+		return 0, nil
+	}
+
+	return duration, nil
+}
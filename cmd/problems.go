@@ -0,0 +1,187 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// An error encountered while scanning or serving a specific file.
+type fileProblem struct {
+	path string
+	err  error
+}
+
+func (p *fileProblem) Error() string {
+	return fmt.Sprintf("%s: %v", p.path, p.err)
+}
+
+func (p *fileProblem) Unwrap() error {
+	return p.err
+}
+
+type problem struct {
+	Path      string `json:"path"`
+	Reason    string `json:"reason"`
+	Count     int    `json:"count"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+}
+
+// Tracks files which could not be read, decoded, or validated, keyed by path.
+type problemReport struct {
+	app *application
+
+	mutex    sync.RWMutex
+	problems map[string]*problem
+}
+
+func (app *application) newProblemReport() *problemReport {
+	return &problemReport{
+		app:      app,
+		problems: make(map[string]*problem),
+	}
+}
+
+// Records the file responsible for the error, if any. Errors which
+// are not tied to a specific file are ignored.
+func (report *problemReport) record(err error) {
+	var path, reason string
+
+	var fp *fileProblem
+	var pe *fs.PathError
+
+	switch {
+	case errors.As(err, &fp):
+		path, reason = fp.path, fp.err.Error()
+	case errors.As(err, &pe):
+		path, reason = pe.Path, pe.Err.Error()
+	default:
+		return
+	}
+
+	now := time.Now().Format(logDate)
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	p, found := report.problems[path]
+	if !found {
+		p = &problem{Path: path, FirstSeen: now}
+
+		report.problems[path] = p
+	}
+
+	p.Reason = reason
+	p.Count++
+	p.LastSeen = now
+}
+
+// Returns all recorded problems, ordered by path.
+func (report *problemReport) list() []problem {
+	report.mutex.RLock()
+	problems := make([]problem, 0, len(report.problems))
+	for _, p := range report.problems {
+		problems = append(problems, *p)
+	}
+	report.mutex.RUnlock()
+
+	slices.SortFunc(problems, func(a, b problem) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return problems
+}
+
+func (report *problemReport) Export(errorChannel chan<- error) {
+	if !report.app.persisted(report.app.ProblemsFile) {
+		return
+	}
+
+	problems := report.list()
+
+	contents, err := json.MarshalIndent(problems, "", "  ")
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	_, err = report.app.saveState(report.app.ProblemsFile, stateProblemsKey, func(w io.Writer) error {
+		_, err := w.Write(contents)
+
+		return err
+	})
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	if report.app.verbose() {
+		fmt.Printf("%s | PROBLEMS: Exported %d entries to %s\n",
+			time.Now().Format(logDate),
+			len(problems),
+			report.app.stateLocation(report.app.ProblemsFile, stateProblemsKey),
+		)
+	}
+}
+
+func (report *problemReport) Import(errorChannel chan<- error) {
+	if !report.app.persisted(report.app.ProblemsFile) {
+		return
+	}
+
+	contents, err := report.app.loadState(report.app.ProblemsFile, stateProblemsKey)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return
+	case err != nil:
+		errorChannel <- err
+
+		return
+	}
+
+	var problems []problem
+
+	err = json.Unmarshal(contents, &problems)
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	report.mutex.Lock()
+	for _, p := range problems {
+		report.problems[p.Path] = &p
+	}
+	report.mutex.Unlock()
+
+	if report.app.verbose() {
+		fmt.Printf("%s | PROBLEMS: Imported %d entries from %s\n",
+			time.Now().Format(logDate),
+			len(problems),
+			report.app.stateLocation(report.app.ProblemsFile, stateProblemsKey),
+		)
+	}
+}
+
+func (app *application) serveProblems(report *problemReport, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Problem files", report.list(), errorChannel)
+	}
+}
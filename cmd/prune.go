@@ -0,0 +1,144 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Removes all index entries which no longer exist on disk,
+// returning the number of entries removed.
+func (index *fileIndex) prune(ctx context.Context, errorChannel chan<- error) int {
+	startTime := time.Now()
+
+	index.mutex.RLock()
+	list := make([]string, len(index.list))
+	copy(list, index.list)
+	index.mutex.RUnlock()
+
+	missing := make(map[string]bool)
+
+	var mutex sync.Mutex
+
+	limit := make(chan struct{}, index.app.Concurrency)
+
+	var wg sync.WaitGroup
+
+	for _, path := range list {
+		if ctx.Err() != nil {
+			break
+		}
+
+		limit <- struct{}{}
+
+		wg.Add(1)
+
+		go func(path string) {
+			defer func() {
+				<-limit
+
+				wg.Done()
+			}()
+
+			exists, err := fileExists(path)
+			if err != nil {
+				errorChannel <- err
+
+				return
+			}
+
+			if !exists {
+				mutex.Lock()
+				missing[path] = true
+				mutex.Unlock()
+			}
+		}(path)
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil || len(missing) == 0 {
+		return 0
+	}
+
+	index.mutex.Lock()
+	kept := make([]string, 0, len(index.list))
+	for _, path := range index.list {
+		if !missing[path] {
+			kept = append(kept, path)
+		}
+	}
+	removed := len(index.list) - len(kept)
+	index.list = kept
+	index.positions = positionsOf(kept)
+	index.mutex.Unlock()
+
+	index.generate()
+
+	index.Export(errorChannel)
+
+	if index.app.verbose() {
+		fmt.Printf("%s | INDEX: Pruned %d/%d missing entries in %s\n",
+			time.Now().Format(logDate),
+			removed,
+			len(list),
+			time.Since(startTime).Round(time.Microsecond))
+	}
+
+	return removed
+}
+
+func (app *application) serveIndexPrune(ctx context.Context, index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Index prune requested by %s\n",
+				time.Now().Format(logDate),
+				requester(r))
+		}
+
+		w.Header().Add("Content-Security-Policy", "default-src 'self';")
+
+		w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+
+		removed := index.prune(ctx, errorChannel)
+
+		_, err := w.Write([]byte(fmt.Sprintf("Removed %d missing entries\n", removed)))
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+	}
+}
+
+func (app *application) registerPruneInterval(ctx context.Context, index *fileIndex, errorChannel chan<- error) {
+	interval, err := time.ParseDuration(app.PruneInterval)
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				index.prune(ctx, errorChannel)
+			case <-ctx.Done():
+				ticker.Stop()
+
+				return
+			}
+		}
+	}()
+}
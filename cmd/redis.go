@@ -0,0 +1,325 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisTimeout     time.Duration = 30 * time.Second
+	redisBatchLength int           = 1000
+)
+
+// A minimal client for the subset of the Redis protocol (RESP2) used to
+// share the index between replicas. Commands are sent over a single
+// connection, which is re-established whenever a command fails.
+type redisClient struct {
+	mutex    sync.Mutex
+	address  string
+	username string
+	password string
+	database int
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+// Parses a URL of the form redis://[[username]:password@]host[:port][/database].
+func newRedisClient(u string) (*redisClient, error) {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "redis" || parsed.Hostname() == "" {
+		return nil, ErrInvalidRedisUrl
+	}
+
+	client := &redisClient{
+		address: parsed.Host,
+	}
+
+	if parsed.Port() == "" {
+		client.address = net.JoinHostPort(parsed.Hostname(), "6379")
+	}
+
+	client.username = parsed.User.Username()
+
+	password, set := parsed.User.Password()
+	if set {
+		client.password = password
+	}
+
+	database := strings.TrimPrefix(parsed.Path, "/")
+	if database != "" {
+		client.database, err = strconv.Atoi(database)
+		if err != nil || client.database < 0 {
+			return nil, ErrInvalidRedisUrl
+		}
+	}
+
+	return client, nil
+}
+
+// Opens the connection, authenticating and selecting the database if
+// needed. Callers must hold the lock.
+func (client *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", client.address, redisTimeout)
+	if err != nil {
+		return err
+	}
+
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+
+	// Users other than the default one are authenticated via ACLs
+	switch {
+	case client.username != "":
+		_, err = client.send("AUTH", client.username, client.password)
+	case client.password != "":
+		_, err = client.send("AUTH", client.password)
+	}
+	if err != nil {
+		client.close()
+
+		return err
+	}
+
+	if client.database != 0 {
+		_, err = client.send("SELECT", strconv.Itoa(client.database))
+		if err != nil {
+			client.close()
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Callers must hold the lock.
+func (client *redisClient) close() {
+	if client.conn != nil {
+		client.conn.Close()
+	}
+
+	client.conn = nil
+	client.reader = nil
+}
+
+// Sends a command and returns its reply, which is one of nil, string,
+// int64, or []any. Error replies are returned as errors.
+func (client *redisClient) do(args ...string) (any, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.conn == nil {
+		err := client.connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := client.send(args...)
+
+	var replyError redisError
+	if err != nil && !errors.As(err, &replyError) {
+		// The connection is in an unknown state after an I/O error
+		client.close()
+	}
+
+	return reply, err
+}
+
+// Callers must hold the lock.
+func (client *redisClient) send(args ...string) (any, error) {
+	client.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var command strings.Builder
+
+	command.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+
+	for _, arg := range args {
+		command.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+	}
+
+	_, err := io.WriteString(client.conn, command.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return client.read()
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Callers must hold the lock.
+func (client *redisClient) read() (any, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, redisError("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if length < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, length+2)
+
+		_, err = io.ReadFull(client.reader, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return string(buf[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if length < 0 {
+			return nil, nil
+		}
+
+		values := make([]any, length)
+
+		for i := range values {
+			values[i], err = client.read()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	default:
+		return nil, redisError("unexpected reply " + strconv.Quote(line))
+	}
+}
+
+// Subscribes to the channel on a dedicated connection, calling receive with
+// each message published to it until the context is canceled or the
+// connection fails.
+func (client *redisClient) subscribe(ctx context.Context, channel string, receive func(string)) error {
+	subscriber := &redisClient{
+		address:  client.address,
+		username: client.username,
+		password: client.password,
+		database: client.database,
+	}
+
+	err := subscriber.connect()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		subscriber.conn.Close()
+	}()
+
+	_, err = subscriber.send("SUBSCRIBE", channel)
+	if err != nil {
+		subscriber.conn.Close()
+
+		return err
+	}
+
+	// Messages may arrive at any time, so no deadline is applied while waiting
+	subscriber.conn.SetDeadline(time.Time{})
+
+	for {
+		reply, err := subscriber.read()
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil:
+			subscriber.conn.Close()
+
+			return err
+		}
+
+		message, ok := reply.([]any)
+		if !ok || len(message) != 3 || message[0] != "message" {
+			continue
+		}
+
+		payload, ok := message[2].(string)
+		if ok {
+			receive(payload)
+		}
+	}
+}
+
+// Sends a command whose reply is expected to be a list of strings.
+func (client *redisClient) strings(args ...string) ([]string, error) {
+	reply, err := client.do(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok {
+		return nil, nil
+	}
+
+	result := make([]string, 0, len(values))
+
+	for _, value := range values {
+		s, ok := value.(string)
+		if ok {
+			result = append(result, s)
+		}
+	}
+
+	return result, nil
+}
+
+// Sends a command whose reply is expected to be an integer, or a
+// string containing one. Returns ErrRedisNil if the key does not exist.
+func (client *redisClient) int(args ...string) (int64, error) {
+	reply, err := client.do(args...)
+	if err != nil {
+		return 0, err
+	}
+
+	switch value := reply.(type) {
+	case int64:
+		return value, nil
+	case string:
+		return strconv.ParseInt(value, 10, 64)
+	default:
+		return 0, ErrRedisNil
+	}
+}
@@ -9,15 +9,55 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"seedno.de/seednode/roulette/types"
 )
 
-func refreshInterval(r *http.Request) (int64, string) {
-	interval := r.URL.Query().Get("refresh")
+// Returns the per-format default interval set via the --refresh-<format>
+// flags, or an empty string if none was provided for this format.
+func (app *application) refreshDefault(format types.Type) string {
+	if format == nil {
+		return ""
+	}
+
+	switch format.Name() {
+	case "audio":
+		return app.RefreshAudio
+	case "code":
+		return app.RefreshCode
+	case "flash":
+		return app.RefreshFlash
+	case "images":
+		return app.RefreshImages
+	case "text":
+		return app.RefreshText
+	case "video":
+		return app.RefreshVideos
+	default:
+		return ""
+	}
+}
+
+func (app *application) validRefreshDefaults() bool {
+	for _, interval := range []string{app.RefreshAudio, app.RefreshCode, app.RefreshFlash, app.RefreshImages, app.RefreshText, app.RefreshVideos} {
+		if interval == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(interval)
+		if err != nil || duration < 0 {
+			return false
+		}
+	}
+
+	return true
+}
 
+func parseRefresh(interval string) (int64, string) {
 	duration, err := time.ParseDuration(interval)
 
 	switch {
-	case err != nil || duration == 0 || !Refresh:
+	case err != nil || duration <= 0:
 		return 0, "0ms"
 	case duration < 500*time.Millisecond:
 		return 500, "500ms"
@@ -26,21 +66,83 @@ func refreshInterval(r *http.Request) (int64, string) {
 	}
 }
 
-func refreshFunction(rootUrl string, refreshTimer int64) string {
+// Returns the refresh interval explicitly requested via query parameter,
+// if any, so that it can be carried over to subsequent pages without
+// baking in the default for whichever format happened to be displayed.
+func (app *application) refreshParam(r *http.Request) string {
+	if !app.Refresh || !r.URL.Query().Has("refresh") {
+		return ""
+	}
+
+	_, interval := parseRefresh(r.URL.Query().Get("refresh"))
+
+	return interval
+}
+
+// Resolves the refresh interval for a page, preferring the query parameter,
+// then the default for the displayed format, then the runtime setting.
+func (app *application) refreshInterval(r *http.Request, format types.Type) (int64, string) {
+	switch {
+	case !app.Refresh:
+		return 0, "0ms"
+	case r.URL.Query().Has("refresh"):
+		return parseRefresh(r.URL.Query().Get("refresh"))
+	case app.refreshDefault(format) != "":
+		return parseRefresh(app.refreshDefault(format))
+	default:
+		return parseRefresh(app.settings().Refresh)
+	}
+}
+
+// Renders a countdown until the next refresh, along with a button (also
+// bound to Spacebar) to pause and resume it. The paused state is kept in
+// session storage, so that it carries over to the next page viewed.
+//
+// Audio and video stop looping while refreshing is enabled, and a refresh
+// which comes due during playback is held until the track has ended.
+func refreshFunction(rootUrl string, refreshTimer int64, nonce string) string {
 	var htmlBody strings.Builder
 
-	htmlBody.WriteString(fmt.Sprintf(`<script>window.addEventListener("load", function(){ clear = setInterval(function() {window.location.href = '%s';}, %d)});`,
-		rootUrl,
-		refreshTimer))
-	htmlBody.WriteString("document.body.onkeyup = function(e) { ")
-	htmlBody.WriteString(`if (e.key == " " || e.code == "Space" || e.keyCode == 32) { `)
-	htmlBody.WriteString(`if (typeof clear !== 'undefined') {`)
-	htmlBody.WriteString(`clearInterval(clear); delete clear;`)
-	htmlBody.WriteString(`} else {`)
-	htmlBody.WriteString(fmt.Sprintf("clear = setInterval(function(){window.location.href = '%s';}, %d);}}}",
-		rootUrl,
-		refreshTimer))
-	htmlBody.WriteString(`</script>`)
+	htmlBody.WriteString(`<div style="position:fixed;bottom:0.5rem;right:0.5rem;z-index:1;font-family:monospace;">`)
+	htmlBody.WriteString(`<span id="refresh-countdown" aria-live="off"></span> `)
+	htmlBody.WriteString(`<button id="refresh-toggle" aria-pressed="false">Pause</button></div>`)
+	htmlBody.WriteString(fmt.Sprintf(`<script nonce="%s">(function(){`, nonce))
+	htmlBody.WriteString(`var key = "roulette-refresh-paused";`)
+	htmlBody.WriteString(fmt.Sprintf(`var remaining = %d;`, refreshTimer))
+	htmlBody.WriteString(`var paused = sessionStorage.getItem(key) === "true";`)
+	htmlBody.WriteString(`var countdown = document.getElementById("refresh-countdown");`)
+	htmlBody.WriteString(`var toggle = document.getElementById("refresh-toggle");`)
+	htmlBody.WriteString(`var timer;`)
+	htmlBody.WriteString(`var media;`)
+	htmlBody.WriteString(`var waiting = false;`)
+	htmlBody.WriteString(`function render() {`)
+	htmlBody.WriteString(`countdown.textContent = paused ? "Paused" : waiting ? "Waiting for playback" : Math.ceil(remaining / 1000) + "s";`)
+	htmlBody.WriteString(`toggle.textContent = paused ? "Play" : "Pause";`)
+	htmlBody.WriteString(`toggle.setAttribute("aria-pressed", paused);}`)
+	htmlBody.WriteString(`function tick() {`)
+	htmlBody.WriteString(`remaining -= 100;`)
+	htmlBody.WriteString(`if (remaining <= 0) {`)
+	htmlBody.WriteString(`clearInterval(timer);`)
+	htmlBody.WriteString(`if (media && !media.ended && !media.error) { waiting = true; render(); return; }`)
+	htmlBody.WriteString(`advance(); return;}`)
+	htmlBody.WriteString(`render();}`)
+	htmlBody.WriteString(fmt.Sprintf(`function advance() { window.location.href = '%s'; }`, rootUrl))
+	htmlBody.WriteString(`function setPaused(p) {`)
+	htmlBody.WriteString(`paused = p;`)
+	htmlBody.WriteString(`sessionStorage.setItem(key, p);`)
+	htmlBody.WriteString(`clearInterval(timer);`)
+	htmlBody.WriteString(`if (!paused) { timer = setInterval(tick, 100); }`)
+	htmlBody.WriteString(`render();}`)
+	htmlBody.WriteString(`toggle.addEventListener("click", function() { setPaused(!paused); });`)
+	htmlBody.WriteString(`document.addEventListener("keyup", function(e) {`)
+	htmlBody.WriteString(`if (e.target !== toggle && (e.key == " " || e.code == "Space" || e.keyCode == 32)) { setPaused(!paused); }});`)
+	htmlBody.WriteString(`window.addEventListener("load", function() {`)
+	htmlBody.WriteString(`media = document.querySelector("audio, video");`)
+	htmlBody.WriteString(`if (media) {`)
+	htmlBody.WriteString(`media.loop = false;`)
+	htmlBody.WriteString(`media.addEventListener("ended", function() { if (waiting && !paused) { advance(); }});}`)
+	htmlBody.WriteString(`setPaused(paused);});`)
+	htmlBody.WriteString(`})();</script>`)
 
 	return htmlBody.String()
 }
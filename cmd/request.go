@@ -0,0 +1,62 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const requestIdHeader string = "X-Request-Id"
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,128}$`)
+
+type requestIdKey struct{}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Assigns an ID to each request, which is returned in the X-Request-Id
+// header and included in all log lines for the request. IDs provided by
+// trusted proxies are reused, so requests can be followed across a chain.
+func (app *application) withRequestIds(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+
+		if !app.fromTrustedProxy(r) || !validRequestId.MatchString(id) {
+			id = newRequestId()
+		}
+
+		w.Header().Set(requestIdHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+func requestId(r *http.Request) string {
+	id, ok := r.Context().Value(requestIdKey{}).(string)
+	if !ok {
+		return "-"
+	}
+
+	return id
+}
+
+// Identifies the client and request, for use in log lines.
+func requester(r *http.Request) string {
+	return fmt.Sprintf("%s [%s]", realIP(r), requestId(r))
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Served at /robots.txt unless --robots-file is set, as randomly
+// served personal media generally should not end up in search results.
+const defaultRobots string = "User-agent: *\nDisallow: /\n"
+
+func (app *application) loadRobots() ([]byte, error) {
+	if app.RobotsFile == "" {
+		return []byte(defaultRobots), nil
+	}
+
+	return os.ReadFile(app.RobotsFile)
+}
+
+func (app *application) serveRobots(robots []byte, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(robots)))
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		written, err := w.Write(robots)
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Robots file (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+	}
+}
+
+// Asks search engines not to index or follow links from any response,
+// including media files, which cannot carry a robots meta tag.
+func (app *application) withNoIndex(next http.Handler) http.Handler {
+	if !app.NoIndex {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -7,13 +7,13 @@ package cmd
 import (
 	"fmt"
 	"log"
-	"math"
-	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"seedno.de/seednode/roulette/types"
 )
 
 const (
@@ -22,41 +22,6 @@ const (
 )
 
 var (
-	AdminPrefix   string
-	All           bool
-	AllowEmpty    bool
-	API           bool
-	Audio         bool
-	Bind          string
-	Code          bool
-	CodeTheme     string
-	Concurrency   int
-	Debug         bool
-	ErrorExit     bool
-	Fallback      bool
-	Flash         bool
-	Fun           bool
-	Ignore        string
-	Images        bool
-	Index         bool
-	IndexFile     string
-	IndexInterval string
-	MaxFiles      int
-	MinFiles      int
-	NoButtons     bool
-	Override      string
-	Port          int
-	Prefix        string
-	Profile       bool
-	Recursive     bool
-	Refresh       bool
-	Russian       bool
-	Sorting       bool
-	Text          bool
-	Verbose       bool
-	Version       bool
-	Videos        bool
-
 	RequiredArgs = []string{
 		"all",
 		"audio",
@@ -65,79 +30,56 @@ var (
 		"flash",
 		"images",
 		"text",
+		"types",
 		"video",
 	}
 )
 
 func NewRootCommand() *cobra.Command {
+	var (
+		cfg     Config
+		daemon  bool
+		version bool
+	)
+
 	rootCmd := &cobra.Command{
 		Use:   "roulette <path> [path]...",
 		Short: "Serves random media from the specified directories.",
-		Args:  cobra.MinimumNArgs(1),
+		Args:  cobra.ArbitraryArgs,
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
 			initializeConfig(cmd)
 		},
-		PreRunE: func(cmd *cobra.Command, args []string) error {
-			switch {
-			case MaxFiles < 0 || MinFiles < 0 || MaxFiles > math.MaxInt32 || MinFiles > math.MaxInt32:
-				return ErrInvalidFileCountValue
-			case MinFiles > MaxFiles:
-				return ErrInvalidFileCountRange
-			case Port < 1 || Port > 65535:
-				return ErrInvalidPort
-			case Concurrency < 1:
-				return ErrInvalidConcurrency
-			case Ignore != "" && !regexp.MustCompile(AllowedCharacters).MatchString(Ignore):
-				return ErrInvalidIgnoreFile
-			case Override != "" && !regexp.MustCompile(AllowedCharacters).MatchString(Override):
-				return ErrInvalidOverrideFile
-			case AdminPrefix != "" && !regexp.MustCompile(AllowedCharacters).MatchString(AdminPrefix):
-				return ErrInvalidAdminPrefix
-			case AdminPrefix != "":
-				AdminPrefix = "/" + AdminPrefix
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg.Paths = args
+
+			applyOpen(cmd, &cfg)
+
+			server, err := New(cfg)
+			if err != nil {
+				return err
 			}
 
-			return nil
-		},
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return ServePage(args)
+			if daemon {
+				parent, err := daemonize()
+				if err != nil || parent {
+					return err
+				}
+			}
+
+			return run(server)
 		},
 	}
 
-	rootCmd.Flags().StringVar(&AdminPrefix, "admin-prefix", "", "string to prepend to administrative paths")
-	rootCmd.Flags().BoolVarP(&All, "all", "a", false, "enable all supported file types")
-	rootCmd.Flags().BoolVar(&AllowEmpty, "allow-empty", false, "allow specifying paths containing no supported files")
-	rootCmd.Flags().BoolVar(&API, "api", false, "expose REST API")
-	rootCmd.Flags().BoolVar(&Audio, "audio", false, "enable support for audio files")
-	rootCmd.Flags().StringVarP(&Bind, "bind", "b", "0.0.0.0", "address to bind to")
-	rootCmd.Flags().BoolVar(&Code, "code", false, "enable support for source code files")
-	rootCmd.Flags().StringVar(&CodeTheme, "code-theme", "solarized-dark256", "theme for source code syntax highlighting")
-	rootCmd.Flags().IntVar(&Concurrency, "concurrency", 1024, "maximum concurrency for scan threads")
-	rootCmd.Flags().BoolVarP(&Debug, "debug", "d", false, "log file permission errors instead of simply skipping the files")
-	rootCmd.Flags().BoolVar(&ErrorExit, "error-exit", false, "shut down webserver on error, instead of just printing error")
-	rootCmd.Flags().BoolVar(&Fallback, "fallback", false, "serve files as application/octet-stream if no matching format is registered")
-	rootCmd.Flags().BoolVar(&Flash, "flash", false, "enable support for shockwave flash files (via ruffle.rs)")
-	rootCmd.Flags().BoolVar(&Fun, "fun", false, "add a bit of excitement to your day")
-	rootCmd.Flags().StringVar(&Ignore, "ignore", "", "filename used to indicate directory should be skipped")
-	rootCmd.Flags().BoolVar(&Images, "images", false, "enable support for image files")
-	rootCmd.Flags().BoolVarP(&Index, "index", "i", false, "generate index of supported file paths at startup")
-	rootCmd.Flags().StringVar(&IndexFile, "index-file", "", "path to optional persistent index file")
-	rootCmd.Flags().StringVar(&IndexInterval, "index-interval", "", "interval at which to regenerate index (e.g. \"5m\" or \"1h\")")
-	rootCmd.Flags().IntVar(&MaxFiles, "max-files", math.MaxInt32, "skip directories with file counts above this value")
-	rootCmd.Flags().IntVar(&MinFiles, "min-files", 0, "skip directories with file counts below this value")
-	rootCmd.Flags().BoolVar(&NoButtons, "no-buttons", false, "disable first/prev/next/last buttons")
-	rootCmd.Flags().StringVar(&Override, "override", "", "filename used to indicate directory should be scanned no matter what")
-	rootCmd.Flags().IntVarP(&Port, "port", "p", 8080, "port to listen on")
-	rootCmd.Flags().StringVar(&Prefix, "prefix", "/", "root path for http handlers (for reverse proxying)")
-	rootCmd.Flags().BoolVar(&Profile, "profile", false, "register net/http/pprof handlers")
-	rootCmd.Flags().BoolVarP(&Recursive, "recursive", "r", false, "recurse into subdirectories")
-	rootCmd.Flags().BoolVar(&Refresh, "refresh", false, "enable automatic page refresh via query parameter")
-	rootCmd.Flags().BoolVar(&Russian, "russian", false, "remove selected images after serving")
-	rootCmd.Flags().BoolVarP(&Sorting, "sort", "s", false, "enable sorting")
-	rootCmd.Flags().BoolVar(&Text, "text", false, "enable support for text files")
-	rootCmd.Flags().BoolVarP(&Verbose, "verbose", "v", false, "log accessed files and other information to stdout")
-	rootCmd.Flags().BoolVarP(&Version, "version", "V", false, "display version and exit")
-	rootCmd.Flags().BoolVar(&Videos, "video", false, "enable support for video files")
+	registerFlags(rootCmd.Flags(), &cfg)
+
+	rootCmd.Flags().BoolVar(&daemon, "daemon", false, "detach from the terminal and run in the background (not supported on Windows, use \"roulette service\" instead)")
+	rootCmd.Flags().BoolVarP(&version, "version", "V", false, "display version and exit")
+
+	rootCmd.AddCommand(newServiceCommand())
+
+	rootCmd.AddCommand(newTokenCommand())
+
+	rootCmd.AddCommand(newWarmCommand())
 
 	rootCmd.CompletionOptions.HiddenDefaultCmd = true
 
@@ -160,6 +102,18 @@ func NewRootCommand() *cobra.Command {
 	return rootCmd
 }
 
+func validTypes(names []string) bool {
+	supported := types.SupportedFormats.Names()
+
+	for _, name := range names {
+		if !slices.Contains(supported, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func initializeConfig(cmd *cobra.Command) {
 	v := viper.New()
 
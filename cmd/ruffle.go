@@ -0,0 +1,44 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"io/fs"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types/flash"
+)
+
+func (app *application) serveRuffle(errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		fname := strings.TrimPrefix(p.ByName("ruffle"), "/")
+
+		data, err := fs.ReadFile(flash.Ruffle(), fname)
+		if err != nil {
+			app.notFound(w, r, fname)
+
+			return
+		}
+
+		contentType := mime.TypeByExtension(filepath.Ext(fname))
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+
+		_, err = w.Write(data)
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	samplingPerDirectory string = "per-dir"
+	samplingUniform      string = "uniform"
+	samplingWeighted     string = "weighted"
+)
+
+func validSampling(sampling string) bool {
+	switch sampling {
+	case "", samplingPerDirectory, samplingUniform, samplingWeighted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (app *application) parsePathWeights(weights []string) (map[string]float64, error) {
+	parsed := make(map[string]float64, len(weights))
+
+	for _, w := range weights {
+		// Split on the last separator, as paths may themselves contain one
+		separator := strings.LastIndex(w, "=")
+		if separator < 1 {
+			return nil, ErrInvalidPathWeight
+		}
+
+		weight, err := strconv.ParseFloat(w[separator+1:], 64)
+		if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+			return nil, ErrInvalidPathWeight
+		}
+
+		path, err := normalizePath(w[:separator])
+		if err != nil {
+			return nil, err
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | WEIGHT: Sampling %s with weight %g\n",
+				time.Now().Format(logDate),
+				path,
+				weight,
+			)
+		}
+
+		parsed[path] = weight
+	}
+
+	return parsed, nil
+}
+
+func (app *application) pathWeight(path string) float64 {
+	weight, found := app.pathWeights[path]
+	if !found {
+		return 1
+	}
+
+	return weight
+}
+
+// Returns the position of a path chosen at random from the list,
+// in proportion to the weight given to each via --path-weight.
+func (app *application) pickWeightedPath(paths []string, rng *rand.Rand) int {
+	var total float64
+
+	for _, path := range paths {
+		total += app.pathWeight(path)
+	}
+
+	target := rng.Float64() * total
+
+	for i, path := range paths {
+		target -= app.pathWeight(path)
+
+		if target < 0 {
+			return i
+		}
+	}
+
+	return len(paths) - 1
+}
+
+// Returns the bounds of the range of directories in the index which are
+// inside the specified path, or the entire index if within is empty.
+// Callers must hold the read lock.
+func (index *fileIndex) directoryRange(within string) (int, int) {
+	if within == "" {
+		return 0, len(index.pathIndex)
+	}
+
+	prefix := strings.TrimSuffix(within, string(filepath.Separator)) + string(filepath.Separator)
+
+	// Directories sharing a prefix are contiguous, as the index is sorted
+	low := sort.SearchStrings(index.pathIndex, prefix)
+	high := low + sort.Search(len(index.pathIndex)-low, func(i int) bool {
+		return !strings.HasPrefix(index.pathIndex[low+i], prefix)
+	})
+
+	return low, high
+}
+
+// Returns a copy of every file in the index inside the specified path,
+// or the entire index if within is empty.
+func (index *fileIndex) filesWithin(within string) []string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	low, high := index.directoryRange(within)
+
+	var list []string
+
+	for _, dir := range index.pathIndex[low:high] {
+		list = append(list, index.pathMap[dir].snapshot()...)
+	}
+
+	return list
+}
+
+// Returns a random directory from the index, weighted by the number of
+// files it contains, so that picking a random file from the result is
+// equivalent to picking one uniformly across all files.
+func (index *fileIndex) getDirectoryByFiles(rng *rand.Rand, within string) string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	low, high := index.directoryRange(within)
+
+	var total int
+
+	for _, dir := range index.pathIndex[low:high] {
+		total += index.pathMap[dir].length()
+	}
+
+	if total == 0 {
+		return ""
+	}
+
+	target := rng.IntN(total)
+
+	for _, dir := range index.pathIndex[low:high] {
+		target -= index.pathMap[dir].length()
+
+		if target < 0 {
+			return dir
+		}
+	}
+
+	return ""
+}
+
+// Selects a directory from the index according to the --sampling mode.
+// If no mode was specified, the index is sampled per directory.
+func (index *fileIndex) sampleDirectory(rng *rand.Rand, paths []string, within string) string {
+	switch {
+	case index.app.Sampling == samplingUniform:
+		return index.getDirectoryByFiles(rng, within)
+	case index.app.Sampling == samplingWeighted && within == "":
+		roots := slices.Clone(paths)
+
+		// Paths are chosen according to their weights, regardless of
+		// size, skipping any without files in the index
+		for len(roots) > 0 {
+			i := index.app.pickWeightedPath(roots, rng)
+
+			dir := index.getDirectoryByFiles(rng, roots[i])
+			if dir != "" {
+				return dir
+			}
+
+			roots = slices.Delete(roots, i, i+1)
+		}
+
+		return ""
+	case index.app.Sampling == samplingWeighted:
+		// Requests restricted to a single path have nothing to weight
+		return index.getDirectoryByFiles(rng, within)
+	default:
+		return index.getDirectory(rng, within)
+	}
+}
+
+// Narrows a list of files according to the specified sampling mode,
+// mirroring the selection made by sampleDirectory for the index. If no
+// mode was specified, or --prefer-unseen is set, all files are kept.
+func (app *application) sampleList(list []string, paths []string, sampling string, rng *rand.Rand) []string {
+	if len(list) == 0 || app.PreferUnseen {
+		return list
+	}
+
+	switch sampling {
+	case "", samplingUniform:
+		return list
+	case samplingWeighted:
+		roots := slices.Clone(paths)
+
+		for len(roots) > 0 {
+			i := app.pickWeightedPath(roots, rng)
+
+			prefix := strings.TrimSuffix(roots[i], string(filepath.Separator)) + string(filepath.Separator)
+
+			files := slices.DeleteFunc(slices.Clone(list), func(file string) bool {
+				return !strings.HasPrefix(file, prefix)
+			})
+			if len(files) > 0 {
+				return files
+			}
+
+			roots = slices.Delete(roots, i, i+1)
+		}
+
+		return nil
+	case samplingPerDirectory:
+		directories := make(map[string][]string)
+
+		for _, file := range list {
+			dir, _ := filepath.Split(file)
+
+			directories[dir] = append(directories[dir], file)
+		}
+
+		// Sorted so that seeded selections are reproducible
+		keys := slices.Sorted(maps.Keys(directories))
+
+		return directories[keys[rng.IntN(len(keys))]]
+	default:
+		return list
+	}
+}
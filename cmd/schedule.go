@@ -0,0 +1,231 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"seedno.de/seednode/roulette/types"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// A time window on a set of days of the week, with start and end given in
+// minutes since midnight. Windows with an end earlier than their start
+// run past midnight, into the following day.
+type window struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+func (w window) active(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	day := int(now.Weekday())
+	previous := (day + 6) % 7
+
+	switch {
+	case w.start == w.end:
+		return w.days[day]
+	case w.start < w.end:
+		return w.days[day] && minute >= w.start && minute < w.end
+	default:
+		return (w.days[day] && minute >= w.start) || (w.days[previous] && minute < w.end)
+	}
+}
+
+func parseWeekday(day string) (int, bool) {
+	position := slices.Index(weekdays, strings.ToLower(day))
+
+	return position, position >= 0
+}
+
+// Parses a comma-separated list of days and day ranges (e.g. "Mon-Fri,Sun").
+func parseDays(value string) ([7]bool, bool) {
+	var days [7]bool
+
+	for _, field := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(field, "-")
+		if !isRange {
+			last = first
+		}
+
+		from, ok := parseWeekday(first)
+		if !ok {
+			return days, false
+		}
+
+		to, ok := parseWeekday(last)
+		if !ok {
+			return days, false
+		}
+
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+
+			if day == to {
+				break
+			}
+		}
+	}
+
+	return days, true
+}
+
+func parseClock(value string) (int, bool) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, false
+	}
+
+	return clock.Hour()*60 + clock.Minute(), true
+}
+
+// Parses a window of the form "[days ]HH:MM-HH:MM", where days is
+// optional and defaults to every day of the week.
+func parseWindow(value string) (window, bool) {
+	w := window{days: [7]bool{true, true, true, true, true, true, true}}
+
+	fields := strings.Fields(value)
+
+	switch len(fields) {
+	case 1:
+	case 2:
+		days, ok := parseDays(fields[0])
+		if !ok {
+			return w, false
+		}
+
+		w.days = days
+	default:
+		return w, false
+	}
+
+	start, end, found := strings.Cut(fields[len(fields)-1], "-")
+	if !found {
+		return w, false
+	}
+
+	var ok bool
+
+	w.start, ok = parseClock(start)
+	if !ok {
+		return w, false
+	}
+
+	w.end, ok = parseClock(end)
+	if !ok {
+		return w, false
+	}
+
+	return w, true
+}
+
+func (app *application) parseSchedules(values []string) (map[string][]window, error) {
+	parsed := make(map[string][]window)
+
+	supported := types.SupportedFormats.Names()
+
+	for _, value := range values {
+		target, spec, found := strings.Cut(value, "=")
+		if !found || target == "" {
+			return nil, ErrInvalidSchedule
+		}
+
+		w, ok := parseWindow(spec)
+		if !ok {
+			return nil, ErrInvalidSchedule
+		}
+
+		if !slices.Contains(supported, target) {
+			path, err := normalizePath(target)
+			if err != nil {
+				return nil, err
+			}
+
+			target = path
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SCHEDULE: Serving %s only during %s\n",
+				time.Now().Format(logDate),
+				target,
+				spec,
+			)
+		}
+
+		parsed[target] = append(parsed[target], w)
+	}
+
+	return parsed, nil
+}
+
+// Returns whether a file is eligible for selection at the specified time.
+// Each path or format the file falls under must have at least one active
+// window; files not covered by any schedule are always eligible.
+func (app *application) eligible(path string, formats types.Types, now time.Time) bool {
+	format := formats.FileType(path)
+
+	for target, windows := range app.schedules {
+		switch {
+		case format != nil && format.Name() == target:
+		case strings.HasPrefix(path, strings.TrimSuffix(target, string(filepath.Separator))+string(filepath.Separator)):
+		default:
+			continue
+		}
+
+		if !slices.ContainsFunc(windows, func(w window) bool { return w.active(now) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the files from the list which are currently eligible for selection.
+func (app *application) scheduled(list []string, formats types.Types) []string {
+	if len(app.schedules) == 0 {
+		return list
+	}
+
+	now := time.Now()
+
+	return slices.DeleteFunc(slices.Clone(list), func(path string) bool {
+		return !app.eligible(path, formats, now)
+	})
+}
+
+// Selects files from a directory in the index. If any schedules were
+// specified, only directories containing files inside their scheduled
+// windows are sampled from.
+func (index *fileIndex) sampleScheduled(rng *rand.Rand, paths []string, within string, formats types.Types) []string {
+	// Serve counts are weighed across every file, rather than only those
+	// in a single sampled directory, so that --prefer-unseen also evens
+	// out coverage between directories
+	if index.app.PreferUnseen {
+		return index.app.scheduled(index.filesWithin(within), formats)
+	}
+
+	if len(index.app.schedules) == 0 {
+		return index.directory(index.sampleDirectory(rng, paths, within))
+	}
+
+	// The index is sampled per directory unless another mode was specified
+	sampling := index.app.Sampling
+	if sampling == "" {
+		sampling = samplingPerDirectory
+	}
+
+	if within != "" {
+		paths = []string{within}
+	}
+
+	return index.app.sampleList(index.app.scheduled(index.filesWithin(within), formats), paths, sampling, rng)
+}
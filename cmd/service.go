@@ -0,0 +1,58 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+const serviceName string = "roulette"
+
+func newServiceCommand() *cobra.Command {
+	serviceCmd := &cobra.Command{
+		Use:   "service",
+		Short: "Manages roulette as a Windows service.",
+	}
+
+	// Flags are passed through to the service, rather than parsed here
+	serviceCmd.AddCommand(&cobra.Command{
+		Use:                "install [flag]... <path> [path]...",
+		Short:              "Installs a service which runs roulette with the specified flags and paths.",
+		Args:               cobra.MinimumNArgs(1),
+		DisableFlagParsing: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return installService(args)
+		},
+	})
+
+	serviceCmd.AddCommand(&cobra.Command{
+		Use:   "uninstall",
+		Short: "Removes the service.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return uninstallService()
+		},
+	})
+
+	serviceCmd.AddCommand(&cobra.Command{
+		Use:   "start",
+		Short: "Starts the service.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return startService()
+		},
+	})
+
+	serviceCmd.AddCommand(&cobra.Command{
+		Use:   "stop",
+		Short: "Stops the service.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return stopService()
+		},
+	})
+
+	return serviceCmd
+}
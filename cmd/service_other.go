@@ -0,0 +1,75 @@
+//go:build !windows
+
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Set in the environment of the detached process, so that it
+// doesn't detach again.
+const daemonEnv string = "ROULETTE_DAEMONIZED"
+
+func run(server *Server) error {
+	return server.ListenAndServe(context.Background())
+}
+
+// Re-runs roulette in a new session, detached from the terminal, with
+// its output discarded. Returns true in the original process, which
+// should then exit.
+func daemonize() (bool, error) {
+	if os.Getenv(daemonEnv) != "" {
+		return false, nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return false, err
+	}
+
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer null.Close()
+
+	daemon := exec.Command(executable, os.Args[1:]...)
+	daemon.Env = append(os.Environ(), daemonEnv+"=1")
+	daemon.Stdin = null
+	daemon.Stdout = null
+	daemon.Stderr = null
+	daemon.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = daemon.Start()
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("roulette running in the background with PID %d\n", daemon.Process.Pid)
+
+	return true, daemon.Process.Release()
+}
+
+func installService(args []string) error {
+	return ErrServiceUnsupported
+}
+
+func uninstallService() error {
+	return ErrServiceUnsupported
+}
+
+func startService() error {
+	return ErrServiceUnsupported
+}
+
+func stopService() error {
+	return ErrServiceUnsupported
+}
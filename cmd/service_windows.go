@@ -0,0 +1,190 @@
+//go:build windows
+
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+type service struct {
+	server *Server
+}
+
+// Serves until the service control manager asks the service to stop.
+func (s *service) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+
+	go func() {
+		served <- s.server.ListenAndServe(ctx)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-served:
+			if err != nil {
+				return true, 1
+			}
+
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+
+				cancel()
+			}
+		}
+	}
+}
+
+func run(server *Server) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+
+	if !isService {
+		return server.ListenAndServe(context.Background())
+	}
+
+	return svc.Run(serviceName, &service{server: server})
+}
+
+func daemonize() (bool, error) {
+	return false, ErrDaemonUnsupported
+}
+
+// Services are started in the system directory, so paths passed
+// to install should be absolute.
+func installService(args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(serviceName, executable, mgr.Config{
+		DisplayName: "roulette",
+		Description: "Serves random media from the specified directories.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	fmt.Printf("Installed service %s\n", serviceName)
+
+	return nil
+}
+
+func openService() (*mgr.Mgr, *mgr.Service, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		m.Disconnect()
+
+		return nil, nil, err
+	}
+
+	return m, s, nil
+}
+
+func uninstallService() error {
+	m, s, err := openService()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+
+	err = s.Delete()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Uninstalled service %s\n", serviceName)
+
+	return nil
+}
+
+func startService() error {
+	m, s, err := openService()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Started service %s\n", serviceName)
+
+	return nil
+}
+
+// Waits for the service to finish shutting down, up to the same
+// timeout the server itself allows for shutdown.
+func stopService() error {
+	m, s, err := openService()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for service %s to stop", serviceName)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+
+		status, err = s.Query()
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Stopped service %s\n", serviceName)
+
+	return nil
+}
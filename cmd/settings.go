@@ -0,0 +1,144 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The subset of settings which can be changed while the server is running.
+// Each change replaces the current settings as a whole, so readers always
+// observe a consistent set of values.
+type runtimeSettings struct {
+	Verbose   bool   `json:"verbose"`
+	NoButtons bool   `json:"no_buttons"`
+	CodeTheme string `json:"code_theme"`
+	Refresh   string `json:"refresh"`
+}
+
+type settingsPatch struct {
+	Verbose   *bool   `json:"verbose"`
+	NoButtons *bool   `json:"no_buttons"`
+	CodeTheme *string `json:"code_theme"`
+	Refresh   *string `json:"refresh"`
+}
+
+func (app *application) initSettings() {
+	app.currentSettings.Store(&runtimeSettings{
+		Verbose:   app.Verbose,
+		NoButtons: app.NoButtons,
+		CodeTheme: app.CodeTheme,
+	})
+}
+
+// Returns the current settings, falling back to the values
+// provided on the command line if they have not yet been initialized.
+func (app *application) settings() runtimeSettings {
+	s := app.currentSettings.Load()
+	if s == nil {
+		return runtimeSettings{
+			Verbose:   app.Verbose,
+			NoButtons: app.NoButtons,
+			CodeTheme: app.CodeTheme,
+		}
+	}
+
+	return *s
+}
+
+func (app *application) verbose() bool {
+	return app.settings().Verbose
+}
+
+func (patch *settingsPatch) apply(s runtimeSettings) (runtimeSettings, error) {
+	if patch.Verbose != nil {
+		s.Verbose = *patch.Verbose
+	}
+
+	if patch.NoButtons != nil {
+		s.NoButtons = *patch.NoButtons
+	}
+
+	if patch.CodeTheme != nil {
+		if !slices.Contains(styles.Names(), *patch.CodeTheme) {
+			return s, ErrInvalidSettings
+		}
+
+		s.CodeTheme = *patch.CodeTheme
+	}
+
+	if patch.Refresh != nil {
+		if *patch.Refresh != "" {
+			duration, err := time.ParseDuration(*patch.Refresh)
+			if err != nil || duration < 0 {
+				return s, ErrInvalidSettings
+			}
+		}
+
+		s.Refresh = *patch.Refresh
+	}
+
+	return s, nil
+}
+
+func (app *application) serveSettings(errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Runtime settings", app.settings(), errorChannel)
+	}
+}
+
+func (app *application) serveSettingsUpdate(errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !app.authorized(r) {
+			app.unauthorized(w, r)
+
+			return
+		}
+
+		var patch settingsPatch
+
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		decoder.DisallowUnknownFields()
+
+		err := decoder.Decode(&patch)
+		if err != nil {
+			http.Error(w, "Invalid settings: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		for {
+			current := app.currentSettings.Load()
+
+			updated, err := patch.apply(*current)
+			if errors.Is(err, ErrInvalidSettings) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+
+				return
+			}
+
+			if app.currentSettings.CompareAndSwap(current, &updated) {
+				break
+			}
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | CONFIG: Settings updated by %s\n",
+				time.Now().Format(logDate),
+				requester(r),
+			)
+		}
+
+		app.serveJson(w, r, "Runtime settings", app.settings(), errorChannel)
+	}
+}
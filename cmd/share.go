@@ -0,0 +1,315 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/spf13/cobra"
+)
+
+const (
+	shareCookie string = "roulette_share"
+	shareParam  string = "share"
+)
+
+// The paths a share token grants access to, and when it stops doing so.
+type shareToken struct {
+	Paths   []string `json:"paths"`
+	Expires int64    `json:"expires"`
+}
+
+type shareTokenKey struct{}
+
+type sharedLink struct {
+	Token   string   `json:"token"`
+	Url     string   `json:"url"`
+	Paths   []string `json:"paths"`
+	Expires string   `json:"expires"`
+}
+
+func (app *application) signShare(payload string) string {
+	mac := hmac.New(sha256.New, []byte(app.ShareSecret))
+
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns a token granting access to the specified paths until the TTL
+// elapses. Tokens are signed with --share-secret rather than stored, so
+// they can be created without access to the running server.
+func (app *application) newShareToken(paths []string, ttl string) (string, *shareToken, error) {
+	duration, err := time.ParseDuration(ttl)
+	if err != nil || duration <= 0 || len(paths) == 0 || app.ShareSecret == "" {
+		return "", nil, ErrInvalidShare
+	}
+
+	token := &shareToken{
+		Paths:   make([]string, 0, len(paths)),
+		Expires: time.Now().Add(duration).Unix(),
+	}
+
+	for _, path := range paths {
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			return "", nil, err
+		}
+
+		token.Paths = append(token.Paths, absolute)
+	}
+
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + app.signShare(encoded), token, nil
+}
+
+// Returns the token if its signature is valid and it has not yet expired.
+func (app *application) parseShareToken(value string) (*shareToken, bool) {
+	encoded, signature, found := strings.Cut(value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(app.signShare(encoded))) {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+
+	var token shareToken
+
+	err = json.Unmarshal(payload, &token)
+	if err != nil || time.Now().Unix() >= token.Expires {
+		return nil, false
+	}
+
+	return &token, true
+}
+
+func shareFrom(r *http.Request) *shareToken {
+	token, _ := r.Context().Value(shareTokenKey{}).(*shareToken)
+
+	return token
+}
+
+// Returns whether a share token grants access to the requested path.
+// Administrative and API endpoints are reserved for the admin token.
+func (app *application) shareable(path string) bool {
+	switch {
+	case path == "/robots.txt", path == app.Prefix, path == app.Prefix+"/", path == app.Prefix+"/favicon.ico":
+		return true
+	}
+
+	for _, prefix := range []string{mediaPrefix, sourcePrefix, artPrefix, siblingPrefix, storyboardPrefix, transcodePrefix, zipPrefix, "/favicons", "/ruffle"} {
+		if strings.HasPrefix(path, app.Prefix+prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// If --share-secret is set, rejects requests without either a valid share
+// token or the admin token. Tokens passed in the share query parameter are
+// stored in a cookie, so that they carry over to subsequent requests.
+func (app *application) withShares(next http.Handler) http.Handler {
+	if app.ShareSecret == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.authorized(r) {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		value := r.URL.Query().Get(shareParam)
+		if value == "" {
+			cookie, err := r.Cookie(shareCookie)
+			if err == nil {
+				value = cookie.Value
+			}
+		}
+
+		token, valid := app.parseShareToken(value)
+		if !valid || !app.shareable(r.URL.Path) {
+			if app.verbose() {
+				fmt.Printf("%s | ERROR: Request for %s from %s without a valid share token\n",
+					time.Now().Format(logDate),
+					r.URL.Path,
+					requester(r),
+				)
+			}
+
+			http.Error(w, "Forbidden", http.StatusForbidden)
+
+			return
+		}
+
+		if r.URL.Query().Has(shareParam) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     shareCookie,
+				Value:    value,
+				Path:     app.Prefix + "/",
+				Expires:  time.Unix(token.Expires, 0),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), shareTokenKey{}, token)))
+	})
+}
+
+// Narrows the served paths to those shared by the request's token, if any.
+// Shared paths are returned with a trailing separator, so that sharing
+// /photos does not also share /photos-private.
+func sharedPaths(r *http.Request, paths []string) []string {
+	token := shareFrom(r)
+	if token == nil {
+		return paths
+	}
+
+	shared := []string{}
+
+	for _, path := range token.Paths {
+		if topLevelPath(path, paths) != "" {
+			shared = append(shared, strings.TrimSuffix(path, string(filepath.Separator))+string(filepath.Separator))
+		}
+	}
+
+	for _, path := range paths {
+		if topLevelPath(path, token.Paths) != "" {
+			shared = append(shared, strings.TrimSuffix(path, string(filepath.Separator))+string(filepath.Separator))
+		}
+	}
+
+	return shared
+}
+
+// Returns the directory random selections should be made within, for requests
+// bearing a share token. Returns false if no shared path is within the scope.
+func (app *application) shareScope(r *http.Request, scope string, paths []string, vhosts map[string]string, rng *rand.Rand) (string, bool) {
+	if shareFrom(r) == nil {
+		return scope, true
+	}
+
+	candidates := []string{}
+
+	for _, path := range app.servedPaths(r, paths, vhosts) {
+		path = strings.TrimSuffix(path, string(filepath.Separator))
+
+		switch {
+		case scope == "":
+			candidates = append(candidates, path)
+		case topLevelPath(scope, []string{path}) != "":
+			return scope, true
+		case topLevelPath(path, []string{scope}) != "":
+			candidates = append(candidates, path)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	return candidates[rng.IntN(len(candidates))], true
+}
+
+func (app *application) serveShareCreate(paths []string, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !app.authorized(r) {
+			app.unauthorized(w, r)
+
+			return
+		}
+
+		requested := r.URL.Query()["path"]
+
+		for _, path := range requested {
+			if !filepath.IsAbs(path) || topLevelPath(filepath.Clean(path), paths) == "" {
+				http.Error(w, "Paths must be inside a served path", http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		value, token, err := app.newShareToken(requested, r.URL.Query().Get("ttl"))
+		switch {
+		case errors.Is(err, ErrInvalidShare):
+			http.Error(w, ErrInvalidShare.Error(), http.StatusBadRequest)
+
+			return
+		case err != nil:
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
+
+			return
+		}
+
+		app.serveJson(w, r, "Share token", sharedLink{
+			Token:   value,
+			Url:     app.rootUrl(r) + "/?" + shareParam + "=" + value,
+			Paths:   token.Paths,
+			Expires: time.Unix(token.Expires, 0).Format(time.RFC3339),
+		}, errorChannel)
+	}
+}
+
+func newTokenCommand() *cobra.Command {
+	var (
+		app   application
+		paths []string
+		ttl   string
+	)
+
+	tokenCmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manages share tokens.",
+	}
+
+	createCmd := &cobra.Command{
+		Use:   "create",
+		Short: "Creates a share token granting access to the specified paths.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			value, _, err := app.newShareToken(paths, ttl)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("%s\n", value)
+
+			return nil
+		},
+	}
+
+	createCmd.Flags().StringSliceVar(&paths, "paths", []string{}, "path to grant access to, can be specified multiple times")
+	createCmd.Flags().StringVar(&app.ShareSecret, "share-secret", "", "secret used to sign the token, matching the server's --share-secret")
+	createCmd.Flags().StringVar(&ttl, "ttl", "24h", "how long the token remains valid for")
+
+	tokenCmd.AddCommand(createCmd)
+
+	return tokenCmd
+}
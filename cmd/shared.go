@@ -0,0 +1,322 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backendMemory string = "memory"
+	backendRedis  string = "redis"
+
+	// Interval at which replicas check for changes made by other replicas
+	sharedSyncInterval time.Duration = 5 * time.Second
+
+	sharedIndexKey   string = "roulette:index"
+	sharedVersionKey string = "roulette:index:version"
+	sharedServedKey  string = "roulette:served"
+	sharedDeletedKey string = "roulette:deleted"
+
+	// Channel on which deletions are broadcast to all replicas
+	sharedDeletionsChannel string = "roulette:deletions"
+
+	// Delay before resubscribing after losing the connection
+	sharedRetryInterval time.Duration = 10 * time.Second
+)
+
+func (app *application) validIndexBackend(backend string) bool {
+	switch backend {
+	case backendMemory:
+		return true
+	case backendRedis:
+		return app.RedisUrl != "" && app.Index
+	default:
+		return false
+	}
+}
+
+// Stores the index in a Redis set, alongside a version number which is
+// incremented whenever it changes, so that other replicas know to reload
+// it. Serve counts and deleted files are recorded as well.
+type sharedStore struct {
+	app *application
+
+	client  *redisClient
+	mutex   sync.Mutex
+	version int64
+	replica string
+}
+
+func (app *application) newSharedStore() (*sharedStore, error) {
+	if app.IndexBackend != backendRedis {
+		return nil, nil
+	}
+
+	client, err := newRedisClient(app.RedisUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = client.do("PING")
+	if err != nil {
+		return nil, err
+	}
+
+	if app.verbose() {
+		fmt.Printf("%s | INDEX: Using shared index at %s\n",
+			time.Now().Format(logDate),
+			client.address,
+		)
+	}
+
+	replica, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sharedStore{app: app, client: client, replica: replica}, nil
+}
+
+// Replaces the shared index with the specified list.
+func (shared *sharedStore) publish(list []string, errorChannel chan<- error) {
+	if shared == nil || len(list) == 0 {
+		return
+	}
+
+	startTime := time.Now()
+
+	// Each replica stages its index under its own key, so that concurrent
+	// rebuilds by multiple replicas cannot interleave their entries
+	staging := sharedIndexKey + ":staging:" + shared.replica
+
+	_, err := shared.client.do("DEL", staging)
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	for batch := range slices.Chunk(list, redisBatchLength) {
+		_, err = shared.client.do(append([]string{"SADD", staging}, batch...)...)
+		if err != nil {
+			errorChannel <- err
+
+			shared.client.do("DEL", staging)
+
+			return
+		}
+	}
+
+	// Renaming replaces the index atomically, so other replicas never
+	// observe a partially written one
+	_, err = shared.client.do("RENAME", staging, sharedIndexKey)
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	version, err := shared.client.int("INCR", sharedVersionKey)
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	shared.mutex.Lock()
+	shared.version = version
+	shared.mutex.Unlock()
+
+	if shared.app.verbose() {
+		fmt.Printf("%s | INDEX: Published %d entries to shared index in %s\n",
+			time.Now().Format(logDate),
+			len(list),
+			time.Since(startTime).Round(time.Microsecond),
+		)
+	}
+}
+
+// Loads the shared index if it has changed since it was last loaded or
+// published by this replica. Returns false if it is unchanged or empty.
+func (shared *sharedStore) load(index *fileIndex, errorChannel chan<- error) bool {
+	if shared == nil {
+		return false
+	}
+
+	version, err := shared.client.int("GET", sharedVersionKey)
+	switch {
+	case errors.Is(err, ErrRedisNil):
+		return false
+	case err != nil:
+		errorChannel <- err
+
+		return false
+	}
+
+	shared.mutex.Lock()
+	current := shared.version
+	shared.mutex.Unlock()
+
+	if version == current {
+		return false
+	}
+
+	startTime := time.Now()
+
+	list, err := shared.client.strings("SMEMBERS", sharedIndexKey)
+	if err != nil {
+		errorChannel <- err
+
+		return false
+	}
+
+	shared.mutex.Lock()
+	shared.version = version
+	shared.mutex.Unlock()
+
+	if len(list) == 0 {
+		return false
+	}
+
+	slices.Sort(list)
+
+	index.set(list, errorChannel)
+
+	if shared.app.verbose() {
+		fmt.Printf("%s | INDEX: Loaded %d entries from shared index in %s\n",
+			time.Now().Format(logDate),
+			len(list),
+			time.Since(startTime).Round(time.Microsecond),
+		)
+	}
+
+	return true
+}
+
+// Removes a deleted file from the shared index, records its deletion, and
+// broadcasts it so that other replicas evict it from their own index
+// immediately, rather than serving it until the index is next rebuilt.
+func (shared *sharedStore) remove(path string) error {
+	if shared == nil {
+		return nil
+	}
+
+	_, err := shared.client.do("SREM", sharedIndexKey, path)
+	if err != nil {
+		return err
+	}
+
+	_, err = shared.client.do("SADD", sharedDeletedKey, path)
+	if err != nil {
+		return err
+	}
+
+	_, err = shared.client.do("PUBLISH", sharedDeletionsChannel, shared.replica+" "+path)
+
+	return err
+}
+
+// Evicts files deleted by other replicas from the index as they are broadcast.
+func (shared *sharedStore) receiveDeletions(ctx context.Context, index *fileIndex, errorChannel chan<- error) {
+	for ctx.Err() == nil {
+		err := shared.client.subscribe(ctx, sharedDeletionsChannel, func(payload string) {
+			replica, path, found := strings.Cut(payload, " ")
+			if !found || replica == shared.replica {
+				return
+			}
+
+			index.remove(path)
+
+			if shared.app.verbose() {
+				fmt.Printf("%s | INDEX: Removed %s, deleted by another replica\n",
+					time.Now().Format(logDate),
+					path,
+				)
+			}
+		})
+		if err != nil {
+			errorChannel <- err
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sharedRetryInterval):
+		}
+
+		// Deletions broadcast while disconnected were missed, so the
+		// shared index is reloaded in full
+		shared.mutex.Lock()
+		shared.version = 0
+		shared.mutex.Unlock()
+
+		shared.load(index, errorChannel)
+	}
+}
+
+// Records that a file was served by this replica.
+func (shared *sharedStore) served(path string) error {
+	if shared == nil {
+		return nil
+	}
+
+	_, err := shared.client.do("HINCRBY", sharedServedKey, path, "1")
+
+	return err
+}
+
+// Returns the number of times each file has been served across all replicas.
+func (shared *sharedStore) servedCounts() (map[string]int, error) {
+	values, err := shared.client.strings("HGETALL", sharedServedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(values)/2)
+
+	for i := 0; i+1 < len(values); i += 2 {
+		count, err := strconv.Atoi(values[i+1])
+		if err != nil {
+			continue
+		}
+
+		counts[values[i]] = count
+	}
+
+	return counts, nil
+}
+
+// Periodically reloads the shared index, so that rebuilds performed by
+// other replicas are picked up, and listens for deletions.
+func (app *application) registerSharedSync(ctx context.Context, index *fileIndex, errorChannel chan<- error) {
+	if app.sharedIndex == nil {
+		return
+	}
+
+	go app.sharedIndex.receiveDeletions(ctx, index, errorChannel)
+
+	ticker := time.NewTicker(sharedSyncInterval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				app.sharedIndex.load(index, errorChannel)
+			case <-ctx.Done():
+				ticker.Stop()
+
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Returns the other files in the same directory as the specified file.
+func (index *fileIndex) siblings(file string) []string {
+	dir, _ := filepath.Split(file)
+
+	return slices.DeleteFunc(index.directory(dir), func(v string) bool {
+		return v == file
+	})
+}
+
+func (app *application) siblingButton(path, queryParams string, index *fileIndex) string {
+	var status string
+
+	if len(index.siblings(path)) == 0 {
+		status = " disabled"
+	}
+
+	return fmt.Sprintf(`<button data-href="%s"%s>Folder</button>`,
+		html.EscapeString(app.Prefix+siblingPrefix+app.pagePath(path)+queryParams),
+		status)
+}
+
+func (app *application) serveSibling(paths []string, vhosts map[string]string, index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, app.Prefix), siblingPrefix)
+
+		switch {
+		case app.HashPaths:
+			resolved, found := index.resolve(path)
+			if !found {
+				app.notFound(w, r, path)
+
+				return
+			}
+
+			path = resolved
+		case runtime.GOOS == "windows":
+			path = fromUrlPath(path)
+		}
+
+		if !app.pathIsValid(path, app.servedPaths(r, paths, vhosts)) {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		siblings := index.siblings(path)
+		if len(siblings) == 0 {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		seed := app.seedParams(r)
+
+		sibling := siblings[seed.source().IntN(len(siblings))]
+
+		refreshInterval := app.refreshParam(r)
+
+		newUrl := fmt.Sprintf("%s%s%s",
+			app.rootUrl(r),
+			app.mediaUri(sibling),
+			app.generateQueryParams(app.sortOrder(r), refreshInterval, seed.next(), playbackParams(r), app.collectionParam(r), app.mountParam(r)),
+		)
+
+		http.Redirect(w, r, newUrl, redirectStatusCode)
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Sibling of %s to %s in %s\n",
+				startTime.Format(logDate),
+				path,
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types/images"
+)
+
+const (
+	// Maximum number of differing bits for two images to be considered similar
+	similarThreshold int = 10
+
+	// Maximum number of similar images shown on an image's view page
+	similarLength int = 6
+)
+
+// A perceptual hash of an image, along with the size and modification
+// time it was computed at, so it is only recomputed when the file changes.
+type perceptualHash struct {
+	size    int64
+	modTime time.Time
+	hash    uint64
+}
+
+type similarGroup struct {
+	Files []string `json:"files"`
+}
+
+// Computes a 64-bit difference hash of the image, by shrinking it to a 9x8
+// grid of average luminance values and comparing horizontally adjacent cells.
+// Resized, recompressed, or lightly edited copies produce hashes differing
+// in only a few bits.
+func differenceHash(img image.Image) uint64 {
+	const (
+		columns = 9
+		rows    = 8
+	)
+
+	var sums, counts [rows][columns]float64
+
+	bounds := img.Bounds()
+
+	width, height := bounds.Dx(), bounds.Dy()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := (y - bounds.Min.Y) * rows / height
+
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			column := (x - bounds.Min.X) * columns / width
+
+			r, g, b, _ := img.At(x, y).RGBA()
+
+			sums[row][column] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			counts[row][column]++
+		}
+	}
+
+	var hash uint64
+
+	for row := 0; row < rows; row++ {
+		for column := 0; column < columns-1; column++ {
+			left := sums[row][column] / max(counts[row][column], 1)
+			right := sums[row][column+1] / max(counts[row][column+1], 1)
+
+			if left > right {
+				hash |= 1 << (row*(columns-1) + column)
+			}
+		}
+	}
+
+	return hash
+}
+
+func hashImage(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	return differenceHash(img), nil
+}
+
+func isImage(path string) bool {
+	_, found := images.Format{}.Extensions()[strings.ToLower(filepath.Ext(path))]
+
+	return found
+}
+
+// Returns perceptual hashes for each image in the list, reusing hashes
+// of unchanged files from the previous run. Decoding is limited to one
+// image per CPU, as each decoded image is held in memory while hashing.
+func findSimilar(list []string, previous map[string]perceptualHash) map[string]perceptualHash {
+	hashes := make(map[string]perceptualHash)
+
+	var mutex sync.Mutex
+
+	limit := make(chan struct{}, runtime.NumCPU())
+
+	var wg sync.WaitGroup
+
+	for _, path := range list {
+		if !isImage(path) {
+			continue
+		}
+
+		limit <- struct{}{}
+
+		wg.Add(1)
+
+		go func(path string) {
+			defer func() {
+				<-limit
+
+				wg.Done()
+			}()
+
+			info, err := os.Stat(path)
+			if err != nil {
+				return
+			}
+
+			cached, found := previous[path]
+			if found && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+				mutex.Lock()
+				hashes[path] = cached
+				mutex.Unlock()
+
+				return
+			}
+
+			hash, err := hashImage(path)
+			if err != nil {
+				return
+			}
+
+			mutex.Lock()
+			hashes[path] = perceptualHash{size: info.Size(), modTime: info.ModTime(), hash: hash}
+			mutex.Unlock()
+		}(path)
+	}
+
+	wg.Wait()
+
+	return hashes
+}
+
+// Returns up to limit images similar to the specified one, closest first.
+func (index *fileIndex) similarTo(path string, limit int) []string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	target, found := index.perceptual[path]
+	if !found {
+		return nil
+	}
+
+	type match struct {
+		path     string
+		distance int
+	}
+
+	var matches []match
+
+	for other, hash := range index.perceptual {
+		if other == path {
+			continue
+		}
+
+		distance := bits.OnesCount64(target.hash ^ hash.hash)
+		if distance <= similarThreshold {
+			matches = append(matches, match{path: other, distance: distance})
+		}
+	}
+
+	slices.SortFunc(matches, func(a, b match) int {
+		if a.distance != b.distance {
+			return a.distance - b.distance
+		}
+
+		return strings.Compare(a.path, b.path)
+	})
+
+	similar := make([]string, 0, min(limit, len(matches)))
+
+	for _, m := range matches[:min(limit, len(matches))] {
+		similar = append(similar, m.path)
+	}
+
+	return similar
+}
+
+// Groups images which are similar to one another, directly or through a
+// chain of similar images. Every pair of images is compared, so this
+// takes time proportional to the square of the number of images.
+func (index *fileIndex) similarGroups() []similarGroup {
+	index.mutex.RLock()
+	paths := make([]string, 0, len(index.perceptual))
+	for path := range index.perceptual {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	hashes := make([]uint64, len(paths))
+	for i, path := range paths {
+		hashes[i] = index.perceptual[path].hash
+	}
+	index.mutex.RUnlock()
+
+	parent := make([]int, len(paths))
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+
+		return parent[i]
+	}
+
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if bits.OnesCount64(hashes[i]^hashes[j]) <= similarThreshold {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := make(map[int][]string)
+
+	for i, path := range paths {
+		root := find(i)
+
+		members[root] = append(members[root], path)
+	}
+
+	groups := []similarGroup{}
+
+	for _, files := range members {
+		if len(files) > 1 {
+			groups = append(groups, similarGroup{Files: files})
+		}
+	}
+
+	slices.SortFunc(groups, func(a, b similarGroup) int {
+		return strings.Compare(a.Files[0], b.Files[0])
+	})
+
+	return groups
+}
+
+// Renders a strip of thumbnails linking to images similar to the one displayed.
+func (app *application) similarStrip(path, queryParams string, index *fileIndex) string {
+	similar := index.similarTo(path, similarLength)
+	if len(similar) == 0 {
+		return ""
+	}
+
+	var htmlBody strings.Builder
+
+	htmlBody.WriteString(`<div style="position:fixed;bottom:0.5rem;left:0.5rem;z-index:1;display:flex;gap:0.25rem;" aria-label="Similar images">`)
+
+	for _, s := range similar {
+		htmlBody.WriteString(fmt.Sprintf(`<a href="%s" style="display:inline;height:auto;width:auto;"><img class="similar" src="%s" alt="Similar image: %s" style="position:static;transform:none;height:4rem;width:auto;max-width:none;max-height:none;"></a>`,
+			html.EscapeString(app.Prefix+escapePath(app.mediaUri(s))+queryParams),
+			html.EscapeString(app.Prefix+escapePath(app.generateFileUri(s))),
+			html.EscapeString(filepath.Base(s)),
+		))
+	}
+
+	htmlBody.WriteString(`</div>`)
+
+	return htmlBody.String()
+}
+
+func (app *application) serveSimilar(index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Similar images", index.similarGroups(), errorChannel)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"time"
+)
+
+func (app *application) validSlowRequest() bool {
+	if app.SlowRequest == "" {
+		return true
+	}
+
+	threshold, err := time.ParseDuration(app.SlowRequest)
+
+	return err == nil && threshold > 0
+}
+
+// Logs requests which take longer than --slow-request to handle. A request
+// which is still running once the threshold passes is logged immediately,
+// so that requests which never complete (e.g. stuck on an unresponsive
+// network mount) are reported as well.
+//
+// If --profile is set, each request is also labeled with its path and ID,
+// so that goroutine and CPU profiles can be narrowed down to slow requests.
+func (app *application) withSlowRequests(next http.Handler) http.Handler {
+	if app.SlowRequest == "" {
+		return next
+	}
+
+	threshold, _ := time.ParseDuration(app.SlowRequest)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+
+		timer := time.AfterFunc(threshold, func() {
+			fmt.Printf("%s | SLOW: %s %s from %s still running after %s\n",
+				time.Now().Format(logDate),
+				r.Method,
+				r.URL.Path,
+				requester(r),
+				threshold,
+			)
+		})
+
+		if app.Profile {
+			labels := pprof.Labels("path", r.URL.Path, "request_id", requestId(r))
+
+			pprof.Do(r.Context(), labels, func(ctx context.Context) {
+				next.ServeHTTP(w, r.WithContext(ctx))
+			})
+		} else {
+			next.ServeHTTP(w, r)
+		}
+
+		if timer.Stop() {
+			return
+		}
+
+		fmt.Printf("%s | SLOW: %s %s from %s took %s\n",
+			time.Now().Format(logDate),
+			r.Method,
+			r.URL.Path,
+			requester(r),
+			time.Since(startTime).Round(time.Microsecond),
+		)
+	})
+}
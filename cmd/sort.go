@@ -6,6 +6,7 @@ package cmd
 
 import (
 	"fmt"
+	"html"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -55,49 +56,23 @@ func split(path string, filename *regexp.Regexp) (*splitPath, error) {
 	return p, nil
 }
 
-func getRange(path string, index *fileIndex, filename *regexp.Regexp) (string, string, error) {
-	splitPath, err := split(path, filename)
-	if err != nil {
-		return "", "", err
-	}
-
+// Returns the first and last files in the directory containing the
+// specified file, as ordered in the index.
+func getRange(path string, index *fileIndex) (string, string) {
 	dir, _ := filepath.Split(path)
 
-	list := index.pathMap[dir]
-
-	var first, last, previous string
-
-Loop:
-	for i, val := range list {
-		splitVal, err := split(val, filename)
-		if err != nil {
-			return "", "", err
-		}
-
-		switch {
-		case splitVal.base == splitPath.base && first == "":
-			first = val
-		case splitVal.base != splitPath.base && first != "":
-			last = previous
-
-			break Loop
-		case splitVal.base == splitPath.base && i == len(list)-1:
-			last = val
-
-			break Loop
-		}
+	return index.bounds(dir)
+}
 
-		previous = val
+func (app *application) pagePath(path string) string {
+	if app.HashPaths {
+		return hashedPrefix + hashPath(path)
 	}
 
-	return first, last, nil
-}
-
-func pathUrlEscape(path string) string {
-	return strings.Replace(path, `'`, `%27`, -1)
+	return escapePath(urlPath(path))
 }
 
-func paginate(path, first, last, queryParams string, filename *regexp.Regexp, formats types.Types) (string, error) {
+func (app *application) paginate(path, first, last, queryParams string, filename *regexp.Regexp, formats types.Types) (string, error) {
 	split, err := split(path, filename)
 	if err != nil {
 		return "", err
@@ -115,6 +90,13 @@ func paginate(path, first, last, queryParams string, filename *regexp.Regexp, fo
 		lastStatus = " disabled"
 	}
 
+	// First and Last span the whole directory, but Prev and Next
+	// can only step through files with numbered names
+	if split.number == "" {
+		prevStatus = " disabled"
+		nextStatus = " disabled"
+	}
+
 	prevPath := &splitPath{
 		base:      split.base,
 		number:    split.decrement(),
@@ -149,37 +131,23 @@ func paginate(path, first, last, queryParams string, filename *regexp.Regexp, fo
 
 	var html strings.Builder
 
-	html.WriteString(`<table><tr><td>`)
-
-	html.WriteString(fmt.Sprintf(`<button onclick="window.location.href = '%s%s%s%s';"%s>First</button>`,
-		Prefix,
-		mediaPrefix,
-		pathUrlEscape(first),
-		queryParams,
-		firstStatus))
-
-	html.WriteString(fmt.Sprintf(`<button onclick="window.location.href = '%s%s%s%s';"%s>Prev</button>`,
-		Prefix,
-		mediaPrefix,
-		pathUrlEscape(prevPage),
-		queryParams,
-		prevStatus))
-
-	html.WriteString(fmt.Sprintf(`<button onclick="window.location.href = '%s%s%s%s';"%s>Next</button>`,
-		Prefix,
-		mediaPrefix,
-		pathUrlEscape(nextPage),
-		queryParams,
-		nextStatus))
-
-	html.WriteString(fmt.Sprintf(`<button onclick="window.location.href = '%s%s%s%s';"%s>Last</button>`,
-		Prefix,
-		mediaPrefix,
-		pathUrlEscape(last),
-		queryParams,
-		lastStatus))
-
-	html.WriteString("</td></tr></table>")
+	html.WriteString(app.pageButton("First", first, queryParams, firstStatus != ""))
+	html.WriteString(app.pageButton("Prev", prevPage, queryParams, prevStatus != ""))
+	html.WriteString(app.pageButton("Next", nextPage, queryParams, nextStatus != ""))
+	html.WriteString(app.pageButton("Last", last, queryParams, lastStatus != ""))
 
 	return html.String(), nil
 }
+
+func (app *application) pageButton(label, path, queryParams string, disabled bool) string {
+	var status string
+
+	if disabled {
+		status = " disabled"
+	}
+
+	return fmt.Sprintf(`<button data-href="%s"%s>%s</button>`,
+		html.EscapeString(app.Prefix+mediaPrefix+app.pagePath(path)+queryParams),
+		status,
+		label)
+}
@@ -0,0 +1,424 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	stateCacheDir     string = "cache"
+	stateDatabaseFile string = "state.db"
+
+	// Keys under which each kind of state is stored in the database
+	stateCollectionsKey string = "collections"
+	stateIndexKey       string = "index"
+	stateProblemsKey    string = "problems"
+	stateStatsKey       string = "stats"
+
+	// Time to wait for another process to release the database
+	stateLockTimeout time.Duration = time.Second
+)
+
+var stateBucket = []byte("state")
+
+// Files in which each kind of state was kept by earlier versions, which
+// are moved into the database the first time it is opened.
+var legacyStateFiles = map[string]string{
+	stateCollectionsKey: "collections.json",
+	stateIndexKey:       "index.zst",
+	stateProblemsKey:    "problems.json",
+	stateStatsKey:       "stats.json",
+}
+
+// Stores the index, problems report, serve counts, and collections in a
+// single bbolt database, each under its own key. Every write replaces a
+// value within a transaction, so a crash part way through leaves the
+// previous contents intact.
+type stateStore struct {
+	app *application
+
+	path string
+	db   *bolt.DB
+}
+
+// Creates the state directory, and places the cache directory
+// inside it if not otherwise specified.
+func (app *application) applyStateDir() error {
+	if app.StateDir == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(app.StateDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	if app.CacheDir == "" {
+		app.CacheDir = filepath.Join(app.StateDir, stateCacheDir)
+	}
+
+	return nil
+}
+
+func (app *application) openStateStore() (*stateStore, error) {
+	if app.StateDir == "" {
+		return nil, nil
+	}
+
+	path := filepath.Join(app.StateDir, stateDatabaseFile)
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: stateLockTimeout})
+	switch {
+	case errors.Is(err, bolt.ErrTimeout):
+		return nil, ErrStateDirInUse
+	case err != nil:
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(stateBucket)
+
+		return err
+	})
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	store := &stateStore{app: app, path: path, db: db}
+
+	err = store.migrate()
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Moves any state files written by earlier versions into the database,
+// unless it already holds state of the same kind.
+func (store *stateStore) migrate() error {
+	for key, name := range legacyStateFiles {
+		path := filepath.Join(store.app.StateDir, name)
+
+		contents, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		case err != nil:
+			return err
+		}
+
+		_, err = store.get(key)
+		switch {
+		case err == nil:
+			continue
+		case !errors.Is(err, os.ErrNotExist):
+			return err
+		}
+
+		err = store.put(key, contents)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+
+		if store.app.verbose() {
+			fmt.Printf("%s | STATE: Moved %s into %s\n",
+				time.Now().Format(logDate),
+				path,
+				store.path,
+			)
+		}
+	}
+
+	return nil
+}
+
+func (store *stateStore) Close() error {
+	if store == nil {
+		return nil
+	}
+
+	return store.db.Close()
+}
+
+// Returns a copy of the value stored under the key,
+// or os.ErrNotExist if there is none.
+func (store *stateStore) get(key string) ([]byte, error) {
+	if store == nil {
+		return nil, os.ErrNotExist
+	}
+
+	var contents []byte
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(stateBucket).Get([]byte(key))
+		if value == nil {
+			return os.ErrNotExist
+		}
+
+		// Values are only valid for the life of the transaction
+		contents = bytes.Clone(value)
+
+		return nil
+	})
+
+	return contents, err
+}
+
+func (store *stateStore) put(key string, contents []byte) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put([]byte(key), contents)
+	})
+}
+
+// Returns whether state is persisted to the specified file, or to the
+// state database if no file is specified.
+func (app *application) persisted(path string) bool {
+	return path != "" || app.state != nil
+}
+
+// Returns where state is persisted, for use in log messages.
+func (app *application) stateLocation(path, key string) string {
+	if path != "" {
+		return path
+	}
+
+	return fmt.Sprintf("%s:%s", app.state.path, key)
+}
+
+// Opens persisted state for reading, along with its size. It is read from
+// the specified file if set, or otherwise from the state database. Returns
+// os.ErrNotExist if none has been persisted.
+func (app *application) readState(path, key string) (io.ReadCloser, int64, error) {
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+
+			return nil, 0, err
+		}
+
+		return file, info.Size(), nil
+	}
+
+	contents, err := app.state.get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), nil
+}
+
+// Returns the contents of persisted state, as read by readState.
+func (app *application) loadState(path, key string) ([]byte, error) {
+	reader, _, err := app.readState(path, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// Persists state to the specified file if set, or otherwise to the state
+// database, returning the number of bytes written. Does nothing if the
+// state is not persisted.
+func (app *application) saveState(path, key string, write func(io.Writer) error) (int64, error) {
+	if path != "" {
+		err := writeAtomic(path, write)
+		if err != nil {
+			return 0, err
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+
+		return info.Size(), nil
+	}
+
+	if app.state == nil {
+		return 0, nil
+	}
+
+	var contents bytes.Buffer
+
+	err := write(&contents)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(contents.Len()), app.state.put(key, contents.Bytes())
+}
+
+// Writes a file by way of a temporary file in the same directory, which
+// is synced to disk and then renamed over the original. A crash part way
+// through therefore leaves the previous contents intact.
+func writeAtomic(path string, write func(io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	temporary := file.Name()
+
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(temporary, 0600)
+	}
+
+	if err != nil {
+		os.Remove(temporary)
+
+		return err
+	}
+
+	err = os.Rename(temporary, path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// Syncs a directory to disk, so that a rename within it survives a crash.
+// Windows does not support syncing directories, and persists renames
+// without doing so.
+func syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+type persistedStats struct {
+	Count      map[string]int       `json:"count"`
+	LastServed map[string]time.Time `json:"last_served"`
+}
+
+func (stats *serveStats) Export(errorChannel chan<- error) {
+	if stats.app.state == nil {
+		return
+	}
+
+	stats.mutex.RLock()
+	contents, err := json.Marshal(persistedStats{
+		Count:      stats.count,
+		LastServed: stats.lastServed,
+	})
+	length := len(stats.count)
+	stats.mutex.RUnlock()
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	_, err = stats.app.saveState("", stateStatsKey, func(w io.Writer) error {
+		_, err := w.Write(contents)
+
+		return err
+	})
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	if stats.app.verbose() {
+		fmt.Printf("%s | STATS: Exported %d entries to %s\n",
+			time.Now().Format(logDate),
+			length,
+			stats.app.stateLocation("", stateStatsKey),
+		)
+	}
+}
+
+func (stats *serveStats) Import(errorChannel chan<- error) {
+	if stats.app.state == nil {
+		return
+	}
+
+	contents, err := stats.app.loadState("", stateStatsKey)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return
+	case err != nil:
+		errorChannel <- err
+
+		return
+	}
+
+	var persisted persistedStats
+
+	err = json.Unmarshal(contents, &persisted)
+	if err != nil {
+		errorChannel <- err
+
+		return
+	}
+
+	stats.mutex.Lock()
+	for path, count := range persisted.Count {
+		stats.count[path] += count
+	}
+
+	for path, lastServed := range persisted.LastServed {
+		if lastServed.After(stats.lastServed[path]) {
+			stats.lastServed[path] = lastServed
+		}
+	}
+	stats.mutex.Unlock()
+
+	if stats.app.verbose() {
+		fmt.Printf("%s | STATS: Imported %d entries from %s\n",
+			time.Now().Format(logDate),
+			len(persisted.Count),
+			stats.app.stateLocation("", stateStatsKey),
+		)
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Number of directories sampled before serving a file despite every
+// candidate having been served within the --no-repeat window
+const noRepeatAttempts int = 10
+
+type serveStats struct {
+	app *application
+
+	mutex      *sync.RWMutex
+	count      map[string]int
+	lastServed map[string]time.Time
+	recent     []string
+	position   int
+	inWindow   map[string]int
+}
+
+type servedFile struct {
+	Path       string `json:"path"`
+	Count      int    `json:"count"`
+	LastServed string `json:"last_served,omitempty"`
+}
+
+func (app *application) newServeStats() *serveStats {
+	return &serveStats{
+		app:        app,
+		mutex:      &sync.RWMutex{},
+		count:      make(map[string]int),
+		lastServed: make(map[string]time.Time),
+		recent:     make([]string, 0, app.NoRepeat),
+		inWindow:   make(map[string]int, app.NoRepeat),
+	}
+}
+
+func (stats *serveStats) record(path string) {
+	stats.mutex.Lock()
+	stats.count[path]++
+	stats.lastServed[path] = time.Now()
+
+	if stats.app.NoRepeat > 0 {
+		stats.remember(path)
+	}
+	stats.mutex.Unlock()
+}
+
+// Adds a path to the window of recently served files, evicting the oldest
+// entry once the window is full. Callers must hold the write lock.
+func (stats *serveStats) remember(path string) {
+	if len(stats.recent) < stats.app.NoRepeat {
+		stats.recent = append(stats.recent, path)
+	} else {
+		evicted := stats.recent[stats.position]
+
+		stats.inWindow[evicted]--
+		if stats.inWindow[evicted] <= 0 {
+			delete(stats.inWindow, evicted)
+		}
+
+		stats.recent[stats.position] = path
+	}
+
+	stats.inWindow[path]++
+
+	stats.position = (stats.position + 1) % stats.app.NoRepeat
+}
+
+// Returns the files from the list which are not among
+// the last --no-repeat files served.
+func (stats *serveStats) notRecent(list []string) []string {
+	if stats.app.NoRepeat == 0 {
+		return list
+	}
+
+	stats.mutex.RLock()
+	defer stats.mutex.RUnlock()
+
+	return slices.DeleteFunc(slices.Clone(list), func(path string) bool {
+		return stats.inWindow[path] > 0
+	})
+}
+
+// Selects a file from the list, with each file weighted
+// inversely to the number of times it has been served.
+func (stats *serveStats) pickUnseen(list []string, rng *rand.Rand) string {
+	weights := make([]float64, len(list))
+
+	var total float64
+
+	stats.mutex.RLock()
+	for i, path := range list {
+		weights[i] = 1 / float64(stats.count[path]+1)
+
+		total += weights[i]
+	}
+	stats.mutex.RUnlock()
+
+	target := rng.Float64() * total
+
+	for i, weight := range weights {
+		target -= weight
+
+		if target < 0 {
+			return list[i]
+		}
+	}
+
+	return list[len(list)-1]
+}
+
+// Returns the number of times each file has been served. If the index is
+// shared, this includes files served by other replicas. Local counts are
+// used if the shared counts cannot be retrieved.
+func (stats *serveStats) counts() map[string]int {
+	if stats.app.sharedIndex != nil {
+		counts, err := stats.app.sharedIndex.servedCounts()
+		if err == nil {
+			return counts
+		}
+	}
+
+	stats.mutex.RLock()
+	defer stats.mutex.RUnlock()
+
+	return maps.Clone(stats.count)
+}
+
+// Returns up to limit files, ordered by descending serve count.
+func (stats *serveStats) mostServed(limit int) []servedFile {
+	counts := stats.counts()
+
+	stats.mutex.RLock()
+	files := make([]servedFile, 0, len(counts))
+	for path, count := range counts {
+		file := servedFile{
+			Path:  path,
+			Count: count,
+		}
+
+		// Files only served by other replicas have no local timestamp
+		lastServed, found := stats.lastServed[path]
+		if found {
+			file.LastServed = lastServed.Format(logDate)
+		}
+
+		files = append(files, file)
+	}
+	stats.mutex.RUnlock()
+
+	slices.SortFunc(files, func(a, b servedFile) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return files[:min(limit, len(files))]
+}
+
+// Returns the total number of files served.
+func (stats *serveStats) total() int {
+	var total int
+
+	for _, count := range stats.counts() {
+		total += count
+	}
+
+	return total
+}
+
+// Returns up to limit indexed files which have never been served.
+func (stats *serveStats) neverServed(index *fileIndex, limit int) []string {
+	list := index.dump()
+
+	files := []string{}
+
+	stats.mutex.RLock()
+	for _, path := range list {
+		if len(files) == limit {
+			break
+		}
+
+		if stats.count[path] == 0 {
+			files = append(files, path)
+		}
+	}
+	stats.mutex.RUnlock()
+
+	return files
+}
+
+// Returns the number of results requested via the count parameter.
+func reportLength(p httprouter.Params) int {
+	count, err := strconv.Atoi(p.ByName("count"))
+	if err != nil || count < 1 {
+		return 10
+	}
+
+	return count
+}
+
+func (app *application) serveMostServed(stats *serveStats, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Most served report", stats.mostServed(reportLength(p)), errorChannel)
+	}
+}
+
+func (app *application) serveNeverServed(stats *serveStats, index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Never served report", stats.neverServed(index, reportLength(p)), errorChannel)
+	}
+}
+
+type indexStats struct {
+	Total       int            `json:"total"`
+	Extensions  map[string]int `json:"extensions"`
+	Directories map[string]int `json:"directories"`
+	LastScan    string         `json:"last_scan,omitempty"`
+	ScanLength  string         `json:"scan_duration,omitempty"`
+}
+
+func (index *fileIndex) stats(paths []string) *indexStats {
+	stats := &indexStats{
+		Extensions:  make(map[string]int),
+		Directories: make(map[string]int),
+	}
+
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	stats.Total = len(index.list)
+
+	for _, file := range index.list {
+		stats.Extensions[strings.ToLower(filepath.Ext(file))]++
+
+		for _, path := range paths {
+			if strings.HasPrefix(file, path) {
+				stats.Directories[path]++
+
+				break
+			}
+		}
+	}
+
+	if !index.scanTime.IsZero() {
+		stats.LastScan = index.scanTime.Format(logDate)
+		stats.ScanLength = index.scanLength.Round(time.Microsecond).String()
+	}
+
+	return stats
+}
+
+func (app *application) serveIndexStats(paths []string, index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Index stats", index.stats(paths), errorChannel)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	storyboardPrefix string = `/storyboard`
+
+	// Maximum number of thumbnails in a storyboard, and how many are
+	// placed in each row of the image
+	storyboardTiles   int = 100
+	storyboardColumns int = 10
+
+	// Dimensions of each thumbnail, in pixels
+	storyboardWidth  int = 160
+	storyboardHeight int = 90
+
+	storyboardTimeout time.Duration = 5 * time.Minute
+)
+
+// Returns the path component used to request the storyboard of the specified file.
+func (app *application) storyboardUri(path string) string {
+	if app.HashPaths {
+		return storyboardPrefix + hashedPrefix + hashPath(path)
+	}
+
+	return preparePath(storyboardPrefix, path)
+}
+
+// Returns the number of seconds between thumbnails, and the number of
+// thumbnails, for a video of the specified duration.
+func storyboardLayout(duration float64) (float64, int) {
+	interval := math.Max(1, math.Ceil(duration/float64(storyboardTiles)))
+
+	tiles := int(math.Ceil(duration / interval))
+
+	return interval, min(max(tiles, 1), storyboardTiles)
+}
+
+// Formats a number of seconds as a WebVTT timestamp.
+func vttTimestamp(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		int(d.Hours()),
+		int(d.Minutes())%60,
+		int(d.Seconds())%60,
+		d.Milliseconds()%1000)
+}
+
+// Returns a WebVTT track with a cue for each thumbnail, referring to its
+// region of the storyboard image.
+func storyboardVtt(duration float64, imageUri string) string {
+	interval, tiles := storyboardLayout(duration)
+
+	var vtt strings.Builder
+
+	vtt.WriteString("WEBVTT\n")
+
+	for i := range tiles {
+		start := float64(i) * interval
+		end := math.Min(start+interval, duration)
+
+		vtt.WriteString(fmt.Sprintf("\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start),
+			vttTimestamp(end),
+			imageUri,
+			(i%storyboardColumns)*storyboardWidth,
+			(i/storyboardColumns)*storyboardHeight,
+			storyboardWidth,
+			storyboardHeight))
+	}
+
+	return vtt.String()
+}
+
+// Returns a JPEG containing evenly spaced thumbnails of the video, laid
+// out in rows of storyboardColumns. Only keyframes are decoded, so each
+// thumbnail is taken from the nearest keyframe rather than the exact time.
+func generateStoryboard(ctx context.Context, path string, duration float64) ([]byte, error) {
+	interval, tiles := storyboardLayout(duration)
+
+	rows := (tiles + storyboardColumns - 1) / storyboardColumns
+
+	filter := fmt.Sprintf("fps=1/%g,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		interval,
+		storyboardWidth, storyboardHeight,
+		storyboardWidth, storyboardHeight,
+		storyboardColumns, rows)
+
+	ctx, cancel := context.WithTimeout(ctx, storyboardTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-loglevel", "error",
+		"-skip_frame", "nokey",
+		"-i", path,
+		"-vf", filter,
+		"-frames:v", "1",
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		"pipe:1",
+	)
+
+	var stderr strings.Builder
+
+	cmd.Stderr = &stderr
+
+	image, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return image, nil
+}
+
+// Returns the storyboard image of the video, generating it if it is not
+// already cached.
+func storyboardImage(ctx context.Context, path string, cache *artifactCache) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return cache.fetch(cacheStoryboard, cacheKey(cacheStoryboard, path, info), func() ([]byte, error) {
+		duration, err := mediaDuration(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return generateStoryboard(ctx, path, duration)
+	})
+}
+
+// Serves the WebVTT storyboard track of a video, or the image its cues
+// refer to if the image query parameter is present.
+func (app *application) serveStoryboard(paths []string, vhosts map[string]string, index *fileIndex, cache *artifactCache, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		path := p.ByName("media")
+
+		switch {
+		case app.HashPaths:
+			resolved, found := index.resolve(path)
+			if !found {
+				app.notFound(w, r, path)
+
+				return
+			}
+
+			path = resolved
+		case runtime.GOOS == "windows":
+			path = fromUrlPath(path)
+		}
+
+		path, err := filepath.EvalSymlinks(path)
+		if err != nil || !app.pathIsValid(path, app.servedPaths(r, paths, vhosts)) {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		var response []byte
+
+		if r.URL.Query().Has("image") {
+			response, err = storyboardImage(r.Context(), path, cache)
+			if err != nil {
+				errorChannel <- &fileProblem{path: path, err: err}
+
+				app.serverError(w, r, nil)
+
+				return
+			}
+
+			w.Header().Set("Content-Type", "image/jpeg")
+		} else {
+			duration, err := mediaDuration(path)
+			if err != nil || duration <= 0 {
+				app.notFound(w, r, path)
+
+				return
+			}
+
+			response = []byte(storyboardVtt(duration, app.Prefix+app.storyboardUri(path)+"?image"))
+
+			w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		written, err := w.Write(response)
+		if err != nil {
+			errorChannel <- err
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Storyboard of %s (%s) to %s in %s\n",
+				startTime.Format(logDate),
+				path,
+				app.humanReadableSize(written),
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+			)
+		}
+	}
+}
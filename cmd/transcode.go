@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	transcodePrefix string = `/transcode`
+)
+
+// Returns the path component used to request a transcoded copy of the specified file.
+func (app *application) transcodeUri(path string) string {
+	if app.HashPaths {
+		return transcodePrefix + hashedPrefix + hashPath(path)
+	}
+
+	return preparePath(transcodePrefix, path)
+}
+
+// Streams a copy of a video, re-encoded by ffmpeg into a fragmented MP4
+// which any browser supporting the video tag is able to play. If the
+// cache is on disk, the copy is saved as it is streamed, and served from
+// there (with support for seeking) on subsequent requests.
+func (app *application) serveTranscode(paths []string, vhosts map[string]string, index *fileIndex, cache *artifactCache, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		startTime := time.Now()
+
+		path := p.ByName("media")
+
+		switch {
+		case app.HashPaths:
+			resolved, found := index.resolve(path)
+			if !found {
+				app.notFound(w, r, path)
+
+				return
+			}
+
+			path = resolved
+		case runtime.GOOS == "windows":
+			path = fromUrlPath(path)
+		}
+
+		path, err := filepath.EvalSymlinks(path)
+		if err != nil || !app.pathIsValid(path, app.servedPaths(r, paths, vhosts)) {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		key := cacheKey(cacheTranscode, path, info)
+
+		w.Header().Set("Content-Type", "video/mp4")
+
+		cached := cache.open(cacheTranscode, key)
+		if cached != nil {
+			defer cached.Close()
+
+			http.ServeContent(w, r, "", time.Time{}, cached)
+
+			if app.verbose() {
+				fmt.Printf("%s | SERVE: Transcoded %s to %s in %s (cached)\n",
+					startTime.Format(logDate),
+					path,
+					requester(r),
+					time.Since(startTime).Round(time.Microsecond),
+				)
+			}
+
+			return
+		}
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		cmd := exec.CommandContext(r.Context(), "ffmpeg",
+			"-loglevel", "error",
+			"-i", path,
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-c:a", "aac",
+			"-movflags", "frag_keyframe+empty_moov",
+			"-f", "mp4",
+			"pipe:1",
+		)
+
+		var stderr strings.Builder
+
+		cmd.Stdout = w
+		cmd.Stderr = &stderr
+
+		writer := cache.create(cacheTranscode, key)
+		if writer != nil {
+			cmd.Stdout = io.MultiWriter(w, writer)
+		}
+
+		var status string
+
+		err = cmd.Run()
+
+		if writer != nil {
+			if err == nil && r.Context().Err() == nil {
+				cacheErr := writer.commit()
+				if cacheErr != nil {
+					errorChannel <- cacheErr
+				}
+			} else {
+				writer.abort()
+			}
+		}
+
+		switch {
+		case r.Context().Err() != nil || errors.Is(err, syscall.EPIPE):
+			status = " (incomplete)"
+		case err != nil:
+			errorChannel <- &fileProblem{path: path, err: fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))}
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Transcoded %s to %s in %s%s\n",
+				startTime.Format(logDate),
+				path,
+				requester(r),
+				time.Since(startTime).Round(time.Microsecond),
+				status,
+			)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Number of file transfers in progress to each client, by address.
+type transferLimiter struct {
+	app *application
+
+	mutex  sync.Mutex
+	active map[string]int
+}
+
+// Returns nil if --max-transfers is not set.
+func (app *application) newTransferLimiter() *transferLimiter {
+	if app.MaxTransfers == 0 {
+		return nil
+	}
+
+	return &transferLimiter{
+		app:    app,
+		active: make(map[string]int),
+	}
+}
+
+// Returns whether the client may start another transfer, recording it if so.
+func (limiter *transferLimiter) acquire(address string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.active[address] >= limiter.app.MaxTransfers {
+		return false
+	}
+
+	limiter.active[address]++
+
+	return true
+}
+
+func (limiter *transferLimiter) release(address string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.active[address]--
+
+	if limiter.active[address] <= 0 {
+		delete(limiter.active, address)
+	}
+}
+
+// Rejects requests from clients which already have --max-transfers
+// file transfers in progress, so that a single client can't tie up
+// a small server with many parallel streams.
+func (app *application) limitTransfers(limiter *transferLimiter, next httprouter.Handle) httprouter.Handle {
+	if limiter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if r.Method == http.MethodHead {
+			next(w, r, p)
+
+			return
+		}
+
+		address := app.clientAddress(r)
+
+		if !limiter.acquire(address) {
+			if app.verbose() {
+				fmt.Printf("%s | ERROR: Rejected request for %s from %s, with %d transfers already in progress\n",
+					time.Now().Format(logDate),
+					r.URL.Path,
+					requester(r),
+					app.MaxTransfers,
+				)
+			}
+
+			w.Header().Set("Retry-After", "1")
+
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+
+			return
+		}
+		defer limiter.release(address)
+
+		next(w, r, p)
+	}
+}
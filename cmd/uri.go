@@ -6,29 +6,134 @@ package cmd
 
 import (
 	"fmt"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/alecthomas/chroma/v2/styles"
+	"seedno.de/seednode/roulette/types"
 )
 
-func sortOrder(r *http.Request) string {
+func (app *application) sortOrder(r *http.Request) string {
 	sortOrder := r.URL.Query().Get("sort")
 	if sortOrder == "asc" || sortOrder == "desc" {
 		return sortOrder
 	}
 
+	// Navigating in index order requires the index
+	if sortOrder == archiveOrder && app.Index {
+		return sortOrder
+	}
+
 	return ""
 }
 
-func generateQueryParams(sortOrder, refreshInterval string) string {
+func highlightRange(r *http.Request) [][2]int {
+	var ranges [][2]int
+
+	for _, v := range strings.Split(r.URL.Query().Get("hl"), ",") {
+		start, end, isRange := strings.Cut(v, "-")
+		if !isRange {
+			end = start
+		}
+
+		first, err := strconv.Atoi(start)
+		if err != nil || first < 1 {
+			continue
+		}
+
+		last, err := strconv.Atoi(end)
+		if err != nil || last < first {
+			continue
+		}
+
+		ranges = append(ranges, [2]int{first, last})
+	}
+
+	return ranges
+}
+
+func (app *application) codeTheme(r *http.Request) string {
+	theme := r.URL.Query().Get("theme")
+	if slices.Contains(styles.Names(), theme) {
+		return theme
+	}
+
+	return app.settings().CodeTheme
+}
+
+// Returns the hints sent by the client, if any, about how the page will be displayed.
+func clientHints(r *http.Request) types.ClientHints {
+	width, err := strconv.Atoi(r.Header.Get("Viewport-Width"))
+	if err != nil || width < 0 {
+		width = 0
+	}
+
+	return types.ClientHints{
+		SaveData:      strings.EqualFold(r.Header.Get("Save-Data"), "on"),
+		ViewportWidth: width,
+	}
+}
+
+// State used to produce a reproducible sequence of random selections.
+// The step is incremented after each selection, and passed along in the
+// query parameters so that the following selection continues the sequence.
+type randomSeed struct {
+	enabled bool
+	seed    uint64
+	step    uint64
+}
+
+func (app *application) seedParams(r *http.Request) randomSeed {
+	query := r.URL.Query()
+
+	seed, err := strconv.ParseUint(query.Get("seed"), 10, 64)
+	if err != nil {
+		if app.Seed == 0 {
+			return randomSeed{}
+		}
+
+		seed = app.Seed
+	}
+
+	step, err := strconv.ParseUint(query.Get("step"), 10, 64)
+	if err != nil {
+		step = 0
+	}
+
+	return randomSeed{enabled: true, seed: seed, step: step}
+}
+
+func (s randomSeed) next() randomSeed {
+	if s.enabled {
+		s.step++
+	}
+
+	return s
+}
+
+func (s randomSeed) source() *rand.Rand {
+	if !s.enabled {
+		return rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+
+	return rand.New(rand.NewPCG(s.seed, s.step))
+}
+
+func (app *application) generateQueryParams(sortOrder, refreshInterval string, seed randomSeed, play playback, collection, mount string) string {
 	var hasParams bool
 
 	var queryParams strings.Builder
 
 	queryParams.WriteString("?")
 
-	if Sorting {
+	if app.Sorting {
 		if hasParams {
 			queryParams.WriteString("&")
 		}
@@ -38,7 +143,7 @@ func generateQueryParams(sortOrder, refreshInterval string) string {
 		hasParams = true
 	}
 
-	if Refresh {
+	if app.Refresh && refreshInterval != "" {
 		if hasParams {
 			queryParams.WriteString("&")
 		}
@@ -47,6 +152,43 @@ func generateQueryParams(sortOrder, refreshInterval string) string {
 		hasParams = true
 	}
 
+	if seed.enabled {
+		if hasParams {
+			queryParams.WriteString("&")
+		}
+		queryParams.WriteString(fmt.Sprintf("seed=%d&step=%d", seed.seed, seed.step))
+
+		hasParams = true
+	}
+
+	params := play.params()
+	if params != "" {
+		if hasParams {
+			queryParams.WriteString("&")
+		}
+		queryParams.WriteString(params)
+
+		hasParams = true
+	}
+
+	if collection != "" {
+		if hasParams {
+			queryParams.WriteString("&")
+		}
+		queryParams.WriteString(fmt.Sprintf("collection=%s", collection))
+
+		hasParams = true
+	}
+
+	if mount != "" {
+		if hasParams {
+			queryParams.WriteString("&")
+		}
+		queryParams.WriteString(fmt.Sprintf("mount=%s", mount))
+
+		hasParams = true
+	}
+
 	if hasParams {
 		return queryParams.String()
 	}
@@ -74,18 +216,63 @@ func stripQueryParams(request string) (string, error) {
 	return escapedUri, nil
 }
 
-func generateFileUri(path string) string {
+func (app *application) generateFileUri(path string) string {
+	if app.HashPaths {
+		return sourcePrefix + hashedPrefix + hashPath(path)
+	}
+
 	var uri strings.Builder
 
 	uri.WriteString(sourcePrefix)
-	if runtime.GOOS == "windows" {
-		uri.WriteString(`/`)
-	}
-	uri.WriteString(path)
+	uri.WriteString(urlPath(path))
 
 	return uri.String()
 }
 
+// Stands in for the leading \\ of UNC paths (e.g. \\server\share) in URLs,
+// as consecutive slashes are collapsed by browsers and routers alike.
+const uncPrefix string = "UNC/"
+
+// Converts a path to the form used in URLs. On Windows, separators are
+// replaced with slashes, and a slash is prepended before the drive letter
+// or UNC prefix.
+func urlPath(path string) string {
+	if runtime.GOOS != "windows" {
+		return path
+	}
+
+	path = filepath.ToSlash(path)
+
+	share, found := strings.CutPrefix(path, "//")
+	if found {
+		path = uncPrefix + share
+	}
+
+	return "/" + path
+}
+
+// Converts a path from the form used in URLs back into a native path.
+func fromUrlPath(path string) string {
+	if runtime.GOOS != "windows" {
+		return path
+	}
+
+	path = strings.TrimPrefix(path, "/")
+
+	share, found := strings.CutPrefix(path, uncPrefix)
+	if found {
+		path = "//" + share
+	}
+
+	return filepath.FromSlash(path)
+}
+
+// Escapes a path for use in a URL, so that characters such as ? and #
+// in filenames are not treated as delimiters.
+func escapePath(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
 func refererToUri(referer string) string {
 	parts := strings.SplitAfterN(referer, "/", 4)
 
@@ -117,3 +304,90 @@ func realIP(r *http.Request) string {
 		return r.RemoteAddr
 	}
 }
+
+func validUrl(u string) bool {
+	if u == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+func validTrustedProxies(proxies []string) bool {
+	for _, proxy := range proxies {
+		_, _, err := net.ParseCIDR(proxy)
+		if err != nil && net.ParseIP(proxy) == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reports whether the request was received directly from one of the
+// addresses or networks specified via --trusted-proxy.
+func (app *application) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range app.TrustedProxies {
+		_, network, err := net.ParseCIDR(proxy)
+		switch {
+		case err == nil && network.Contains(ip):
+			return true
+		case err != nil && ip.Equal(net.ParseIP(proxy)):
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the externally visible URL of the root path, used as the base for
+// all redirects. This is --base-url if provided, otherwise it is derived from
+// the request, honoring X-Forwarded-Proto and X-Forwarded-Host if the request
+// was received from a trusted proxy.
+func (app *application) rootUrl(r *http.Request) string {
+	if app.BaseUrl != "" {
+		return strings.TrimSuffix(app.BaseUrl, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if app.fromTrustedProxy(r) {
+		proto := r.Header.Get("X-Forwarded-Proto")
+		if proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, app.requestHost(r), app.Prefix)
+}
+
+// Returns the host the request was made to, honoring X-Forwarded-Host
+// if the request was received from a trusted proxy.
+func (app *application) requestHost(r *http.Request) string {
+	if app.fromTrustedProxy(r) {
+		forwardedHost := r.Header.Get("X-Forwarded-Host")
+		if forwardedHost != "" {
+			return forwardedHost
+		}
+	}
+
+	return r.Host
+}
@@ -0,0 +1,353 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/spf13/cobra"
+	"seedno.de/seednode/roulette/types"
+	"seedno.de/seednode/roulette/types/video"
+)
+
+// Progress of pre-generating the cached artifacts of each file.
+type warmProgress struct {
+	Running   bool   `json:"running"`
+	Total     int    `json:"total"`
+	Done      int    `json:"done"`
+	Generated int    `json:"generated"`
+	Cached    int    `json:"cached"`
+	Failed    int    `json:"failed"`
+	Started   string `json:"started,omitempty"`
+	Finished  string `json:"finished,omitempty"`
+}
+
+type warmer struct {
+	app *application
+
+	mutex    sync.Mutex
+	progress warmProgress
+}
+
+// Returns the kinds of cached artifact which are derived from the file.
+func (app *application) warmKinds(path string, formats types.Types) []string {
+	var kinds []string
+
+	if app.stripsMetadata(path) {
+		kinds = append(kinds, cacheStripped)
+	}
+
+	if _, isVideo := formats.FileType(path).(video.Format); app.Storyboards && isVideo {
+		kinds = append(kinds, cacheStoryboard)
+	}
+
+	return kinds
+}
+
+// Generates an artifact of the file, unless it is already cached.
+// Returns whether it was generated.
+func warmArtifact(ctx context.Context, path, kind string, cache *artifactCache) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	if cache.contains(cacheKey(kind, path, info)) {
+		return false, nil
+	}
+
+	switch kind {
+	case cacheStripped:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = cache.fetch(kind, cacheKey(kind, path, info), func() ([]byte, error) {
+			return stripMetadata(path, data)
+		})
+		if err != nil {
+			return false, err
+		}
+	case cacheStoryboard:
+		_, err = storyboardImage(ctx, path, cache)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Generates the missing artifacts of each file, using up to WarmWorkers
+// workers at a time, until done or the context is canceled.
+func (warm *warmer) run(ctx context.Context, list []string, cache *artifactCache, formats types.Types, errorChannel chan<- error) warmProgress {
+	paths := make(chan string)
+
+	var wg sync.WaitGroup
+
+	for range warm.app.WarmWorkers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for path := range paths {
+				var generated, cached, failed int
+
+				for _, kind := range warm.app.warmKinds(path, formats) {
+					created, err := warmArtifact(ctx, path, kind, cache)
+
+					switch {
+					case err != nil:
+						failed++
+
+						errorChannel <- &fileProblem{path: path, err: err}
+					case created:
+						generated++
+
+						if warm.app.verbose() {
+							fmt.Printf("%s | WARM: Generated %s of %s\n",
+								time.Now().Format(logDate),
+								kind,
+								path)
+						}
+					default:
+						cached++
+					}
+				}
+
+				warm.mutex.Lock()
+				warm.progress.Done++
+				warm.progress.Generated += generated
+				warm.progress.Cached += cached
+				warm.progress.Failed += failed
+				warm.mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, path := range list {
+		if ctx.Err() != nil {
+			break
+		}
+
+		paths <- path
+	}
+
+	close(paths)
+
+	wg.Wait()
+
+	warm.mutex.Lock()
+	warm.progress.Running = false
+	warm.progress.Finished = time.Now().Format(time.RFC3339)
+	progress := warm.progress
+	warm.mutex.Unlock()
+
+	return progress
+}
+
+func (progress warmProgress) summary() string {
+	return fmt.Sprintf("Generated %d artifacts (%d already cached, %d failed) for %d/%d files",
+		progress.Generated,
+		progress.Cached,
+		progress.Failed,
+		progress.Done,
+		progress.Total)
+}
+
+// Resets the progress for a run over the specified number of files,
+// unless one is already running. Returns whether it was reset.
+func (warm *warmer) begin(total int) bool {
+	warm.mutex.Lock()
+	defer warm.mutex.Unlock()
+
+	if warm.progress.Running {
+		return false
+	}
+
+	warm.progress = warmProgress{
+		Running: true,
+		Total:   total,
+		Started: time.Now().Format(time.RFC3339),
+	}
+
+	return true
+}
+
+// Starts warming the cache in the background, unless already running.
+// Returns whether it was started.
+func (warm *warmer) start(ctx context.Context, index *fileIndex, cache *artifactCache, formats types.Types, errorChannel chan<- error) bool {
+	index.mutex.RLock()
+	list := make([]string, len(index.list))
+	copy(list, index.list)
+	index.mutex.RUnlock()
+
+	if !warm.begin(len(list)) {
+		return false
+	}
+
+	startTime := time.Now()
+
+	go func() {
+		progress := warm.run(ctx, list, cache, formats, errorChannel)
+
+		if warm.app.verbose() {
+			fmt.Printf("%s | WARM: %s in %s\n",
+				time.Now().Format(logDate),
+				progress.summary(),
+				time.Since(startTime).Round(time.Microsecond))
+		}
+	}()
+
+	return true
+}
+
+func (warm *warmer) status() warmProgress {
+	warm.mutex.Lock()
+	defer warm.mutex.Unlock()
+
+	return warm.progress
+}
+
+func (app *application) serveWarmProgress(warm *warmer, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		app.serveJson(w, r, "Cache warming progress", warm.status(), errorChannel)
+	}
+}
+
+func (app *application) serveWarm(ctx context.Context, warm *warmer, index *fileIndex, cache *artifactCache, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !warm.start(ctx, index, cache, formats, errorChannel) {
+			http.Error(w, "Cache warming is already running", http.StatusConflict)
+
+			return
+		}
+
+		if app.verbose() {
+			fmt.Printf("%s | SERVE: Cache warming requested by %s\n",
+				time.Now().Format(logDate),
+				requester(r))
+		}
+
+		app.serveJson(w, r, "Cache warming progress", warm.status(), errorChannel)
+	}
+}
+
+// Generates the cached artifacts (stripped images and storyboards) of
+// the supported files within the configured paths, so that they are
+// ready before first being requested. Artifacts which are already cached
+// are skipped, so an interrupted run resumes where it left off.
+//
+// Requires a cache directory, shared with the servers which use it.
+func (s *Server) Warm(ctx context.Context) error {
+	app, err := newApplication(s.config)
+	if err != nil {
+		return err
+	}
+
+	return app.warm(ctx, s.formats)
+}
+
+func (app *application) warm(ctx context.Context, extra []types.Type) error {
+	err := app.applyStateDir()
+	if err != nil {
+		return err
+	}
+
+	if app.CacheDir == "" || !(app.StripMetadata || app.Storyboards) {
+		return ErrInvalidWarm
+	}
+
+	if app.Storyboards {
+		_, err = exec.LookPath("ffmpeg")
+		if err != nil || ffprobe() == "" {
+			return ErrMissingStoryboard
+		}
+	}
+
+	formats, err := app.enabledFormats(extra)
+	if err != nil {
+		return err
+	}
+
+	list, scanErr := app.scan(ctx, formats)
+	if list == nil && scanErr != nil {
+		return scanErr
+	}
+
+	cache, err := app.newArtifactCache()
+	if err != nil {
+		return err
+	}
+
+	errorChannel := make(chan error)
+
+	var errs []error
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for err := range errorChannel {
+			if !ignorable(err) {
+				errs = append(errs, err)
+			}
+		}
+	}()
+
+	startTime := time.Now()
+
+	warm := &warmer{app: app}
+
+	warm.begin(len(list))
+
+	progress := warm.run(ctx, list, cache, formats, errorChannel)
+
+	close(errorChannel)
+
+	<-done
+
+	fmt.Printf("%s | WARM: %s in %s\n",
+		time.Now().Format(logDate),
+		progress.summary(),
+		time.Since(startTime).Round(time.Microsecond))
+
+	return errors.Join(append(errs, scanErr)...)
+}
+
+func newWarmCommand() *cobra.Command {
+	var cfg Config
+
+	warmCmd := &cobra.Command{
+		Use:   "warm [path]...",
+		Short: "Generates cached stripped images and storyboards ahead of time.",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg.Paths = args
+
+			server, err := New(cfg)
+			if err != nil {
+				return err
+			}
+
+			return server.Warm(context.Background())
+		},
+	}
+
+	registerFlags(warmCmd.Flags(), &cfg)
+
+	return warmCmd
+}
@@ -5,22 +5,28 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/spf13/pflag"
 	"seedno.de/seednode/roulette/types"
 	"seedno.de/seednode/roulette/types/audio"
 	"seedno.de/seednode/roulette/types/code"
@@ -32,10 +38,15 @@ import (
 
 const (
 	logDate            string        = `2006-01-02T15:04:05.000-07:00`
+	siblingPrefix      string        = `/sibling`
 	sourcePrefix       string        = `/source`
 	mediaPrefix        string        = `/view`
 	redirectStatusCode int           = http.StatusSeeOther
 	timeout            time.Duration = 10 * time.Second
+
+	// Number of files selected in place of ones which fail validation,
+	// before giving up and serving the last one selected
+	selectionAttempts int = 10
 )
 
 func newPage(title, body string) string {
@@ -51,9 +62,15 @@ func newPage(title, body string) string {
 	return htmlBody.String()
 }
 
-func serveStaticFile(paths []string, index *fileIndex, errorChannel chan<- error) httprouter.Handle {
+func (app *application) serveStaticFile(paths []string, vhosts map[string]string, formats types.Types, index *fileIndex, cache *artifactCache, notify *notifier, errorChannel chan<- error) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		prefix := Prefix + sourcePrefix
+		if app.hotlinked(r) {
+			app.rejectHotlink(w, r)
+
+			return
+		}
+
+		prefix := app.Prefix + sourcePrefix
 
 		path := strings.TrimPrefix(r.URL.Path, prefix)
 
@@ -61,22 +78,43 @@ func serveStaticFile(paths []string, index *fileIndex, errorChannel chan<- error
 		if err != nil {
 			errorChannel <- err
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
 
+		switch {
+		case app.HashPaths:
+			resolved, found := index.resolve("/" + strings.TrimPrefix(prefixedFilePath, "/"))
+			if !found {
+				app.notFound(w, r, prefixedFilePath)
+
+				return
+			}
+
+			prefixedFilePath = resolved
+		case runtime.GOOS == "windows":
+			prefixedFilePath = fromUrlPath(prefixedFilePath)
+		}
+
 		filePath, err := filepath.EvalSymlinks(strings.TrimPrefix(prefixedFilePath, prefix))
+		if errors.Is(err, os.ErrNotExist) {
+			app.removeVanished(r, strings.TrimPrefix(prefixedFilePath, prefix), index, errorChannel)
+
+			app.notFound(w, r, prefixedFilePath)
+
+			return
+		}
 		if err != nil {
 			errorChannel <- err
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
 
-		if !pathIsValid(filePath, paths) {
-			notFound(w, r, filePath)
+		if !app.pathIsValid(filePath, app.servedPaths(r, paths, vhosts)) {
+			app.notFound(w, r, filePath)
 
 			return
 		}
@@ -85,24 +123,95 @@ func serveStaticFile(paths []string, index *fileIndex, errorChannel chan<- error
 		if err != nil {
 			errorChannel <- err
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
 		if !exists {
-			notFound(w, r, filePath)
+			app.removeVanished(r, filePath, index, errorChannel)
+
+			app.notFound(w, r, filePath)
 
 			return
 		}
 
 		startTime := time.Now()
 
+		strip := app.stripsMetadata(filePath)
+
+		if app.HashContents {
+			etag := index.etag(filePath)
+			if etag != "" {
+				// The stripped copy differs from the file on disk
+				if strip {
+					etag = strings.TrimSuffix(etag, `"`) + `-stripped"`
+				}
+
+				w.Header().Set("ETag", etag)
+
+				if etagMatches(r.Header.Get("If-None-Match"), etag) {
+					w.WriteHeader(http.StatusNotModified)
+
+					if app.verbose() {
+						fmt.Printf("%s | SERVE: %s (not modified) to %s in %s\n",
+							startTime.Format(logDate),
+							filePath,
+							requester(r),
+							time.Since(startTime).Round(time.Microsecond),
+						)
+					}
+
+					return
+				}
+			}
+		}
+
+		if r.Method == http.MethodHead && !strip {
+			err = app.serveStaticHead(w, filePath, formats)
+			if err != nil {
+				errorChannel <- err
+
+				app.serverError(w, r, nil)
+			}
+
+			return
+		}
+
 		buf, err := os.ReadFile(filePath)
 		if err != nil {
 			errorChannel <- err
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
+
+			return
+		}
+
+		if strip {
+			info, err := os.Stat(filePath)
+			if err != nil {
+				errorChannel <- err
+
+				app.serverError(w, r, nil)
+
+				return
+			}
+
+			buf, err = cache.fetch(cacheStripped, cacheKey(cacheStripped, filePath, info), func() ([]byte, error) {
+				return stripMetadata(filePath, buf)
+			})
+			if err != nil {
+				errorChannel <- &fileProblem{path: filePath, err: err}
+
+				app.serverError(w, r, nil)
 
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", app.contentType(filePath, formats, buf))
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+
+		if r.Method == http.MethodHead {
 			return
 		}
 
@@ -115,7 +224,7 @@ func serveStaticFile(paths []string, index *fileIndex, errorChannel chan<- error
 		case err != nil:
 			errorChannel <- err
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
@@ -124,28 +233,28 @@ func serveStaticFile(paths []string, index *fileIndex, errorChannel chan<- error
 		if err != nil {
 			errorChannel <- err
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
 
-		if Russian && refererUri != "" {
-			err = kill(filePath, index)
+		if app.Russian && refererUri != "" {
+			err = app.kill(filePath, index, notify)
 			if err != nil {
 				errorChannel <- err
 
-				serverError(w, r, nil)
+				app.serverError(w, r, nil)
 
 				return
 			}
 		}
 
-		if Verbose {
+		if app.verbose() {
 			fmt.Printf("%s | SERVE: %s (%s) to %s in %s%s\n",
 				startTime.Format(logDate),
 				filePath,
-				humanReadableSize(written),
-				realIP(r),
+				app.humanReadableSize(written),
+				requester(r),
 				time.Since(startTime).Round(time.Microsecond),
 				status,
 			)
@@ -153,37 +262,149 @@ func serveStaticFile(paths []string, index *fileIndex, errorChannel chan<- error
 	}
 }
 
-func serveRoot(paths []string, index *fileIndex, filename *regexp.Regexp, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+// Removes an indexed file which no longer exists (e.g. deleted by another
+// program) from the index. Returns false if the file was not indexed.
+func (app *application) removeVanished(r *http.Request, path string, index *fileIndex, errorChannel chan<- error) bool {
+	if !app.Index || !index.contains(path) {
+		return false
+	}
+
+	index.remove(path)
+
+	err := app.sharedIndex.remove(path)
+	if err != nil {
+		errorChannel <- err
+	}
+
+	if app.verbose() {
+		fmt.Printf("%s | INDEX: Removed vanished file %s requested by %s\n",
+			time.Now().Format(logDate),
+			path,
+			requester(r),
+		)
+	}
+
+	return true
+}
+
+// Removes a vanished file from the index, as with removeVanished, and
+// redirects its view page to a new selection in its place. Returns false,
+// without responding, if the file was not indexed.
+func (app *application) redirectVanished(w http.ResponseWriter, r *http.Request, path string, index *fileIndex, errorChannel chan<- error) bool {
+	if !app.removeVanished(r, path, index, errorChannel) {
+		return false
+	}
+
+	queryParams := app.generateQueryParams(app.sortOrder(r), app.refreshParam(r), app.seedParams(r), playbackParams(r), app.collectionParam(r), app.mountParam(r))
+
+	http.Redirect(w, r, app.rootUrl(r)+app.mountParam(r)+"/"+queryParams, redirectStatusCode)
+
+	return true
+}
+
+func (app *application) serveRoot(paths []string, within, mount string, vhosts map[string]string, index *fileIndex, stats *serveStats, filename *regexp.Regexp, formats types.Types, errorChannel chan<- error) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		refererUri, err := stripQueryParams(refererToUri(r.Referer()))
 		if err != nil {
 			errorChannel <- err
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
 
-		strippedRefererUri := strings.TrimPrefix(refererUri, Prefix+mediaPrefix)
+		strippedRefererUri := strings.TrimPrefix(refererUri, app.Prefix+mediaPrefix)
+
+		if app.HashPaths {
+			strippedRefererUri, _ = index.resolve(strippedRefererUri)
+		}
+
+		sortOrder := app.sortOrder(r)
+
+		collection := app.collectionParam(r)
+
+		// Collections are selected from at random, regardless of sorting
+		if collection != "" {
+			refererUri = ""
+			sortOrder = ""
+		}
 
-		sortOrder := sortOrder(r)
+		refreshInterval := app.refreshParam(r)
 
-		_, refreshInterval := refreshInterval(r)
+		scope := within
+		if scope == "" {
+			scope = app.vhostPath(r, vhosts)
+		}
 
 		var path string
 
-		if refererUri != "" {
+		// Files from listed URLs have no position to continue from
+		if strings.HasPrefix(refererUri, app.Prefix+remotePrefix) {
+			refererUri = ""
+		}
+
+		switch {
+		case refererUri != "" && sortOrder == archiveOrder:
+			path = index.adjacent(strippedRefererUri, scope, 1)
+		case refererUri != "":
 			path, err = nextFile(strippedRefererUri, sortOrder, filename, formats)
 			if err != nil {
 				errorChannel <- err
 
-				serverError(w, r, nil)
+				app.serverError(w, r, nil)
 
 				return
 			}
 		}
 
-		list := fileList(paths, index, formats, errorChannel)
+		seed := app.seedParams(r)
+
+		rng := seed.source()
+
+		scope, shared := app.shareScope(r, scope, paths, vhosts, rng)
+		if !shared {
+			app.notFound(w, r, within)
+
+			return
+		}
+
+		// Sorting may otherwise continue past the end of a shared path
+		if path != "" && !app.pathIsValid(path, app.servedPaths(r, paths, vhosts)) {
+			path = ""
+		}
+
+		var list []string
+
+		if collection != "" {
+			var found bool
+
+			list, found = app.collections.available(r, collection, scope, paths, vhosts)
+			if !found {
+				app.notFound(w, r, collection)
+
+				return
+			}
+		} else {
+			list = app.freshFileList(r.Context(), paths, scope, index, stats, rng, formats, errorChannel)
+		}
+
+		if path == "" && scope == "" && collection == "" {
+			u := app.remoteFiles.pick(len(list), rng)
+			if u != "" {
+				queryParams := app.generateQueryParams(sortOrder, refreshInterval, seed.next(), playbackParams(r), collection, mount)
+
+				newUrl := fmt.Sprintf("%s%s%s",
+					app.rootUrl(r),
+					remoteUri(u),
+					strings.Replace(queryParams, "?", "&", 1),
+				)
+				http.Redirect(w, r, newUrl, redirectStatusCode)
+
+				return
+			}
+		}
+
+		var rerolls int
 
 	loop:
 		for timeout := time.After(timeout); ; {
@@ -197,7 +418,7 @@ func serveRoot(paths []string, index *fileIndex, filename *regexp.Regexp, format
 				break loop
 			}
 
-			path, err = newFile(list, sortOrder, filename, formats)
+			path, err = app.newFile(list, stats, rng, sortOrder, filename, formats)
 			switch {
 			case path == "":
 				startTime := time.Now()
@@ -206,85 +427,112 @@ func serveRoot(paths []string, index *fileIndex, filename *regexp.Regexp, format
 
 				w.Write([]byte("No files found in the specified path(s).\n"))
 
-				if Verbose {
+				if app.verbose() {
 					fmt.Printf("%s | SERVE: Empty path notification to %s\n",
 						startTime.Format(logDate),
-						r.RemoteAddr,
+						requester(r),
 					)
 				}
 
 				return
 			case err != nil && err == ErrNoMediaFound:
-				notFound(w, r, path)
+				app.notFound(w, r, path)
 
 				return
 			case err != nil:
 				errorChannel <- err
 
-				serverError(w, r, nil)
+				app.serverError(w, r, nil)
 
 				return
 			}
+
+			// Selects another file in place of one which would fail to display
+			if rerolls < selectionAttempts && !app.displayable(path, formats, errorChannel) {
+				rerolls++
+
+				path = ""
+			}
 		}
 
-		queryParams := generateQueryParams(sortOrder, refreshInterval)
+		queryParams := app.generateQueryParams(sortOrder, refreshInterval, seed.next(), playbackParams(r), collection, mount)
 
-		newUrl := fmt.Sprintf("http://%s%s%s%s",
-			r.Host,
-			Prefix,
-			preparePath(mediaPrefix, path),
+		newUrl := fmt.Sprintf("%s%s%s",
+			app.rootUrl(r),
+			app.mediaUri(path),
 			queryParams,
 		)
 		http.Redirect(w, r, newUrl, redirectStatusCode)
 	}
 }
 
-func serveMedia(index *fileIndex, filename *regexp.Regexp, formats types.Types, errorChannel chan<- error) httprouter.Handle {
+func (app *application) serveMedia(paths []string, vhosts map[string]string, index *fileIndex, stats *serveStats, notify *notifier, filename *regexp.Regexp, formats types.Types, errorChannel chan<- error) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		startTime := time.Now()
 
-		sortOrder := sortOrder(r)
+		sortOrder := app.sortOrder(r)
+
+		path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, app.Prefix), mediaPrefix)
+
+		switch {
+		case app.HashPaths:
+			resolved, found := index.resolve(path)
+			if !found {
+				app.notFound(w, r, path)
 
-		path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, Prefix), mediaPrefix)
+				return
+			}
 
-		if runtime.GOOS == "windows" {
-			path = strings.TrimPrefix(path, "/")
+			path = resolved
+		case runtime.GOOS == "windows":
+			path = fromUrlPath(path)
 		}
 
 		exists, err := fileExists(path)
 		if err != nil {
 			errorChannel <- err
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
 		if !exists {
-			notFound(w, r, path)
+			if !app.redirectVanished(w, r, path, index, errorChannel) {
+				app.notFound(w, r, path)
+			}
+
+			return
+		}
+
+		within := app.vhostPath(r, vhosts)
+
+		// Sniffing would otherwise render any readable file on the host
+		if !app.pathIsValid(path, app.servedPaths(r, paths, vhosts)) {
+			app.notFound(w, r, path)
 
 			return
 		}
 
-		format := formats.FileType(path)
+		format, extension := app.detectFormat(path, formats)
+
 		if format == nil {
-			if Fallback {
+			if app.Fallback {
 				w.Header().Add("Content-Type", "application/octet-stream")
 
-				_, refreshInterval := refreshInterval(r)
+				refreshInterval := app.refreshParam(r)
 
 				// redirect to static url for file
-				newUrl := fmt.Sprintf("http://%s%s%s%s",
-					r.Host,
-					Prefix,
-					preparePath(sourcePrefix, path),
-					generateQueryParams(sortOrder, refreshInterval),
+				newUrl := fmt.Sprintf("%s%s%s",
+					app.rootUrl(r),
+					app.generateFileUri(path),
+					app.generateQueryParams(sortOrder, refreshInterval, app.seedParams(r), playbackParams(r), app.collectionParam(r), app.mountParam(r)),
 				)
 
 				http.Redirect(w, r, newUrl, redirectStatusCode)
 
 				return
 			} else {
-				notFound(w, r, path)
+				app.notFound(w, r, path)
 
 				return
 
@@ -292,35 +540,96 @@ func serveMedia(index *fileIndex, filename *regexp.Regexp, formats types.Types,
 		}
 
 		if !format.Validate(path) {
-			notFound(w, r, path)
+			errorChannel <- &fileProblem{path: path, err: ErrFailedValidation}
+
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		nonce, err := newNonce()
+		if err != nil {
+			errorChannel <- err
+
+			app.serverError(w, r, nil)
 
 			return
 		}
 
-		mediaType := format.MediaType(filepath.Ext(path))
+		switch f := format.(type) {
+		case audio.Format:
+			if readAlbumArt(path) != nil {
+				f.ArtUri = app.Prefix + app.artUri(path)
+			}
+
+			format = f
+		case code.Format:
+			f.Highlight = highlightRange(r)
+			f.Theme = app.codeTheme(r)
+
+			format = f
+		case images.Format:
+			f.NoButtons = app.settings().NoButtons
+			f.Caption = readCaption(path)
+
+			format = f
+		case video.Format:
+			f.Caption = readCaption(path)
+
+			if app.Storyboards {
+				f.StoryboardUri = app.Prefix + app.storyboardUri(path)
+			}
+
+			if app.Transcode {
+				f.TranscodeUri = app.Prefix + app.transcodeUri(path)
+			}
+
+			format = f
+		}
+
+		mediaType := format.MediaType(extension)
 
-		fileUri := Prefix + generateFileUri(path)
+		fileUri := app.Prefix + app.generateFileUri(path)
 
 		fileName := filepath.Base(path)
 
 		w.Header().Add("Content-Type", "text/html")
 
-		refreshTimer, refreshInterval := refreshInterval(r)
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy(nonce, format))
 
-		queryParams := generateQueryParams(sortOrder, refreshInterval)
+		refreshTimer, refreshInterval := app.refreshInterval(r, format)
 
-		rootUrl := Prefix + "/" + queryParams
+		queryParams := app.generateQueryParams(sortOrder, app.refreshParam(r), app.seedParams(r), playbackParams(r), app.collectionParam(r), app.mountParam(r))
+
+		rootUrl := app.Prefix + app.mountParam(r) + "/" + queryParams
+
+		play := playbackParams(r)
+
+		opts := types.Options{
+			RootUrl:   rootUrl,
+			FileUri:   fileUri,
+			FilePath:  path,
+			FileName:  fileName,
+			Prefix:    app.Prefix,
+			MediaType: mediaType,
+			Theme:     app.codeTheme(r),
+			Nonce:     nonce,
+			Autoplay:  play.autoplay,
+			Loop:      play.loop,
+			Muted:     play.muted,
+			Hints:     clientHints(r),
+		}
 
 		var htmlBody strings.Builder
 		htmlBody.WriteString(`<!DOCTYPE html><html class="bg" lang="en"><head>`)
 		htmlBody.WriteString(getFavicon())
 		htmlBody.WriteString(fmt.Sprintf(`<style>%s</style>`, format.CSS()))
 
-		title, err := format.Title(rootUrl, fileUri, path, fileName, Prefix, mediaType)
+		title, err := format.Title(r.Context(), opts)
 		if err != nil {
-			errorChannel <- err
+			errorChannel <- &fileProblem{path: path, err: err}
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
@@ -329,70 +638,121 @@ func serveMedia(index *fileIndex, filename *regexp.Regexp, formats types.Types,
 
 		var first, last string
 
-		if Index && sortOrder != "" {
-			first, last, err = getRange(path, index, filename)
-			if err != nil {
-				errorChannel <- err
+		if app.Index && sortOrder != "" && sortOrder != archiveOrder {
+			first, last = getRange(path, index)
+		}
 
-				serverError(w, r, nil)
+		if app.Index && !app.settings().NoButtons {
+			htmlBody.WriteString(`<table><tr><td>`)
 
-				return
+			switch {
+			case sortOrder == archiveOrder:
+				htmlBody.WriteString(app.archivePaginate(path, within, queryParams, index))
+			case sortOrder != "":
+				paginated, err := app.paginate(path, first, last, queryParams, filename, formats)
+				if err != nil {
+					errorChannel <- err
+
+					app.serverError(w, r, nil)
+
+					return
+				}
+
+				htmlBody.WriteString(paginated)
 			}
-		}
 
-		if Index && !NoButtons && sortOrder != "" {
-			paginated, err := paginate(path, first, last, queryParams, filename, formats)
-			if err != nil {
-				errorChannel <- err
+			htmlBody.WriteString(app.siblingButton(path, queryParams, index))
 
-				serverError(w, r, nil)
+			if app.Zip {
+				htmlBody.WriteString(app.zipButton(path))
+			}
 
-				return
+			if app.Collections && app.AdminToken != "" && !app.ReadOnly {
+				htmlBody.WriteString(app.collectionForm(path))
 			}
 
-			htmlBody.WriteString(paginated)
+			htmlBody.WriteString(`</td></tr></table>`)
+
+			htmlBody.WriteString(buttonScript(nonce))
+
+			if app.Collections && app.AdminToken != "" && !app.ReadOnly {
+				htmlBody.WriteString(collectionScript(nonce))
+			}
 		}
 
 		if refreshInterval != "0ms" {
-			htmlBody.WriteString(refreshFunction(rootUrl, refreshTimer))
+			htmlBody.WriteString(refreshFunction(rootUrl, refreshTimer, nonce))
 		}
 
-		body, err := format.Body(rootUrl, fileUri, path, fileName, Prefix, mediaType)
+		body, err := format.Body(r.Context(), opts)
 		if err != nil {
-			errorChannel <- err
+			errorChannel <- &fileProblem{path: path, err: err}
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
 		htmlBody.WriteString(body)
 
+		switch format.Name() {
+		case "flash", "images", "video":
+			htmlBody.WriteString(fullscreenButton(nonce))
+		}
+
+		if app.ShowLocation && format.Name() == "images" {
+			htmlBody.WriteString(locationLink(path, errorChannel))
+		}
+
+		if app.Similar && format.Name() == "images" {
+			htmlBody.WriteString(app.similarStrip(path, queryParams, index))
+		}
+
 		htmlBody.WriteString(`</body></html>`)
 
-		formattedPage := htmlBody.String()
+		formattedPage := htmlBody.String() + "\n"
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(formattedPage)))
+
+		// HEAD requests receive the headers alone, and do not count as serving the file
+		if r.Method == http.MethodHead {
+			return
+		}
 
-		written, err := io.WriteString(w, formattedPage+"\n")
+		written, err := io.WriteString(w, formattedPage)
 		if err != nil {
 			errorChannel <- err
 
-			serverError(w, r, nil)
+			app.serverError(w, r, nil)
 
 			return
 		}
 
+		if app.Stats || app.PreferUnseen || app.NoRepeat > 0 {
+			stats.record(path)
+		}
+
+		app.metrics.record(format.Name(), path, paths)
+
+		app.clients.served(r)
+
+		err = app.sharedIndex.served(path)
+		if err != nil {
+			errorChannel <- err
+		}
+
 		if format.Type() != "embed" {
-			if Verbose {
+			if app.verbose() {
 				fmt.Printf("%s | SERVE: %s (%s) to %s in %s\n",
 					startTime.Format(logDate),
 					path,
-					humanReadableSize(written),
-					realIP(r),
+					app.humanReadableSize(written),
+					requester(r),
 					time.Since(startTime).Round(time.Microsecond),
 				)
 			}
 
-			if Russian {
-				err := kill(path, index)
+			if app.Russian {
+				err := app.kill(path, index, notify)
 				if err != nil {
 					errorChannel <- err
 
@@ -403,7 +763,62 @@ func serveMedia(index *fileIndex, filename *regexp.Regexp, formats types.Types,
 	}
 }
 
-func serveVersion(errorChannel chan<- error) httprouter.Handle {
+// Responds to HEAD requests for a file with the headers a GET request would
+// receive, without reading more of the file than is needed to detect its type.
+// Returns the media type registered for the file's format, falling back
+// to detecting it from the file's leading bytes if the format has none
+// (e.g. source code) or the file matches no format (e.g. with --fallback).
+func (app *application) contentType(path string, formats types.Types, head []byte) string {
+	format, extension := app.detectFormat(path, formats)
+
+	if format != nil {
+		mediaType := format.MediaType(extension)
+
+		switch {
+		// Text files are validated as UTF-8 when selected
+		case strings.HasPrefix(mediaType, "text/"):
+			return mediaType + "; charset=utf-8"
+		case mediaType != "":
+			return mediaType
+		}
+	}
+
+	return http.DetectContentType(head)
+}
+
+func (app *application) serveStaticHead(w http.ResponseWriter, path string, formats types.Types) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Only the leading bytes are needed to detect the media type
+	head := make([]byte, 512)
+
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	w.Header().Set("Content-Type", app.contentType(path, formats, head[:n]))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+
+	return nil
+}
+
+// Registers the handler for both GET and HEAD requests.
+func registerGet(mux *httprouter.Router, path string, handle httprouter.Handle) {
+	mux.GET(path, handle)
+	mux.HEAD(path, handle)
+}
+
+func (app *application) serveVersion(errorChannel chan<- error) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		startTime := time.Now()
 
@@ -420,31 +835,190 @@ func serveVersion(errorChannel chan<- error) httprouter.Handle {
 			return
 		}
 
-		if Verbose {
+		if app.verbose() {
 			fmt.Printf("%s | SERVE: Version page (%s) to %s in %s\n",
 				startTime.Format(logDate),
-				humanReadableSize(written),
-				realIP(r),
+				app.humanReadableSize(written),
+				requester(r),
 				time.Since(startTime).Round(time.Microsecond),
 			)
 		}
 	}
 }
 
-func redirectRoot() httprouter.Handle {
+func (app *application) redirectRoot() httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		newUrl := fmt.Sprintf("http://%s%s",
-			r.Host,
-			Prefix,
-		)
+		http.Redirect(w, r, app.rootUrl(r), redirectStatusCode)
+	}
+}
 
-		http.Redirect(w, r, newUrl, redirectStatusCode)
+func (app *application) formatEnabled(name string) bool {
+	return app.All || slices.Contains(app.Types, name)
+}
+
+func normalizeExtension(extension string) string {
+	if !strings.HasPrefix(extension, ".") {
+		return "." + extension
 	}
+
+	return extension
 }
 
-func ServePage(args []string) error {
+func (app *application) remapExtensions(formats types.Types) error {
+	for _, mapping := range app.Map {
+		extension, name, found := strings.Cut(mapping, "=")
+		if !found || extension == "" || extension == "." {
+			return ErrInvalidMapping
+		}
+
+		if !formats.Map(normalizeExtension(extension), name) {
+			return ErrInvalidMapping
+		}
+	}
+
+	for _, extension := range app.Unmap {
+		formats.Unmap(normalizeExtension(extension))
+	}
+
+	// Files with no extension are looked up by the empty string
+	if app.Extensionless != "" && !formats.Map("", app.Extensionless) {
+		return ErrInvalidExtensionless
+	}
+
+	return nil
+}
+
+// Returns the formats enabled by the configuration. Any additional formats
+// are added first, so they take precedence over the built-in ones.
+func (app *application) enabledFormats(extra []types.Type) (types.Types, error) {
+	formats := make(types.Types)
+
+	for _, format := range extra {
+		formats.Add(format)
+	}
+
+	enabled := []types.Type{}
+
+	if app.Audio || app.formatEnabled("audio") {
+		enabled = append(enabled, audio.Format{})
+	}
+
+	if app.Code || app.formatEnabled("code") {
+		enabled = append(enabled, code.Format{Fun: app.Fun, Theme: app.CodeTheme})
+	}
+
+	if app.Flash || app.formatEnabled("flash") {
+		enabled = append(enabled, flash.Format{})
+	}
+
+	if app.Text || app.formatEnabled("text") {
+		enabled = append(enabled, text.Format{})
+	}
+
+	if app.Videos || app.formatEnabled("video") {
+		enabled = append(enabled, video.Format{})
+	}
+
+	if app.Images || app.formatEnabled("images") {
+		enabled = append(enabled, images.Format{NoButtons: app.NoButtons, Fun: app.Fun})
+	}
+
+	for _, format := range enabled {
+		configurable, ok := format.(types.Configurable)
+		if ok {
+			configured, err := configurable.Configure(app.formatFlags)
+			if err != nil {
+				return nil, err
+			}
+
+			format = configured
+		}
+
+		formats.Add(format)
+	}
+
+	err := app.remapExtensions(formats)
+	if err != nil {
+		return nil, err
+	}
+
+	return formats, nil
+}
+
+// Reports whether the error is expected while scanning (e.g. a file which was
+// removed or is unreadable), and so is only logged if --debug is set.
+func ignorable(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) || errors.Is(err, ErrFailedValidation) || errors.Is(err, ErrInvalidImageData)
+}
+
+// A server built from a Config, holding its settings along with the
+// handler serving requests and the state persisted on shutdown.
+type application struct {
+	Config
+
+	handler      http.Handler
+	index        *fileIndex
+	stats        *serveStats
+	problems     *problemReport
+	errorChannel chan<- error
+
+	// Populated only if --audit-file is set
+	audit *auditLog
+
+	// Populated only if --api and --stats are both set
+	clients *clientStats
+	metrics *serveMetrics
+
+	// Populated only if --collections is set
+	collections *collectionStore
+
+	// The subset of settings which can be changed while running
+	currentSettings atomic.Pointer[runtimeSettings]
+
+	// Headers added to or overridden in every response via --header
+	customHeaders []customHeader
+
+	// Flags registered by the built-in formats, set from FormatFlags
+	formatFlags *pflag.FlagSet
+
+	// Relative weights of each path when sampling with --sampling weighted,
+	// keyed by normalized path. Paths without a weight default to 1.
+	pathWeights map[string]float64
+
+	// Files listed by --list-url, shared by every scan
+	remoteFiles *remoteList
+
+	// Time windows during which files under a path, or of a format, are
+	// eligible for selection, keyed by normalized path or format name
+	schedules map[string][]window
+
+	// The index and serve records shared between replicas via --index-backend redis
+	sharedIndex *sharedStore
+
+	// The database persisted state is kept in, if --state-dir is set
+	state *stateStore
+}
+
+// Returns an application for the configuration, or an error if it is invalid.
+func newApplication(cfg Config) (*application, error) {
+	app := &application{Config: cfg}
+
+	err := app.configure()
+	if err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+// Builds the handler for the configured paths, and starts any background
+// tasks (e.g. scheduled index rebuilds), which run until the context is
+// canceled. Errors are passed to fatal if --error-exit is set.
+func (app *application) start(ctx context.Context, fatal context.CancelCauseFunc, extra []types.Type) error {
 	var err error
 
+	app.initSettings()
+
 	timeZone := os.Getenv("TZ")
 	if timeZone != "" {
 		time.Local, err = time.LoadLocation(timeZone)
@@ -453,50 +1027,70 @@ func ServePage(args []string) error {
 		}
 	}
 
-	if Verbose {
-		fmt.Printf("%s | START: roulette v%s\n",
-			time.Now().Format(logDate),
-			ReleaseVersion,
-		)
+	formats, err := app.enabledFormats(extra)
+	if err != nil {
+		return err
 	}
 
-	bindHost, err := net.LookupHost(Bind)
+	paths, err := app.validatePaths(app.Paths, formats)
 	if err != nil {
 		return err
 	}
 
-	bindAddr := net.ParseIP(bindHost[0])
-	if bindAddr == nil {
-		return errors.New("invalid bind address provided")
+	mounts, err := app.parseMounts(app.Mounts, formats)
+	if err != nil {
+		return err
 	}
 
-	formats := make(types.Types)
+	vhosts, err := app.parseVhosts(app.Vhosts, formats)
+	if err != nil {
+		return err
+	}
 
-	if Audio || All {
-		formats.Add(audio.Format{})
+	paths = mountedPaths(paths, mounts, vhosts)
+
+	app.pathWeights, err = app.parsePathWeights(app.PathWeights)
+	if err != nil {
+		return err
 	}
 
-	if Code || All {
-		formats.Add(code.Format{Fun: Fun, Theme: CodeTheme})
+	app.schedules, err = app.parseSchedules(app.Schedules)
+	if err != nil {
+		return err
 	}
 
-	if Flash || All {
-		formats.Add(flash.Format{})
+	app.customHeaders, err = app.parseHeaders(app.Headers)
+	if err != nil {
+		return err
 	}
 
-	if Text || All {
-		formats.Add(text.Format{})
+	err = app.applyStateDir()
+	if err != nil {
+		return err
 	}
 
-	if Videos || All {
-		formats.Add(video.Format{})
+	app.state, err = app.openStateStore()
+	if err != nil {
+		return err
 	}
 
-	if Images || All {
-		formats.Add(images.Format{NoButtons: NoButtons, Fun: Fun})
+	app.audit, err = app.newAuditLog()
+	if err != nil {
+		return err
 	}
 
-	paths, err := validatePaths(args, formats)
+	app.remoteFiles = app.newRemoteList(paths)
+
+	app.metrics = app.newServeMetrics()
+
+	app.clients = app.newClientStats()
+
+	app.sharedIndex, err = app.newSharedStore()
+	if err != nil {
+		return err
+	}
+
+	app.collections, err = app.newCollectionStore()
 	if err != nil {
 		return err
 	}
@@ -505,98 +1099,322 @@ func ServePage(args []string) error {
 		return ErrNoMediaFound
 	}
 
-	listenHost := net.JoinHostPort(Bind, strconv.Itoa(Port))
-
 	index := &fileIndex{
+		app:   app,
 		mutex: &sync.RWMutex{},
 		list:  []string{},
 	}
 
+	stats := app.newServeStats()
+
 	mux := httprouter.New()
 
-	srv := &http.Server{
-		Addr:         listenHost,
-		Handler:      mux,
-		IdleTimeout:  10 * time.Minute,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Minute,
-	}
+	mux.PanicHandler = app.serverErrorHandler()
+
+	notify := app.newNotifier()
 
-	mux.PanicHandler = serverErrorHandler()
+	recent := newErrorBuffer(app.ErrorBuffer)
+
+	problems := app.newProblemReport()
+
+	cache, err := app.newArtifactCache()
+	if err != nil {
+		return err
+	}
 
 	errorChannel := make(chan error)
 
 	go func() {
 		for err := range errorChannel {
+			notify.error(err)
+
+			problems.record(err)
+
 			switch {
-			case ErrorExit:
-				fmt.Printf("%s | FATAL: %v\n", time.Now().Format(logDate), err)
-			case Debug && errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission):
+			case app.Debug && ignorable(err):
 				fmt.Printf("%s | DEBUG: %v\n", time.Now().Format(logDate), err)
-			case errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission):
+			case ignorable(err):
 				continue
+			case app.ErrorExit:
+				fmt.Printf("%s | FATAL: %v\n", time.Now().Format(logDate), err)
+
+				fatal(err)
 			default:
 				fmt.Printf("%s | ERROR: %v\n", time.Now().Format(logDate), err)
 			}
+
+			recent.add(err)
 		}
 	}()
 
+	problems.Import(errorChannel)
+
+	stats.Import(errorChannel)
+
 	filename := regexp.MustCompile(`(.+?)([0-9]*)(\..+)`)
 
-	if !strings.HasSuffix(Prefix, "/") {
-		Prefix = Prefix + "/"
+	if !strings.HasSuffix(app.Prefix, "/") {
+		app.Prefix = app.Prefix + "/"
 	}
 
-	mux.GET(Prefix, serveRoot(paths, index, filename, formats, errorChannel))
+	registerGet(mux, app.Prefix, app.serveRoot(paths, "", "", vhosts, index, stats, filename, formats, errorChannel))
 
-	Prefix = strings.TrimSuffix(Prefix, "/")
+	app.Prefix = strings.TrimSuffix(app.Prefix, "/")
 
-	if Prefix != "" {
-		mux.GET("/", redirectRoot())
+	if app.Prefix != "" {
+		registerGet(mux, "/", app.redirectRoot())
 	}
 
-	mux.GET(Prefix+"/favicons/*favicon", serveFavicons(errorChannel))
+	for _, m := range mounts {
+		registerGet(mux, app.Prefix+m.prefix+"/", app.serveRoot(paths, m.path, m.prefix, vhosts, index, stats, filename, formats, errorChannel))
+	}
+
+	registerGet(mux, app.Prefix+artPrefix+"/*media", app.serveAlbumArt(paths, vhosts, index, errorChannel))
 
-	mux.GET(Prefix+"/favicon.ico", serveFavicons(errorChannel))
+	registerGet(mux, app.Prefix+"/daily", app.serveDaily(paths, vhosts, index, false, formats, errorChannel))
 
-	mux.GET(Prefix+mediaPrefix+"/*media", serveMedia(index, filename, formats, errorChannel))
+	registerGet(mux, app.Prefix+"/daily/source", app.serveDaily(paths, vhosts, index, true, formats, errorChannel))
 
-	mux.GET(Prefix+sourcePrefix+"/*static", serveStaticFile(paths, index, errorChannel))
+	registerGet(mux, app.Prefix+"/favicons/*favicon", serveFavicons(errorChannel))
 
-	mux.GET(Prefix+"/version", serveVersion(errorChannel))
+	registerGet(mux, app.Prefix+"/favicon.ico", serveFavicons(errorChannel))
 
-	quit := make(chan struct{})
-	defer close(quit)
+	registerGet(mux, app.Prefix+mediaPrefix+"/*media", app.serveMedia(paths, vhosts, index, stats, notify, filename, formats, errorChannel))
 
-	if API {
-		registerAPIHandlers(mux, paths, index, formats, errorChannel)
+	if app.Index {
+		registerGet(mux, app.Prefix+siblingPrefix+"/*media", app.serveSibling(paths, vhosts, index, errorChannel))
 	}
 
-	if Index {
-		importIndex(paths, index, formats, errorChannel)
+	transfers := app.newTransferLimiter()
+
+	if app.Transcode {
+		_, err = exec.LookPath("ffmpeg")
+		if err != nil {
+			return ErrMissingFfmpeg
+		}
+
+		registerGet(mux, app.Prefix+transcodePrefix+"/*media", app.limitTransfers(transfers, app.serveTranscode(paths, vhosts, index, cache, errorChannel)))
+	}
 
-		if IndexInterval != "" {
-			registerIndexInterval(paths, index, formats, quit, errorChannel)
+	if app.Storyboards {
+		_, err = exec.LookPath("ffmpeg")
+		if err != nil || ffprobe() == "" {
+			return ErrMissingStoryboard
 		}
+
+		registerGet(mux, app.Prefix+storyboardPrefix+"/*media", app.limitTransfers(transfers, app.serveStoryboard(paths, vhosts, index, cache, errorChannel)))
+	}
+
+	z := app.newZipper(cache)
+
+	if app.Zip {
+		registerGet(mux, app.Prefix+zipPrefix+"/*dir", app.limitTransfers(transfers, app.serveZip(paths, vhosts, index, formats, z, errorChannel)))
+	}
+
+	if app.Collections {
+		app.registerCollectionHandlers(mux, paths, vhosts, index, transfers, z, errorChannel)
+	}
+
+	registerGet(mux, app.Prefix+sourcePrefix+"/*static", app.limitTransfers(transfers, app.serveStaticFile(paths, vhosts, formats, index, cache, notify, errorChannel)))
+
+	registerGet(mux, app.Prefix+"/version", app.serveVersion(errorChannel))
+
+	if app.ListUrl != "" {
+		registerGet(mux, app.Prefix+remotePrefix, app.serveRemote(formats, errorChannel))
+	}
+
+	robots, err := app.loadRobots()
+	if err != nil {
+		return err
 	}
 
-	if Profile {
-		registerProfileHandlers(mux)
+	// Crawlers only ever request this from the root, regardless of prefix
+	registerGet(mux, "/robots.txt", app.serveRobots(robots, errorChannel))
+
+	if app.Flash || app.formatEnabled("flash") {
+		if !flash.HasRuffle() {
+			return ErrMissingRuffle
+		}
+
+		registerGet(mux, app.Prefix+"/ruffle/*ruffle", app.serveRuffle(errorChannel))
+
+		if app.verbose() {
+			fmt.Printf("%s | START: Using embedded ruffle version %s\n",
+				time.Now().Format(logDate),
+				flash.RuffleVersion(),
+			)
+		}
 	}
 
-	if Russian {
+	if app.API {
+		app.registerAPIHandlers(ctx, mux, paths, vhosts, index, stats, notify, recent, problems, cache, formats, errorChannel)
+	}
+
+	if app.Index {
+		app.importIndex(ctx, paths, index, formats, errorChannel)
+
+		if app.IndexInterval != "" {
+			app.registerIndexInterval(ctx, paths, index, formats, errorChannel)
+		}
+
+		app.registerSharedSync(ctx, index, errorChannel)
+
+		if app.PruneInterval != "" {
+			app.registerPruneInterval(ctx, index, errorChannel)
+		}
+	}
+
+	if app.Profile {
+		app.registerProfileHandlers(mux)
+	}
+
+	if app.Russian && app.ReadOnly {
+		fmt.Printf("WARNING! Read-only mode is enabled, so files will not be deleted after serving.\n\n")
+
+		app.Russian = false
+	}
+
+	if app.Russian {
 		fmt.Printf("WARNING! Files *will* be deleted after serving!\n\n")
 	}
 
-	if Verbose {
-		fmt.Printf("%s | SERVE: Listening on http://%s%s/\n",
+	app.handler = app.withRequestIds(app.withSlowRequests(app.withNoIndex(app.withClients(app.withShares(app.withHeaders(app.withCompression(mux)))))))
+	app.index = index
+	app.stats = stats
+	app.problems = problems
+	app.errorChannel = errorChannel
+
+	return nil
+}
+
+// Writes the index, problems report, and serve counts to their files or
+// the state database, if persisted, then closes the state database.
+func (app *application) persist() {
+	app.index.Export(app.errorChannel)
+
+	app.problems.Export(app.errorChannel)
+
+	app.stats.Export(app.errorChannel)
+
+	err := app.state.Close()
+	if err != nil {
+		app.errorChannel <- err
+	}
+}
+
+// Serves until interrupted, or until the parent context is canceled.
+func (app *application) servePage(parent context.Context, extra []types.Type) error {
+	if app.verbose() {
+		fmt.Printf("%s | START: roulette v%s\n",
 			time.Now().Format(logDate),
-			listenHost,
-			Prefix)
+			ReleaseVersion,
+		)
 	}
 
-	err = srv.ListenAndServe()
-	if !errors.Is(err, http.ErrServerClosed) {
+	for _, address := range app.Bind {
+		bindHost, err := net.LookupHost(address)
+		if err != nil {
+			return err
+		}
+
+		bindAddr := net.ParseIP(bindHost[0])
+		if bindAddr == nil {
+			return errors.New("invalid bind address provided")
+		}
+	}
+
+	// Canceled with the triggering error if --error-exit is set,
+	// which then shuts down the server and is returned to the caller.
+	fatalCtx, fatal := context.WithCancelCause(parent)
+	defer fatal(nil)
+
+	ctx, stop := signal.NotifyContext(fatalCtx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := app.start(ctx, fatal, extra)
+	if err != nil {
+		app.state.Close()
+
+		return err
+	}
+	defer app.audit.Close()
+
+	srv := &http.Server{
+		Handler:      app.handler,
+		IdleTimeout:  10 * time.Minute,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Minute,
+	}
+
+	listeners, err := listen(app.Bind, app.Port)
+	if err != nil {
+		return err
+	}
+
+	// The assigned port is always reported if one was requested
+	if app.verbose() || app.Port == 0 {
+		for _, listener := range listeners {
+			fmt.Printf("%s | SERVE: Listening on http://%s%s/\n",
+				time.Now().Format(logDate),
+				listener.Addr(),
+				app.Prefix)
+		}
+	}
+
+	if app.UrlFile != "" {
+		err = app.writeUrlFile(listeners)
+		if err != nil {
+			return err
+		}
+	}
+
+	if app.Open {
+		err = openBrowser(app.listenUrl(listeners[0]))
+		if err != nil {
+			app.errorChannel <- err
+		}
+	}
+
+	shutdown := make(chan struct{})
+
+	go func() {
+		defer close(shutdown)
+
+		<-ctx.Done()
+
+		if app.verbose() {
+			fmt.Printf("%s | STOP: Shutting down\n",
+				time.Now().Format(logDate),
+			)
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		srv.Shutdown(shutdownCtx)
+
+		app.persist()
+	}()
+
+	served := make(chan error, len(listeners))
+
+	for _, listener := range listeners {
+		go func() {
+			served <- srv.Serve(listener)
+		}()
+	}
+
+	for range listeners {
+		err = <-served
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+
+	<-shutdown
+
+	// A canceled parent is a normal shutdown, not an error
+	if err := context.Cause(fatalCtx); err != nil && !errors.Is(err, context.Canceled) {
 		return err
 	}
 
@@ -0,0 +1,336 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package cmd
+
+import (
+	"archive/zip"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"seedno.de/seednode/roulette/types"
+)
+
+const (
+	zipPrefix string = `/zip`
+)
+
+// Returns the path component used to request a zip of the directory
+// containing the specified file.
+func (app *application) zipUri(path string) string {
+	return zipPrefix + app.pagePath(path)
+}
+
+func (app *application) zipButton(path string) string {
+	return fmt.Sprintf(`<button data-href="%s">Download folder</button>`,
+		html.EscapeString(app.Prefix+app.zipUri(path)))
+}
+
+// Returns the supported files directly inside the directory, sorted by name.
+func (app *application) zipFiles(dir string, index *fileIndex, formats types.Types) ([]string, error) {
+	if app.Index {
+		return index.directory(dir + "/"), nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+
+	for _, entry := range entries {
+		if entry.Name() == app.Ignore {
+			return nil, nil
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		if entry.Type().IsRegular() && app.isSupported(path, formats) {
+			files = append(files, path)
+		}
+	}
+
+	slices.Sort(files)
+
+	return files, nil
+}
+
+// Returns the total size of the files, stopping once it exceeds maxSize.
+func zipSize(files []string, maxSize int64) (int64, error) {
+	var total int64
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, err
+		}
+
+		total += info.Size()
+
+		if total > maxSize {
+			break
+		}
+	}
+
+	return total, nil
+}
+
+// Returns the name of the file within a zip, numbering any which would
+// otherwise share a name with an earlier file (e.g. in a collection).
+func zipName(names map[string]int, path string) string {
+	name := filepath.Base(path)
+
+	names[name]++
+
+	if names[name] == 1 {
+		return name
+	}
+
+	extension := filepath.Ext(name)
+
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, extension), names[name]-1, extension)
+}
+
+// Adds the file to the archive under the specified name, stripping its
+// metadata if --strip-metadata is set, as when it is served on its own.
+func (app *application) zipFile(archive *zip.Writer, path, name string, cache *artifactCache) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+
+	// Most media is already compressed
+	header.Method = zip.Store
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if app.stripsMetadata(path) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		data, err = cache.fetch(cacheStripped, cacheKey(cacheStripped, path, info), func() ([]byte, error) {
+			return stripMetadata(path, data)
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = entry.Write(data)
+
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(entry, file)
+
+	return err
+}
+
+// Streams zips of files, rejecting those larger than --zip-max-size, and
+// allowing each client only one download at a time.
+type zipper struct {
+	app *application
+
+	maxSize int64
+	cache   *artifactCache
+
+	mutex  sync.Mutex
+	active map[string]bool
+}
+
+func (app *application) newZipper(cache *artifactCache) *zipper {
+	maxSize, _ := types.ParseSize(app.ZipMaxSize)
+
+	return &zipper{
+		app:     app,
+		maxSize: maxSize,
+		cache:   cache,
+		active:  make(map[string]bool),
+	}
+}
+
+// Returns whether the client may start another download, recording it if so.
+func (z *zipper) acquire(address string) bool {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if z.active[address] {
+		return false
+	}
+
+	z.active[address] = true
+
+	return true
+}
+
+func (z *zipper) release(address string) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	delete(z.active, address)
+}
+
+// Streams a zip of the files, named after the specified directory or
+// collection.
+func (z *zipper) serve(w http.ResponseWriter, r *http.Request, name string, files []string, errorChannel chan<- error) {
+	startTime := time.Now()
+
+	size, err := zipSize(files, z.maxSize)
+	if err != nil {
+		errorChannel <- err
+
+		z.app.serverError(w, r, nil)
+
+		return
+	}
+
+	if size > z.maxSize {
+		http.Error(w, fmt.Sprintf("Files exceed the maximum download size of %s", z.app.humanReadableSize(int(z.maxSize))), http.StatusRequestEntityTooLarge)
+
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "application/zip")
+
+		return
+	}
+
+	address := z.app.clientAddress(r)
+
+	if !z.acquire(address) {
+		w.Header().Set("Retry-After", "1")
+
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+
+		return
+	}
+	defer z.release(address)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(name) + ".zip"}))
+
+	archive := zip.NewWriter(w)
+
+	names := make(map[string]int, len(files))
+
+	for _, file := range files {
+		err = z.app.zipFile(archive, file, zipName(names, file), z.cache)
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = archive.Close()
+	}
+
+	var status string
+
+	switch {
+	case r.Context().Err() != nil:
+		status = " (incomplete)"
+	case err != nil:
+		errorChannel <- &fileProblem{path: name, err: err}
+
+		return
+	}
+
+	if z.app.verbose() {
+		fmt.Printf("%s | SERVE: Zip of %d files in %s (%s) to %s in %s%s\n",
+			startTime.Format(logDate),
+			len(files),
+			name,
+			z.app.humanReadableSize(int(size)),
+			requester(r),
+			time.Since(startTime).Round(time.Microsecond),
+			status,
+		)
+	}
+}
+
+// Streams a zip of the supported files in a directory, or in the directory
+// containing the specified file.
+func (app *application) serveZip(paths []string, vhosts map[string]string, index *fileIndex, formats types.Types, z *zipper, errorChannel chan<- error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if app.hotlinked(r) {
+			app.rejectHotlink(w, r)
+
+			return
+		}
+
+		path := p.ByName("dir")
+
+		switch {
+		case app.HashPaths:
+			resolved, found := index.resolve(path)
+			if !found {
+				app.notFound(w, r, path)
+
+				return
+			}
+
+			path = resolved
+		case runtime.GOOS == "windows":
+			path = fromUrlPath(path)
+		}
+
+		path, err := filepath.EvalSymlinks(path)
+		if err != nil || !app.pathIsValid(path, app.servedPaths(r, paths, vhosts)) {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			app.notFound(w, r, path)
+
+			return
+		}
+
+		dir := path
+		if !info.IsDir() {
+			dir = filepath.Dir(path)
+		}
+
+		files, err := app.zipFiles(dir, index, formats)
+		if err != nil || len(files) == 0 {
+			app.notFound(w, r, dir)
+
+			return
+		}
+
+		z.serve(w, r, dir, files, errorChannel)
+	}
+}
@@ -6,10 +6,13 @@ require (
 	github.com/alecthomas/chroma/v2 v2.15.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/klauspost/compress v1.17.11
+	github.com/pierrec/lz4/v4 v4.1.22
 	github.com/spf13/cobra v1.8.1
-	github.com/spf13/pflag v1.0.5
+	github.com/spf13/pflag v1.0.6
 	github.com/spf13/viper v1.19.0
+	go.etcd.io/bbolt v1.4.0
 	golang.org/x/image v0.23.0
+	golang.org/x/sys v0.29.0
 )
 
 require (
@@ -28,7 +31,6 @@ require (
 	github.com/subosito/gotenv v1.6.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/exp v0.0.0-20250106191152-7588d65b2ba8 // indirect
-	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -0,0 +1,64 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+// Package roulette serves random media from the specified directories,
+// for embedding in other Go programs.
+//
+// A Server can either listen on its own via ListenAndServe, or provide an
+// http.Handler to mount under an existing router:
+//
+//	cfg := roulette.DefaultConfig()
+//	cfg.Images = true
+//	cfg.Prefix = "/random"
+//	cfg.Paths = []string{"/mnt/photos"}
+//
+//	server, err := roulette.New(cfg)
+//	if err != nil {
+//		return err
+//	}
+//
+//	handler, err := server.Handler(ctx)
+//	if err != nil {
+//		return err
+//	}
+//
+//	mux.Handle("/random/", handler)
+//
+// Several Servers can run in the same process, as long as they do not
+// share a state directory.
+package roulette
+
+import (
+	"seedno.de/seednode/roulette/cmd"
+	"seedno.de/seednode/roulette/types"
+)
+
+// Config holds the settings for a Server. Each field corresponds to the
+// command-line flag of the same name, FormatFlags to the flags registered
+// by the formats themselves (keyed by flag name), and Paths to the paths
+// to serve.
+type Config = cmd.Config
+
+// Server serves random media according to its Config.
+type Server = cmd.Server
+
+// Format describes how files of a given type are detected and displayed.
+// Custom formats can be added to a Server via Register.
+type Format = types.Type
+
+// Returns a Config with the same defaults as the command-line flags.
+func DefaultConfig() Config {
+	return cmd.DefaultConfig()
+}
+
+// Returns a Server for the configuration, or an error if it is invalid.
+func New(cfg Config) (*Server, error) {
+	return cmd.New(cfg)
+}
+
+// Returns the names of the built-in formats, which can be enabled via
+// Config.Types.
+func Formats() []string {
+	return types.SupportedFormats.Names()
+}
@@ -5,13 +5,37 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package audio
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"html"
+	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/spf13/pflag"
 	"seedno.de/seednode/roulette/types"
 )
 
-type Format struct{}
+type Format struct {
+	ArtUri     string
+	NoAutoplay bool
+}
+
+func (t Format) RegisterFlags(flags *pflag.FlagSet) {
+	types.RegisterAutoplayFlag(flags)
+}
+
+func (t Format) Configure(flags *pflag.FlagSet) (types.Type, error) {
+	noAutoplay, err := types.NoAutoplay(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	t.NoAutoplay = noAutoplay
+
+	return t, nil
+}
 
 func (t Format) CSS() string {
 	var css strings.Builder
@@ -19,27 +43,54 @@ func (t Format) CSS() string {
 	css.WriteString(`html,body{margin:0;padding:0;height:100%;}`)
 	css.WriteString(`a{color:inherit;display:block;height:100%;width:100%;text-decoration:none;}`)
 	css.WriteString(`table{margin-left:auto;margin-right:auto;}`)
+	if t.ArtUri != "" {
+		css.WriteString(`.art{display:block;margin:1rem auto;max-width:90%;max-height:80vh;object-fit:contain;}`)
+		css.WriteString(`audio{display:block;margin:0 auto;}`)
+		css.WriteString(fmt.Sprintf(`body::before{content:"";position:fixed;top:0;right:0;bottom:0;left:0;z-index:-1;`+
+			`background:url("%s") center/cover;filter:blur(2rem) brightness(.5);}`, t.ArtUri))
+	}
 
 	return css.String()
 }
 
-func (t Format) Title(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	return fmt.Sprintf(`<title>%s</title>`, fileName), nil
+func (t Format) Title(ctx context.Context, opts types.Options) (string, error) {
+	return fmt.Sprintf(`<title>%s</title>`, opts.FileName), nil
 }
 
-func (t Format) Body(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	return fmt.Sprintf(`<a href="%s"><audio controls autoplay loop preload="auto"><source src="%s" type="%s" alt="Roulette selected: %s">Your browser does not support the audio tag.</audio></a>`,
-		rootUrl,
-		fileUri,
-		mime,
-		fileName), nil
+func (t Format) Body(ctx context.Context, opts types.Options) (string, error) {
+	var body strings.Builder
+
+	body.WriteString(fmt.Sprintf(`<a href="%s">`, opts.RootUrl))
+
+	if t.ArtUri != "" {
+		body.WriteString(fmt.Sprintf(`<img class="art" src="%s" alt="Album art for %s">`,
+			t.ArtUri,
+			html.EscapeString(opts.FileName)))
+	}
+
+	body.WriteString(fmt.Sprintf(`<audio controls%s preload="auto"><source src="%s" type="%s" alt="Roulette selected: %s">Your browser does not support the audio tag.</audio></a>`,
+		opts.PlaybackAttributes(t.NoAutoplay),
+		opts.FileUri,
+		opts.MediaType,
+		opts.FileName))
+
+	body.WriteString(opts.ResumeScript())
+
+	return body.String(), nil
 }
 
 func (t Format) Extensions() map[string]string {
 	return map[string]string{
-		`.mp3`: `audio/mpeg`,
-		`.ogg`: `audio/ogg`,
-		`.oga`: `audio/ogg`,
+		`.aac`:  `audio/aac`,
+		`.aif`:  `audio/aiff`,
+		`.aiff`: `audio/aiff`,
+		`.flac`: `audio/flac`,
+		`.m4a`:  `audio/mp4`,
+		`.mp3`:  `audio/mpeg`,
+		`.oga`:  `audio/ogg`,
+		`.ogg`:  `audio/ogg`,
+		`.opus`: `audio/ogg`,
+		`.wav`:  `audio/wav`,
 	}
 }
 
@@ -55,7 +106,50 @@ func (t Format) MediaType(extension string) string {
 }
 
 func (t Format) Validate(filePath string) bool {
-	return true
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	head := make([]byte, 36)
+
+	n, _ := file.Read(head)
+
+	return hasSignature(filepath.Ext(filePath), head[:n])
+}
+
+// Checks the leading bytes of a file against the container
+// signature expected for its extension.
+func hasSignature(extension string, head []byte) bool {
+	id3 := bytes.HasPrefix(head, []byte("ID3"))
+	adts := len(head) > 1 && head[0] == 0xFF && head[1]&0xE0 == 0xE0
+
+	switch extension {
+	case `.aac`:
+		return id3 || len(head) > 1 && head[0] == 0xFF && head[1]&0xF6 == 0xF0
+	case `.aif`, `.aiff`:
+		return len(head) >= 12 && bytes.Equal(head[:4], []byte("FORM")) &&
+			(bytes.Equal(head[8:12], []byte("AIFF")) || bytes.Equal(head[8:12], []byte("AIFC")))
+	case `.flac`:
+		return id3 || bytes.HasPrefix(head, []byte("fLaC"))
+	case `.m4a`:
+		return len(head) >= 8 && bytes.Equal(head[4:8], []byte("ftyp"))
+	case `.mp3`:
+		return id3 || adts
+	case `.oga`, `.ogg`:
+		return bytes.HasPrefix(head, []byte("OggS"))
+	case `.opus`:
+		return len(head) >= 36 && bytes.HasPrefix(head, []byte("OggS")) && bytes.Equal(head[28:36], []byte("OpusHead"))
+	case `.wav`:
+		return len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WAVE"))
+	default:
+		return true
+	}
+}
+
+func (t Format) Name() string {
+	return "audio"
 }
 
 func (t Format) Type() string {
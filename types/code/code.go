@@ -7,6 +7,7 @@ package code
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -16,21 +17,31 @@ import (
 	"github.com/alecthomas/chroma/v2/formatters/html"
 	"github.com/alecthomas/chroma/v2/lexers"
 	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/spf13/pflag"
 	"seedno.de/seednode/roulette/types"
 )
 
 type Format struct {
-	Fun   bool
-	Theme string
+	Fun       bool
+	Theme     string
+	Highlight [][2]int
+	MaxSize   int64
+}
+
+func (t Format) formatter() *html.Formatter {
+	return html.New(
+		html.TabWidth(4),
+		html.WithClasses(true),
+		html.WrapLongLines(true),
+		html.WithLineNumbers(true),
+		html.WithLinkableLineNumbers(true, "L"),
+		html.HighlightLines(t.Highlight))
 }
 
 func (t Format) CSS() string {
 	var css strings.Builder
 
-	formatter := html.New(
-		html.TabWidth(4),
-		html.WithClasses(true),
-		html.WrapLongLines(true))
+	formatter := t.formatter()
 
 	style := styles.Get(t.Theme)
 	if style == nil {
@@ -56,7 +67,7 @@ func (t Format) CSS() string {
 	css.Write(b)
 
 	css.WriteString("html{height:100%;width:100%;}")
-	css.WriteString("a{bottom:0;left:0;position:absolute;right:0;top:0;margin:1rem;padding:0;height:99%;width:99%;color:inherit;text-decoration:none;}")
+	css.WriteString("#code{bottom:0;left:0;position:absolute;right:0;top:0;margin:1rem;padding:0;height:99%;width:99%;color:inherit;text-decoration:none;cursor:pointer;}")
 	css.WriteString(`table{margin-left:auto;margin-right:auto;}`)
 	if t.Fun {
 		css.WriteString("body{font-family: \"Comic Sans MS\", cursive, \"Brush Script MT\", sans-serif;}\n")
@@ -65,19 +76,21 @@ func (t Format) CSS() string {
 	return css.String()
 }
 
-func (t Format) Title(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	return fmt.Sprintf(`<title>%s</title>`, fileName), nil
+func (t Format) Title(ctx context.Context, opts types.Options) (string, error) {
+	return fmt.Sprintf(`<title>%s</title>`, opts.FileName), nil
 }
 
-func (t Format) Body(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	contents, err := os.ReadFile(filePath)
+func (t Format) Body(ctx context.Context, opts types.Options) (string, error) {
+	contents, size, err := t.read(opts.FilePath)
 	if err != nil {
 		return "", err
 	}
 
+	truncated := int64(len(contents)) < size
+
 	contentString := string(contents)
 
-	lexer := lexers.Match(filePath)
+	lexer := lexers.Match(opts.FilePath)
 	if lexer == nil {
 		lexer = lexers.Analyse(contentString)
 	}
@@ -90,15 +103,12 @@ func (t Format) Body(rootUrl, fileUri, filePath, fileName, prefix, mime string)
 	w := bufio.NewWriter(&response)
 	r := bufio.NewReader(&response)
 
-	style := styles.Get(t.Theme)
+	style := styles.Get(opts.Theme)
 	if style == nil {
 		style = styles.Fallback
 	}
 
-	formatter := html.New(
-		html.TabWidth(4),
-		html.WithClasses(true),
-		html.WrapLongLines(true))
+	formatter := t.formatter()
 
 	iterator, err := lexer.Tokenise(nil, contentString)
 	if err != nil {
@@ -117,9 +127,83 @@ func (t Format) Body(rootUrl, fileUri, filePath, fileName, prefix, mime string)
 		return "", err
 	}
 
-	return fmt.Sprintf(`<a href="%s">%s</a>`,
-		rootUrl,
-		string(b)), nil
+	var body strings.Builder
+
+	// Line number links are left alone, so that clicking one
+	// updates the fragment instead of loading a new file.
+	body.WriteString(fmt.Sprintf(`<div id="code">%s</div>`,
+		string(b)))
+	body.WriteString(fmt.Sprintf(`<script nonce="%s">document.getElementById("code").addEventListener("click", function (event) { if (!event.target.closest('a')) { window.location.href = '%s'; } });</script>`,
+		opts.Nonce,
+		opts.RootUrl))
+
+	if truncated {
+		body.WriteString(fmt.Sprintf(`<p>File truncated to %d of %d bytes.</p>`,
+			len(contents),
+			size))
+	}
+
+	if len(t.Highlight) > 0 {
+		body.WriteString(fmt.Sprintf(`<script nonce="%s">window.addEventListener("load", function () { if (window.location.hash === "") { var line = document.getElementById("L%d"); if (line) { line.scrollIntoView(); } } });</script>`,
+			opts.Nonce,
+			t.Highlight[0][0]))
+	}
+
+	return body.String(), nil
+}
+
+// Reads at most MaxSize bytes of the specified file, trimmed back
+// to the last complete line, and returns them along with the full
+// size of the file. A MaxSize of zero disables truncation.
+func (t Format) read(filePath string) ([]byte, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	stats, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := stats.Size()
+
+	if t.MaxSize <= 0 || size <= t.MaxSize {
+		contents, err := io.ReadAll(file)
+
+		return contents, size, err
+	}
+
+	contents, err := io.ReadAll(io.LimitReader(file, t.MaxSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	i := bytes.LastIndexByte(contents, '\n')
+	if i > 0 {
+		contents = contents[:i+1]
+	}
+
+	return contents, size, nil
+}
+
+func (t Format) RegisterFlags(flags *pflag.FlagSet) {
+	flags.String("code-max-size", "1MB", "maximum amount of a source code file to display (0 to disable)")
+}
+
+func (t Format) Configure(flags *pflag.FlagSet) (types.Type, error) {
+	maxSize, err := flags.GetString("code-max-size")
+	if err != nil {
+		return nil, err
+	}
+
+	t.MaxSize, err = types.ParseSize(maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
 }
 
 func (t Format) Extensions() map[string]string {
@@ -226,6 +310,10 @@ func (t Format) Validate(filePath string) bool {
 	return true
 }
 
+func (t Format) Name() string {
+	return "code"
+}
+
 func (t Format) Type() string {
 	return "inline"
 }
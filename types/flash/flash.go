@@ -5,12 +5,53 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package flash
 
 import (
+	"context"
+	"embed"
 	"fmt"
+	"io/fs"
 	"strings"
 
 	"seedno.de/seednode/roulette/types"
 )
 
+// Self-hosted ruffle assets, populated by update-ruffle.sh, which
+// build.sh and the Dockerfiles run before building
+//
+//go:embed ruffle
+var ruffle embed.FS
+
+// Returns the embedded ruffle assets, rooted at the ruffle directory.
+func Ruffle() fs.FS {
+	assets, err := fs.Sub(ruffle, "ruffle")
+	if err != nil {
+		return ruffle
+	}
+
+	return assets
+}
+
+// Returns the version of the embedded ruffle assets, or "none"
+// if the binary was built without them.
+func RuffleVersion() string {
+	version, err := ruffle.ReadFile("ruffle/VERSION")
+	if err != nil {
+		return "none"
+	}
+
+	return strings.TrimSpace(string(version))
+}
+
+// Returns whether the binary was built with the ruffle assets.
+func HasRuffle() bool {
+	_, err := fs.Stat(ruffle, "ruffle/ruffle.js")
+
+	return err == nil
+}
+
+func ruffleSource(prefix string) string {
+	return prefix + "/ruffle/ruffle.js"
+}
+
 type Format struct{}
 
 func (t Format) CSS() string {
@@ -23,16 +64,16 @@ func (t Format) CSS() string {
 	return css.String()
 }
 
-func (t Format) Title(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	return fmt.Sprintf(`<title>%s</title>`, fileName), nil
+func (t Format) Title(ctx context.Context, opts types.Options) (string, error) {
+	return fmt.Sprintf(`<title>%s</title>`, opts.FileName), nil
 }
 
-func (t Format) Body(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
+func (t Format) Body(ctx context.Context, opts types.Options) (string, error) {
 	var html strings.Builder
 
-	html.WriteString(fmt.Sprintf(`<script src="https://unpkg.com/@ruffle-rs/ruffle"></script><script>window.RufflePlayer.config = {autoplay:"on"};</script><embed src="%s"></embed>`, fileUri))
+	html.WriteString(fmt.Sprintf(`<script src="%s"></script><script nonce="%s">window.RufflePlayer.config = {autoplay:"on"};</script><embed src="%s"></embed>`, ruffleSource(opts.Prefix), opts.Nonce, opts.FileUri))
 	html.WriteString(`<br /><button id="next">Next</button>`)
-	html.WriteString(fmt.Sprintf(`<script>window.addEventListener("load", function () { document.getElementById("next").addEventListener("click", function () { window.location.href = '%s'; }) }); </script>`, rootUrl))
+	html.WriteString(fmt.Sprintf(`<script nonce="%s">window.addEventListener("load", function () { document.getElementById("next").addEventListener("click", function () { window.location.href = '%s'; }) }); </script>`, opts.Nonce, opts.RootUrl))
 
 	return html.String(), nil
 }
@@ -58,6 +99,10 @@ func (t Format) Validate(filePath string) bool {
 	return true
 }
 
+func (t Format) Name() string {
+	return "flash"
+}
+
 func (t Format) Type() string {
 	return "embed"
 }
@@ -5,16 +5,20 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package images
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"html"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"math/rand"
 	"os"
+	"slices"
 	"strings"
 
+	"github.com/spf13/pflag"
 	_ "golang.org/x/image/bmp"
 	_ "golang.org/x/image/webp"
 	"seedno.de/seednode/roulette/types"
@@ -25,9 +29,32 @@ type dimensions struct {
 	height int
 }
 
+func (d *dimensions) Width() int {
+	return d.width
+}
+
+func (d *dimensions) Height() int {
+	return d.height
+}
+
+// Effects which --fun may apply to images, in addition to rotating them.
+var effects = []string{"mirror", "sepia", "spin"}
+
+// Each enabled effect is applied to one in this many images.
+const effectChance = 20
+
+var ErrInvalidEffect = errors.New("fun effects must be any of: " + strings.Join(effects, ", "))
+
 type Format struct {
 	NoButtons bool
 	Fun       bool
+	Effects   []string
+	Caption   string
+}
+
+// Returns whether the effect is enabled, and was chosen for this image.
+func (t Format) effect(name string) bool {
+	return slices.Contains(t.Effects, name) && rand.Intn(effectChance) == 0
 }
 
 func (t Format) CSS() string {
@@ -40,49 +67,89 @@ func (t Format) CSS() string {
 		css.WriteString(`a{color:inherit;display:block;height:97%;width:100%;text-decoration:none;}`)
 	}
 	css.WriteString(`table{margin-left:auto;margin-right:auto;}`)
-	css.WriteString(`img{margin:auto;display:block;max-width:96%;max-height:95%;`)
-	css.WriteString(`object-fit:scale-down;position:absolute;top:50%;left:50%;transform:translate(-50%,-50%)`)
+
+	transform := "translate(-50%,-50%)"
+
 	if t.Fun {
-		rotate := rand.Intn(360)
+		transform += fmt.Sprintf(" rotate(%ddeg)", rand.Intn(360))
 
-		css.WriteString(fmt.Sprintf(" rotate(%ddeg);", rotate))
-		css.WriteString(fmt.Sprintf("-ms-transform:rotate(%ddeg);", rotate))
-		css.WriteString(fmt.Sprintf("-webkit-transform:rotate(%ddeg);", rotate))
-		css.WriteString(fmt.Sprintf("-moz-transform:rotate(%ddeg);", rotate))
-		css.WriteString(fmt.Sprintf("-o-transform:rotate(%ddeg)", rotate))
+		if t.effect("mirror") {
+			transform += " scaleX(-1)"
+		}
+	}
+
+	css.WriteString(`img{margin:auto;display:block;max-width:96%;max-height:95%;`)
+	css.WriteString(fmt.Sprintf(`object-fit:scale-down;position:absolute;top:50%%;left:50%%;transform:%s;`, transform))
+	if t.Fun && t.effect("sepia") {
+		css.WriteString(`filter:sepia(1);`)
+	}
+	if t.Fun && t.effect("spin") {
+		css.WriteString(`animation:spin 60s linear infinite;}`)
+		css.WriteString(fmt.Sprintf(`@keyframes spin{from{transform:%s;}to{transform:%s rotate(360deg);}}`, transform, transform))
+		css.WriteString(`@media (prefers-reduced-motion:reduce){img{animation:none;}}`)
+	} else {
+		css.WriteString(`}`)
 	}
-	css.WriteString(`;}`)
+	css.WriteString(types.CaptionCSS)
 
 	return css.String()
 }
 
-func (t Format) Title(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	dimensions, err := ImageDimensions(filePath)
+func (t Format) RegisterFlags(flags *pflag.FlagSet) {
+	flags.StringSlice("fun-effects", effects, "rare effects which --fun may apply to images: "+strings.Join(effects, ", "))
+}
+
+func (t Format) Configure(flags *pflag.FlagSet) (types.Type, error) {
+	enabled, err := flags.GetStringSlice("fun-effects")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, effect := range enabled {
+		if !slices.Contains(effects, effect) {
+			return nil, ErrInvalidEffect
+		}
+	}
+
+	t.Effects = enabled
+
+	return t, nil
+}
+
+func (t Format) Title(ctx context.Context, opts types.Options) (string, error) {
+	dimensions, err := ImageDimensions(opts.FilePath)
 	if err != nil {
 		return "", err
 	}
 
 	return fmt.Sprintf(`<title>%s (%dx%d)</title>`,
-		fileName,
+		opts.FileName,
 		dimensions.width,
 		dimensions.height), nil
 }
 
-func (t Format) Body(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	dimensions, err := ImageDimensions(filePath)
+func (t Format) Body(ctx context.Context, opts types.Options) (string, error) {
+	dimensions, err := ImageDimensions(opts.FilePath)
 	if err != nil {
 		return "", err
 	}
 
 	var w strings.Builder
 
-	w.WriteString(fmt.Sprintf(`<a href="%s"><img src="%s" width="%d" height="%d" type="%s" alt="Roulette selected: %s"></a>`,
-		rootUrl,
-		fileUri,
+	alt := "Roulette selected: " + opts.FileName
+	if t.Caption != "" {
+		alt = t.Caption
+	}
+
+	w.WriteString(fmt.Sprintf(`<a href="%s"><img src="%s" width="%d" height="%d" type="%s" alt="%s"></a>`,
+		opts.RootUrl,
+		opts.FileUri,
 		dimensions.width,
 		dimensions.height,
-		mime,
-		fileName))
+		opts.MediaType,
+		html.EscapeString(alt)))
+
+	w.WriteString(types.Caption(t.Caption))
 
 	return w.String(), nil
 }
@@ -147,6 +214,10 @@ func ImageDimensions(path string) (*dimensions, error) {
 	return &dimensions{width: decodedConfig.Width, height: decodedConfig.Height}, nil
 }
 
+func (t Format) Name() string {
+	return "images"
+}
+
 func (t Format) Type() string {
 	return "embed"
 }
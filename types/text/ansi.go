@@ -0,0 +1,192 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package text
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ansiSequence = regexp.MustCompile(`\x1b\[([0-9;?]*)([A-Za-z])`)
+
+	ansiColors = [16]string{
+		"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+		"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+	}
+)
+
+type ansiState struct {
+	foreground string
+	background string
+	bold       bool
+	italic     bool
+	underline  bool
+}
+
+func (s *ansiState) style() string {
+	var style strings.Builder
+
+	if s.foreground != "" {
+		style.WriteString("color:" + s.foreground + ";")
+	}
+
+	if s.background != "" {
+		style.WriteString("background-color:" + s.background + ";")
+	}
+
+	if s.bold {
+		style.WriteString("font-weight:bold;")
+	}
+
+	if s.italic {
+		style.WriteString("font-style:italic;")
+	}
+
+	if s.underline {
+		style.WriteString("text-decoration:underline;")
+	}
+
+	return style.String()
+}
+
+// Returns the color for the extended (38/48) sequence starting at
+// params[i], along with the number of additional parameters consumed.
+func extendedColor(params []int, i int) (string, int) {
+	switch {
+	case i+2 < len(params) && params[i+1] == 5:
+		return color256(params[i+2]), 2
+	case i+4 < len(params) && params[i+1] == 2:
+		return fmt.Sprintf("#%02x%02x%02x", params[i+2]&0xff, params[i+3]&0xff, params[i+4]&0xff), 4
+	default:
+		return "", len(params) - i - 1
+	}
+}
+
+func color256(n int) string {
+	switch {
+	case n < 0 || n > 255:
+		return ""
+	case n < 16:
+		return ansiColors[n]
+	case n < 232:
+		n -= 16
+
+		levels := [6]int{0, 95, 135, 175, 215, 255}
+
+		return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[(n/6)%6], levels[n%6])
+	default:
+		gray := 8 + (n-232)*10
+
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+}
+
+func (s *ansiState) apply(sequence string) {
+	var params []int
+
+	for _, v := range strings.Split(sequence, ";") {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			n = 0
+		}
+
+		params = append(params, n)
+	}
+
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+
+		switch {
+		case p == 0:
+			*s = ansiState{}
+		case p == 1:
+			s.bold = true
+		case p == 3:
+			s.italic = true
+		case p == 4:
+			s.underline = true
+		case p == 22:
+			s.bold = false
+		case p == 23:
+			s.italic = false
+		case p == 24:
+			s.underline = false
+		case p >= 30 && p <= 37:
+			s.foreground = ansiColors[p-30]
+		case p == 38:
+			color, skip := extendedColor(params, i)
+			s.foreground = color
+			i += skip
+		case p == 39:
+			s.foreground = ""
+		case p >= 40 && p <= 47:
+			s.background = ansiColors[p-40]
+		case p == 48:
+			color, skip := extendedColor(params, i)
+			s.background = color
+			i += skip
+		case p == 49:
+			s.background = ""
+		case p >= 90 && p <= 97:
+			s.foreground = ansiColors[p-90+8]
+		case p >= 100 && p <= 107:
+			s.background = ansiColors[p-100+8]
+		}
+	}
+}
+
+func hasANSI(contents []byte) bool {
+	return ansiSequence.Match(contents)
+}
+
+// Converts ANSI SGR (color and style) sequences into HTML <span> elements,
+// escaping all other content. Any other escape sequences are discarded.
+func ansiToHTML(contents []byte) string {
+	var output strings.Builder
+
+	var state ansiState
+
+	open := false
+
+	last := 0
+
+	for _, match := range ansiSequence.FindAllSubmatchIndex(contents, -1) {
+		output.WriteString(html.EscapeString(string(contents[last:match[0]])))
+
+		last = match[1]
+
+		if !bytes.Equal(contents[match[4]:match[5]], []byte("m")) {
+			continue
+		}
+
+		state.apply(string(contents[match[2]:match[3]]))
+
+		if open {
+			output.WriteString("</span>")
+
+			open = false
+		}
+
+		style := state.style()
+		if style != "" {
+			output.WriteString(fmt.Sprintf(`<span style="%s">`, style))
+
+			open = true
+		}
+	}
+
+	output.WriteString(html.EscapeString(string(contents[last:])))
+
+	if open {
+		output.WriteString("</span>")
+	}
+
+	return output.String()
+}
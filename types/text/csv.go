@@ -0,0 +1,65 @@
+/*
+Copyright © 2024 Seednode <seednode@seedno.de>
+*/
+
+package text
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// Maximum number of rows rendered for a single CSV/TSV file
+const csvMaxRows = 1000
+
+// Renders comma- or tab-separated contents as an HTML table, with the
+// first row used as the header.
+func csvToHTML(contents []byte, separator rune) (string, error) {
+	reader := csv.NewReader(bytes.NewReader(contents))
+	reader.Comma = separator
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var table strings.Builder
+
+	table.WriteString(`<table class="csv">`)
+
+	rows := 0
+
+	for {
+		record, err := reader.Read()
+		switch {
+		case errors.Is(err, io.EOF):
+			table.WriteString(`</table>`)
+
+			return table.String(), nil
+		case err != nil:
+			return "", err
+		}
+
+		if rows == csvMaxRows {
+			table.WriteString(`</table>`)
+			table.WriteString(fmt.Sprintf(`<p>Only the first %d rows are displayed.</p>`, csvMaxRows))
+
+			return table.String(), nil
+		}
+
+		cell := "td"
+		if rows == 0 {
+			cell = "th"
+		}
+
+		table.WriteString(`<tr>`)
+		for _, field := range record {
+			table.WriteString(fmt.Sprintf(`<%s>%s</%s>`, cell, html.EscapeString(field), cell))
+		}
+		table.WriteString(`</tr>`)
+
+		rows++
+	}
+}
@@ -5,9 +5,11 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package text
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"unicode/utf8"
 
@@ -24,28 +26,59 @@ func (t Format) CSS() string {
 	css.WriteString(`table{margin-left:auto;margin-right:auto;}`)
 	css.WriteString(`textarea{border:none;caret-color:transparent;outline:none;margin:.5rem;`)
 	css.WriteString(`height:99%;width:99%;white-space:pre;overflow:auto;}`)
+	css.WriteString(`pre{margin:.5rem;height:99%;width:99%;white-space:pre;overflow:auto;}`)
+	css.WriteString(`div.csv{margin:.5rem;height:99%;width:99%;overflow:auto;}`)
+	css.WriteString(`table.csv{margin:0;border-collapse:collapse;}`)
+	css.WriteString(`table.csv th,table.csv td{border:1px solid #ccc;padding:.2rem .4rem;white-space:nowrap;text-align:left;}`)
+	css.WriteString(`table.csv th{position:sticky;top:0;background-color:#eee;}`)
 
 	return css.String()
 }
 
-func (t Format) Title(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	return fmt.Sprintf(`<title>%s</title>`, fileName), nil
+func (t Format) Title(ctx context.Context, opts types.Options) (string, error) {
+	return fmt.Sprintf(`<title>%s</title>`, opts.FileName), nil
 }
 
-func (t Format) Body(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	body, err := os.ReadFile(filePath)
+func (t Format) Body(ctx context.Context, opts types.Options) (string, error) {
+	body, err := os.ReadFile(opts.FilePath)
 	if err != nil {
 		body = []byte{}
 	}
 
+	var separator rune
+
+	switch filepath.Ext(opts.FilePath) {
+	case `.csv`:
+		separator = ','
+	case `.tsv`:
+		separator = '\t'
+	}
+
+	if separator != 0 {
+		table, err := csvToHTML(body, separator)
+		if err == nil {
+			return fmt.Sprintf(`<a href="%s"><div class="csv">%s</div></a>`,
+				opts.RootUrl,
+				table), nil
+		}
+	}
+
+	if hasANSI(body) {
+		return fmt.Sprintf(`<a href="%s"><pre>%s</pre></a>`,
+			opts.RootUrl,
+			ansiToHTML(body)), nil
+	}
+
 	return fmt.Sprintf(`<a href="%s"><textarea autofocus readonly>%s</textarea></a>`,
-		rootUrl,
+		opts.RootUrl,
 		body), nil
 }
 
 func (t Format) Extensions() map[string]string {
 	return map[string]string{
 		`.csv`: `text/csv`,
+		`.log`: `text/plain`,
+		`.tsv`: `text/tab-separated-values`,
 		`.txt`: `text/plain`,
 	}
 }
@@ -77,6 +110,10 @@ func (t Format) Validate(filePath string) bool {
 	return utf8.Valid(head)
 }
 
+func (t Format) Name() string {
+	return "text"
+}
+
 func (t Format) Type() string {
 	return "inline"
 }
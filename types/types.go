@@ -5,14 +5,172 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package types
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/spf13/pflag"
 )
 
 var SupportedFormats = make(Types)
 
+var ErrInvalidSize = errors.New("size must be a non-negative number with an optional unit (e.g. \"512KB\" or \"1MiB\")")
+
+// Minimum duration, in seconds, of files whose playback position is saved.
+const resumeMinDuration = 300
+
+// Media types returned by http.DetectContentType which differ
+// from those registered by the corresponding formats.
+var sniffedAliases = map[string]string{
+	`application/ogg`: `audio/ogg`,
+	`audio/wave`:      `audio/wav`,
+	`video/avi`:       `video/x-msvideo`,
+}
+
+// Hints provided by the client about how the page will be displayed.
+type ClientHints struct {
+	// Whether the client requested reduced data usage, via Save-Data
+	SaveData bool
+
+	// Width of the client's viewport in CSS pixels, via Viewport-Width,
+	// or 0 if not provided
+	ViewportWidth int
+}
+
+// Per-request values used to render the page for a file.
+type Options struct {
+	// URL of the root page, including any query parameters to carry over
+	RootUrl string
+
+	// URL the file itself is served from
+	FileUri string
+
+	// Path to the file on disk
+	FilePath string
+
+	// Base name of the file
+	FileName string
+
+	// Prefix all URLs are served under, if any
+	Prefix string
+
+	// Media type of the file
+	MediaType string
+
+	// Name of the syntax highlighting theme to use
+	Theme string
+
+	// Nonce which inline scripts must carry to be permitted to run
+	Nonce string
+
+	// Whether audio and video should start automatically, if requested,
+	// overriding the default set by the format's --no-autoplay flag
+	Autoplay *bool
+
+	// Whether audio and video should repeat once finished, and start muted
+	Loop  bool
+	Muted bool
+
+	Hints ClientHints
+}
+
+// Registers the --no-autoplay flag shared by the audio and video formats,
+// unless the other format has already done so.
+func RegisterAutoplayFlag(flags *pflag.FlagSet) {
+	if flags.Lookup("no-autoplay") != nil {
+		return
+	}
+
+	flags.Bool("no-autoplay", false, "do not start playing audio and video automatically, unless requested via the autoplay query parameter")
+}
+
+// Returns the value of the --no-autoplay flag.
+func NoAutoplay(flags *pflag.FlagSet) (bool, error) {
+	return flags.GetBool("no-autoplay")
+}
+
+// Returns the attributes controlling playback of audio and video
+// elements, each preceded by a space. Unless requested otherwise,
+// playback starts automatically if noAutoplay is false.
+func (o Options) PlaybackAttributes(noAutoplay bool) string {
+	var attributes strings.Builder
+
+	autoplay := !noAutoplay
+	if o.Autoplay != nil {
+		autoplay = *o.Autoplay
+	}
+
+	if autoplay {
+		attributes.WriteString(" autoplay")
+	}
+
+	if o.Loop {
+		attributes.WriteString(" loop")
+	}
+
+	if o.Muted {
+		attributes.WriteString(" muted")
+	}
+
+	return attributes.String()
+}
+
+// Returns the string as a quoted JavaScript string literal, which is
+// safe to include within a script element.
+func Quote(s string) string {
+	return strings.ReplaceAll(strconv.Quote(s), "<", `\u003c`)
+}
+
+// Styles the caption overlay displayed by formats which support captions.
+const CaptionCSS = `.caption{position:fixed;bottom:0;left:0;right:0;margin:0;padding:.5em;text-align:center;` +
+	`color:#fff;background-color:rgba(0,0,0,.6);font-family:sans-serif;white-space:pre-wrap;}`
+
+// Returns a caption overlay containing the specified text,
+// or an empty string if there is no caption.
+func Caption(caption string) string {
+	if caption == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(`<p class="caption">%s</p>`, html.EscapeString(caption))
+}
+
+// Returns a script which saves the playback position of long audio and
+// video files in the browser's local storage, and resumes playback from
+// that position when the same file is served again.
+func (o Options) ResumeScript() string {
+	var script strings.Builder
+
+	script.WriteString(fmt.Sprintf(`<script nonce="%s">(function(){`, o.Nonce))
+	script.WriteString(`var media = document.querySelector("audio, video");`)
+	script.WriteString(fmt.Sprintf(`var key = "roulette-position:" + %s;`, Quote(o.FileUri)))
+	script.WriteString(fmt.Sprintf(`function long() { return media.duration >= %d; }`, resumeMinDuration))
+	script.WriteString(`function store(f) { try { f(window.localStorage); } catch (e) {} }`)
+	script.WriteString(`function resume() { if (!long()) { return; }`)
+	script.WriteString(`store(function (s) { var position = parseFloat(s.getItem(key));`)
+	script.WriteString(`if (position > 0 && position < media.duration - 10) { media.currentTime = position; } }); }`)
+	script.WriteString(`if (media.readyState >= 1) { resume(); } else { media.addEventListener("loadedmetadata", resume); }`)
+	script.WriteString(`var saved = 0;`)
+	script.WriteString(`media.addEventListener("timeupdate", function () { if (!long() || Math.abs(media.currentTime - saved) < 5) { return; }`)
+	script.WriteString(`saved = media.currentTime; store(function (s) { s.setItem(key, saved); }); });`)
+	script.WriteString(`media.addEventListener("ended", function () { store(function (s) { s.removeItem(key); }); });`)
+	script.WriteString(`})();</script>`)
+
+	return script.String()
+}
+
 type Type interface {
+	// Returns the name used to enable this format (e.g. "images")
+	Name() string
+
 	// Returns either "inline" or "embed", depending on whether the file
 	// should be displayed inline (e.g. code) or embedded (e.g. images)
 	Type() string
@@ -21,10 +179,10 @@ type Type interface {
 	CSS() string
 
 	// Returns an HTML <title> element for the specified file
-	Title(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error)
+	Title(ctx context.Context, opts Options) (string, error)
 
 	// Returns an HTML <body> element used to display the specified file
-	Body(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error)
+	Body(ctx context.Context, opts Options) (string, error)
 
 	// Returns a map of file extensions to MIME type strings.
 	Extensions() map[string]string
@@ -38,6 +196,16 @@ type Type interface {
 	Validate(filePath string) bool
 }
 
+// Optionally implemented by formats which accept command-line flags of
+// their own, in addition to the flag enabling them.
+type Configurable interface {
+	// Registers the format's flags on the specified flag set
+	RegisterFlags(flags *pflag.FlagSet)
+
+	// Returns a copy of the format configured by the parsed flags
+	Configure(flags *pflag.FlagSet) (Type, error)
+}
+
 type Types map[string]Type
 
 func (t Types) Add(format Type) {
@@ -58,6 +226,25 @@ func (t Types) FileType(path string) Type {
 	return nil
 }
 
+// Assigns the specified extension to the format with the given name,
+// replacing any existing assignment. Returns false if no format with
+// that name is present in the collection.
+func (t Types) Map(extension, name string) bool {
+	for _, format := range t {
+		if format.Name() == name {
+			t[extension] = format
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t Types) Unmap(extension string) {
+	delete(t, extension)
+}
+
 func (t Types) Register(format Type) {
 	t.Add(format)
 }
@@ -71,6 +258,85 @@ func (t Types) Validate(path string) bool {
 	return format.Validate(path)
 }
 
+// Determines the format of a file from its leading bytes, for use when
+// the file's extension is missing or unregistered. Returns the matching
+// format and one of its extensions, or nil if no match was found.
+func (t Types) Sniff(path string) (Type, string) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, ""
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+
+	n, err := file.Read(head)
+	if err != nil || n == 0 {
+		return nil, ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if err != nil {
+		return nil, ""
+	}
+
+	alias, exists := sniffedAliases[mediaType]
+	if exists {
+		mediaType = alias
+	}
+
+	extensions := make([]string, 0, len(t))
+
+	for k := range t {
+		extensions = append(extensions, k)
+	}
+
+	slices.Sort(extensions)
+
+	for _, extension := range extensions {
+		format := t[extension]
+
+		if format.MediaType(extension) == mediaType && format.Validate(path) {
+			return format, extension
+		}
+	}
+
+	return nil, ""
+}
+
+// Returns the sorted names of all formats in the collection.
+func (t Types) Names() []string {
+	var names []string
+
+	for _, format := range t {
+		if !slices.Contains(names, format.Name()) {
+			names = append(names, format.Name())
+		}
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// Registers the flags of each configurable format in the collection.
+func (t Types) RegisterFlags(flags *pflag.FlagSet) {
+	registered := make(map[string]bool)
+
+	for _, name := range t.Names() {
+		for _, format := range t {
+			configurable, ok := format.(Configurable)
+			if !ok || format.Name() != name || registered[name] {
+				continue
+			}
+
+			configurable.RegisterFlags(flags)
+
+			registered[name] = true
+		}
+	}
+}
+
 func (t Types) GetExtensions() string {
 	var output strings.Builder
 
@@ -86,7 +352,10 @@ func (t Types) GetExtensions() string {
 	slices.Sort(extensions)
 
 	for _, v := range extensions {
-		output.WriteString(v + "\n")
+		// Files with no extension are keyed by the empty string
+		if v != "" {
+			output.WriteString(v + "\n")
+		}
 	}
 
 	return output.String()
@@ -129,3 +398,41 @@ func removeDuplicateStr(strSlice []string) []string {
 	}
 	return list
 }
+
+// Returns the number of bytes in a size such as "512KB" or "1MiB".
+func ParseSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KIB", 1 << 10},
+		{"MIB", 1 << 20},
+		{"GIB", 1 << 30},
+		{"TIB", 1 << 40},
+		{"KB", 1000},
+		{"MB", 1000 * 1000},
+		{"GB", 1000 * 1000 * 1000},
+		{"TB", 1000 * 1000 * 1000 * 1000},
+		{"B", 1},
+	}
+
+	value := strings.ToUpper(strings.TrimSpace(size))
+
+	multiplier := int64(1)
+
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, ErrInvalidSize
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
@@ -5,14 +5,37 @@ Copyright © 2024 Seednode <seednode@seedno.de>
 package video
 
 import (
+	"context"
 	"fmt"
+	"html"
 	"path/filepath"
 	"strings"
 
+	"github.com/spf13/pflag"
 	"seedno.de/seednode/roulette/types"
 )
 
-type Format struct{}
+type Format struct {
+	Caption       string
+	NoAutoplay    bool
+	StoryboardUri string
+	TranscodeUri  string
+}
+
+func (t Format) RegisterFlags(flags *pflag.FlagSet) {
+	types.RegisterAutoplayFlag(flags)
+}
+
+func (t Format) Configure(flags *pflag.FlagSet) (types.Type, error) {
+	noAutoplay, err := types.NoAutoplay(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	t.NoAutoplay = noAutoplay
+
+	return t, nil
+}
 
 func (t Format) CSS() string {
 	var css strings.Builder
@@ -22,24 +45,99 @@ func (t Format) CSS() string {
 	css.WriteString(`table{margin-left:auto;margin-right:auto;}`)
 	css.WriteString(`video{margin:auto;display:block;max-width:97%;max-height:97%;`)
 	css.WriteString(`object-fit:scale-down;position:absolute;top:50%;left:50%;transform:translate(-50%,-50%);}`)
+	css.WriteString(`#storyboard{display:none;position:fixed;pointer-events:none;background-repeat:no-repeat;border:1px solid #fff;z-index:1;}`)
+	css.WriteString(`#unsupported{display:none;text-align:center;position:absolute;top:50%;left:50%;transform:translate(-50%,-50%);}`)
+	css.WriteString(types.CaptionCSS)
 
 	return css.String()
 }
 
-func (t Format) Title(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	return fmt.Sprintf(`<title>%s</title>`, fileName), nil
+func (t Format) Title(ctx context.Context, opts types.Options) (string, error) {
+	return fmt.Sprintf(`<title>%s</title>`, opts.FileName), nil
+}
+
+func (t Format) Body(ctx context.Context, opts types.Options) (string, error) {
+	var body strings.Builder
+
+	alt := "Roulette selected: " + opts.FileName
+	if t.Caption != "" {
+		alt = t.Caption
+	}
+
+	// Replaces the player with a download link if the browser is unable to play the file
+	body.WriteString(fmt.Sprintf(`<a href="%s"><video controls%s preload="auto" aria-label="%s"><source src="%s" type="%s" alt="%s">Your browser does not support the video tag.</video></a>`,
+		opts.RootUrl,
+		opts.PlaybackAttributes(t.NoAutoplay),
+		html.EscapeString(alt),
+		html.EscapeString(opts.FileUri),
+		opts.MediaType,
+		html.EscapeString(alt)))
+	body.WriteString(fmt.Sprintf(`<script nonce="%s">document.querySelector("video source").addEventListener("error", function () { document.querySelector("video").style.display = "none"; document.getElementById("unsupported").style.display = "block"; });</script>`,
+		opts.Nonce))
+
+	body.WriteString(opts.ResumeScript())
+
+	if t.StoryboardUri != "" {
+		body.WriteString(storyboard(t.StoryboardUri, opts.Nonce))
+	}
+
+	if t.TranscodeUri != "" {
+		body.WriteString(fmt.Sprintf(`<p id="unsupported">Your browser is unable to play %s. <a href="%s">Play a transcoded copy</a>, <a href="%s" download>download it</a>, or <a href="%s">view another file</a>.</p>`,
+			html.EscapeString(opts.FileName),
+			html.EscapeString(t.TranscodeUri),
+			html.EscapeString(opts.FileUri),
+			opts.RootUrl))
+	} else {
+		body.WriteString(fmt.Sprintf(`<p id="unsupported">Your browser is unable to play %s. <a href="%s" download>Download it</a> or <a href="%s">view another file</a>.</p>`,
+			html.EscapeString(opts.FileName),
+			html.EscapeString(opts.FileUri),
+			opts.RootUrl))
+	}
+
+	body.WriteString(types.Caption(t.Caption))
+
+	return body.String(), nil
 }
 
-func (t Format) Body(rootUrl, fileUri, filePath, fileName, prefix, mime string) (string, error) {
-	return fmt.Sprintf(`<a href="%s"><video controls autoplay loop preload="auto"><source src="%s" type="%s" alt="Roulette selected: %s">Your browser does not support the video tag.</video></a>`,
-		rootUrl,
-		fileUri,
-		mime,
-		fileName), nil
+// Returns a storyboard track for the video, along with a script which
+// displays the matching thumbnail while hovering over the seek bar.
+func storyboard(uri, nonce string) string {
+	var html strings.Builder
+
+	html.WriteString(`<div id="storyboard"></div>`)
+	html.WriteString(fmt.Sprintf(`<script nonce="%s">(function(){`, nonce))
+	html.WriteString(`var video = document.querySelector("video");`)
+	html.WriteString(`var preview = document.getElementById("storyboard");`)
+	html.WriteString(`var element = document.createElement("track");`)
+	html.WriteString(fmt.Sprintf(`element.kind = "metadata"; element.src = %s; video.appendChild(element);`, types.Quote(uri)))
+	html.WriteString(`var track = element.track; track.mode = "hidden";`)
+	html.WriteString(`function hide() { preview.style.display = "none"; }`)
+	html.WriteString(`video.addEventListener("mousemove", function (e) {`)
+	html.WriteString(`var rect = video.getBoundingClientRect();`)
+	// Native controls place the seek bar along the bottom of the video
+	html.WriteString(`if (e.clientY < rect.bottom - 40 || !video.duration || !track.cues) { hide(); return; }`)
+	html.WriteString(`var time = (e.clientX - rect.left) / rect.width * video.duration;`)
+	html.WriteString(`for (var i = 0; i < track.cues.length; i++) { var cue = track.cues[i];`)
+	html.WriteString(`if (time < cue.startTime || time >= cue.endTime) { continue; }`)
+	html.WriteString(`var parts = cue.text.split("#xywh="); var xywh = parts[1].split(",");`)
+	html.WriteString(`preview.style.backgroundImage = "url(\"" + parts[0] + "\")";`)
+	html.WriteString(`preview.style.backgroundPosition = "-" + xywh[0] + "px -" + xywh[1] + "px";`)
+	html.WriteString(`preview.style.width = xywh[2] + "px"; preview.style.height = xywh[3] + "px";`)
+	html.WriteString(`preview.style.left = (e.clientX - xywh[2] / 2) + "px"; preview.style.top = (rect.bottom - 48 - xywh[3]) + "px";`)
+	html.WriteString(`preview.style.display = "block"; return; }`)
+	html.WriteString(`hide(); });`)
+	html.WriteString(`video.addEventListener("mouseleave", hide);`)
+	html.WriteString(`})();</script>`)
+
+	return html.String()
 }
 
 func (t Format) Extensions() map[string]string {
 	return map[string]string{
+		`.avi`:  `video/x-msvideo`,
+		`.m4v`:  `video/mp4`,
+		`.mkv`:  `video/x-matroska`,
+		`.mov`:  `video/quicktime`,
 		`.mp4`:  `video/mp4`,
 		`.ogm`:  `video/ogg`,
 		`.ogv`:  `video/ogg`,
@@ -64,6 +162,10 @@ func (t Format) Validate(filePath string) bool {
 	return true
 }
 
+func (t Format) Name() string {
+	return "video"
+}
+
 func (t Format) Type() string {
 	return "embed"
 }
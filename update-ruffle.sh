@@ -0,0 +1,32 @@
+#!/usr/bin/env bash
+# download the latest self-hosted ruffle release into types/flash/ruffle,
+# to be embedded into the binary at build time
+
+# exit if a command fails
+set -o errexit
+
+# directory containing embedded ruffle assets
+ruffle_dir="types/flash/ruffle"
+
+# release to download, defaulting to the latest nightly
+release="${RELEASE:-$(curl -fsSL "https://api.github.com/repos/ruffle-rs/ruffle/releases?per_page=1" | grep -m1 '"tag_name"' | awk -F'"' '{print $4}')}"
+
+# find the self-hosted web package for the selected release
+asset_url="$(curl -fsSL "https://api.github.com/repos/ruffle-rs/ruffle/releases/tags/${release}" | grep '"browser_download_url"' | grep 'web-selfhosted.zip' | head -n1 | awk -F'"' '{print $4}')"
+
+if [ -z "${asset_url}" ]; then
+  echo "No self-hosted package found for release ${release}" >&2
+  exit 1
+fi
+
+tmp_dir="$(mktemp -d)"
+trap 'rm -rf "${tmp_dir}"' EXIT
+
+curl -fsSL -o "${tmp_dir}/ruffle.zip" "${asset_url}"
+
+# replace existing assets with the new release
+find "${ruffle_dir}" -mindepth 1 -delete
+unzip -q "${tmp_dir}/ruffle.zip" '*.js' '*.wasm' -d "${ruffle_dir}"
+echo "${release}" > "${ruffle_dir}/VERSION"
+
+echo "Updated ruffle to ${release}"